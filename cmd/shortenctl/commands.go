@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/boltdb"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/postgres"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/sqlite"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/storageconf"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/transfer"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/aidlatyp/ya-pr-shortener/internal/config"
+)
+
+// restoreChunkSize bounds number of links written at once on restore
+const restoreChunkSize = 1000
+
+func list(ctx context.Context, repo usecase.AdminRepository, args []string) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tCREATED\tORIGINAL")
+
+	err := repo.ForEach(ctx, args[0], func(url *domain.URL) error {
+		_, err := fmt.Fprintf(writer, "%v\t%v\t%v\n", url.Short, url.CreatedAt.Format(time.RFC3339), url.Orig)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func get(ctx context.Context, repo usecase.AdminRepository, args []string) error {
+	url, err := repo.FindByKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(url)
+}
+
+func deleteLink(ctx context.Context, repo usecase.AdminRepository, args []string) error {
+	return repo.Delete(ctx, args[0])
+}
+
+func reassign(ctx context.Context, repo usecase.AdminRepository, args []string) error {
+	return repo.Reassign(ctx, args[0], args[1])
+}
+
+func users(ctx context.Context, repo usecase.AdminRepository, _ []string) error {
+	count, err := repo.CountUsers(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println(count)
+	return nil
+}
+
+// dump writes links in the same JSON lines format file storage uses
+func dump(ctx context.Context, repo usecase.AdminRepository, args []string) error {
+	var output io.Writer = os.Stdout
+	if len(args) > 0 {
+		file, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+
+	buffered := bufio.NewWriter(output)
+	encoder := json.NewEncoder(buffered)
+	count := 0
+	err := repo.Dump(ctx, func(url *domain.URL) error {
+		count++
+		return encoder.Encode(url)
+	})
+	if err != nil {
+		return err
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%v links dumped\n", count)
+	return nil
+}
+
+// restore writes links in chunks, links with existing ids are overwritten
+func restore(ctx context.Context, repo usecase.AdminRepository, args []string) error {
+	var input io.Reader = os.Stdin
+	if len(args) > 0 {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(input))
+	chunk := make([]domain.URL, 0, restoreChunkSize)
+	count := 0
+	write := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := repo.BatchWrite(ctx, chunk); err != nil {
+			return fmt.Errorf("restore stopped after %v links: %w", count, err)
+		}
+		count += len(chunk)
+		chunk = chunk[:0]
+		return nil
+	}
+
+	for {
+		var url domain.URL
+		err := decoder.Decode(&url)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("restore stopped after %v links: %w", count, err)
+		}
+		chunk = append(chunk, url)
+		if len(chunk) == restoreChunkSize {
+			if err = write(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%v links restored\n", count)
+	return nil
+}
+
+// openMigrationTarget opens storage given as the second migrate argument or configured one
+func openMigrationTarget(ctx context.Context, appConf *config.AppConfig, args []string) (usecase.AdminRepository, io.Closer, error) {
+	if len(args) > 1 {
+		return transfer.Open(ctx, args[1], storageconf.Postgres(appConf)...)
+	}
+	return openStorage(ctx, appConf, args)
+}
+
+// migrate copies links from storage given by the first argument into opened storage
+func migrate(ctx context.Context, repo usecase.AdminRepository, args []string) error {
+	src, closer, err := transfer.Open(ctx, args[0], storageconf.Postgres(config.NewAppConfig())...)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	report, err := transfer.Copy(ctx, src, repo, transfer.WithProgress(func(p transfer.Progress) {
+		fmt.Fprintf(os.Stderr, "%v links read, %v copied, %v already present\n", p.Read, p.Copied, p.Skipped)
+	}))
+	if err != nil {
+		return err
+	}
+	if report.Users > 0 {
+		fmt.Fprintf(os.Stderr, "%v users registered\n", report.Users)
+	}
+	fmt.Fprintf(os.Stderr, "%v links verified with checksum %v\n", report.Read, report.Checksum)
+	return nil
+}
+
+// openSchema connects to database without migrating it, unlike the server
+func openSchema(ctx context.Context, appConf *config.AppConfig, _ []string) (usecase.AdminRepository, io.Closer, error) {
+	if appConf.StorageEngine == config.EngineSQLite {
+		db, err := sqlite.Connect(ctx, appConf.SQLitePath, storageconf.SQLite(appConf)...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't open sqlite storage: %w", err)
+		}
+		return db, db, nil
+	}
+	if appConf.DBConnect == "" {
+		return nil, nil, errors.New("schema is kept by Postgres only, set DATABASE_DSN (-d)")
+	}
+	pg, err := postgres.Connect(ctx, appConf.DBConnect, storageconf.Postgres(appConf)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't open database: %w", err)
+	}
+	return pg, pg, nil
+}
+
+// schemaKeeper is a storage with versioned schema
+type schemaKeeper interface {
+	MigrateTo(ctx context.Context, version int) error
+	SchemaVersion(ctx context.Context) (int, error)
+}
+
+// schema shows schema version or migrates schema to version given
+func schema(ctx context.Context, repo usecase.AdminRepository, args []string) error {
+	keeper := repo.(schemaKeeper)
+	latestVersion := postgres.LatestSchemaVersion
+	if _, ok := repo.(*sqlite.DB); ok {
+		latestVersion = sqlite.LatestSchemaVersion
+	}
+
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("version must be a number: %w", err)
+		}
+		if err = keeper.MigrateTo(ctx, version); err != nil {
+			return err
+		}
+	}
+
+	current, err := keeper.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	latest, err := latestVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %v, latest %v\n", current, latest)
+	return nil
+}
+
+// backup copies bolt storage, the copy can be opened as storage right away
+func backup(_ context.Context, repo usecase.AdminRepository, args []string) error {
+	db, ok := repo.(*boltdb.DB)
+	if !ok {
+		return errors.New("backup is made of bolt storage only, set STORAGE_ENGINE=bolt")
+	}
+	written, err := db.BackupFile(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%v bytes written\n", written)
+	return nil
+}
+
+// nopCloser closes nothing
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// openNone is for commands which work with files rather than opened storage
+func openNone(context.Context, *config.AppConfig, []string) (usecase.AdminRepository, io.Closer, error) {
+	return nil, nopCloser{}, nil
+}
+
+// reencrypt rewrites file log under the current key, old keys must be kept to open records sealed with them
+func reencrypt(_ context.Context, _ usecase.AdminRepository, _ []string) error {
+	appConf := config.NewAppConfig()
+	if appConf.FilePath == "" {
+		return errors.New("file storage is not configured, set FILE_STORAGE_PATH (-f)")
+	}
+	keyring, err := storage.LoadKeyring(appConf.FileKeys, appConf.FileKeyFile)
+	if err != nil {
+		return err
+	}
+	if keyring == nil {
+		return errors.New("encryption keys are not configured, set FILE_ENCRYPTION_KEYS or FILE_ENCRYPTION_KEY_FILE")
+	}
+	count, err := storage.Reencrypt(appConf.FilePath, keyring)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%v records sealed with key %v\n", count, keyring.Current())
+	return nil
+}
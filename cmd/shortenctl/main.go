@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/postgres"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/sqlite"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/storageconf"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/transfer"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/aidlatyp/ya-pr-shortener/internal/config"
+	"github.com/spf13/pflag"
+)
+
+const usage = `shortenctl works with shortener storage directly, while the server is down.
+Storage is configured the same way as the server: STORAGE_ENGINE chooses one explicitly,
+otherwise DATABASE_DSN or -d is for Postgres and FILE_STORAGE_PATH or -f for file storage.
+
+Usage:
+  shortenctl [flags] <command> [arguments]
+
+Commands:
+  list <user>             list links of a user
+  get <id>                show a link
+  delete <id>             delete a link
+  reassign <id> <user>    give a link to another user
+  users                   count users
+  dump [file]             write every link as JSON lines to file or stdout
+  restore [file]          read links written by dump from file or stdin
+  migrate <from> [to]     copy every link and user from one storage into another,
+                          configured storage is the target if to is omitted
+  schema [version]        show Postgres or SQLite schema version or migrate it up or down to version
+  backup <file>           copy bolt storage file consistently
+  reencrypt               rewrite file log sealing every record with the current encryption key
+
+Storages for migrate are file:<path>, snapshot:<path> (a dump file), bolt:<path>,
+sqlite:<path> or postgres:<dsn> with any Postgres connection string. Migration can be run again safely,
+links the target already has with the same settings are skipped and a link which differs stops it.
+History of changed originals is not migrated.
+
+File log records are sealed with the first of FILE_ENCRYPTION_KEYS or FILE_ENCRYPTION_KEY_FILE keys,
+the rest open records sealed before. To rotate keys put a new one first and run reencrypt.
+
+Flags:
+`
+
+// command runs against opened storage with positional arguments which follow command name
+type command struct {
+	args int // number of required arguments
+	opt  int // number of optional arguments
+	run  func(ctx context.Context, repo usecase.AdminRepository, args []string) error
+	// open is used instead of configured storage if set
+	open func(ctx context.Context, appConf *config.AppConfig, args []string) (usecase.AdminRepository, io.Closer, error)
+}
+
+var commands = map[string]command{
+	"list":      {args: 1, run: list},
+	"get":       {args: 1, run: get},
+	"delete":    {args: 1, run: deleteLink},
+	"reassign":  {args: 2, run: reassign},
+	"users":     {run: users},
+	"dump":      {opt: 1, run: dump},
+	"restore":   {opt: 1, run: restore},
+	"migrate":   {args: 1, opt: 1, run: migrate, open: openMigrationTarget},
+	"schema":    {opt: 1, run: schema, open: openSchema},
+	"backup":    {args: 1, run: backup},
+	"reencrypt": {run: reencrypt, open: openNone},
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("shortenctl: ")
+
+	pflag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		pflag.PrintDefaults()
+	}
+
+	// configure from flags, env or by default, the same as server does
+	appConf := config.NewAppConfig()
+
+	args := pflag.Args()
+	if len(args) == 0 {
+		pflag.Usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[args[0]]
+	args = args[1:]
+	if !ok || len(args) < cmd.args || len(args) > cmd.args+cmd.opt {
+		pflag.Usage()
+		os.Exit(2)
+	}
+
+	open := openStorage
+	if cmd.open != nil {
+		open = cmd.open
+	}
+	// interrupted command stops storage operations it runs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	repo, closer, err := open(ctx, appConf, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cmd.run(ctx, repo, args)
+	if closeErr := closer.Close(); closeErr != nil {
+		log.Print(closeErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// openStorage opens configured engine or prefers Postgres like the server does
+func openStorage(ctx context.Context, appConf *config.AppConfig, _ []string) (usecase.AdminRepository, io.Closer, error) {
+	switch appConf.StorageEngine {
+	case "":
+	case config.EngineFile:
+		return openFile(appConf)
+	case config.EnginePostgres:
+		return transfer.Open(ctx, "postgres:"+appConf.DBConnect, storageconf.Postgres(appConf)...)
+	case config.EngineBolt:
+		return transfer.Open(ctx, "bolt:"+appConf.BoltPath)
+	case config.EngineSQLite:
+		db, err := sqlite.Open(ctx, appConf.SQLitePath, storageconf.SQLite(appConf)...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't open sqlite storage: %w", err)
+		}
+		return db, db, nil
+	default:
+		return nil, nil, fmt.Errorf("storage engine %q is not kept offline", appConf.StorageEngine)
+	}
+
+	if appConf.DBConnect != "" {
+		pg, err := postgres.NewDB(ctx, appConf.DBConnect, storageconf.Postgres(appConf)...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't open database: %w", err)
+		}
+		return pg, pg, nil
+	}
+	if appConf.FilePath != "" {
+		return openFile(appConf)
+	}
+	return nil, nil, errors.New("storage is not configured, set DATABASE_DSN (-d) or FILE_STORAGE_PATH (-f)")
+}
+
+// openFile opens file storage with encryption keys the server uses
+func openFile(appConf *config.AppConfig) (usecase.AdminRepository, io.Closer, error) {
+	keyring, err := storage.LoadKeyring(appConf.FileKeys, appConf.FileKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't load encryption keys: %w", err)
+	}
+	file, err := storage.NewPersistentStorage(appConf.FilePath, storage.WithKeyring(keyring))
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't open file storage: %w", err)
+	}
+	return file, file, nil
+}
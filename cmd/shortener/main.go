@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/handler"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/policy"
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/boltdb"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/cache"
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/postgres"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/replication"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/sqlite"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/storageconf"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/transfer"
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
 	"github.com/aidlatyp/ya-pr-shortener/internal/config"
 	"github.com/aidlatyp/ya-pr-shortener/internal/util"
@@ -18,20 +29,80 @@ func main() {
 	// configure from flags, env or by default
 	appConf := config.NewAppConfig()
 
-	// choose storage depending on if specified filepath or not
-	store := storage.NewStorage(appConf.FilePath)
+	pgOpts := storageconf.Postgres(appConf)
+	if appConf.MigrateOnly {
+		migrateSchema(appConf.DBConnect, pgOpts)
+		return
+	}
 
-	// connect database if connect string configured
-	pg, err := postgres.NewDB(appConf.DBConnect)
-	if err != nil {
-		log.Printf("can't start database due to: %v", err.Error())
-	} else {
-		store = pg
-		defer func() {
-			if err := pg.Close(); err != nil {
-				log.Print(err)
-			}
-		}()
+	store, pinger, closeStore := openStore(appConf, pgOpts)
+	defer closeStore()
+
+	// metrics are served by admin listener only, they are not for public eyes
+	metrics := handler.NewMetrics()
+	if bounded, ok := store.(*storage.BoundedStorage); ok {
+		metrics.Publish("memory", func() interface{} {
+			return bounded.Usage()
+		})
+	}
+
+	// file storage is replicated from leader to followers, follower storage changes by replication only
+	var routerOpts []handler.RouterOption
+	var replica *storage.PersistentStorage
+	switch appConf.ReplicationRole {
+	case "":
+	case config.RoleLeader:
+		if appConf.ReplicationToken == "" {
+			log.Fatal("leader serves its log to followers with REPLICATION_TOKEN only, set it")
+		}
+		leader := replication.NewLeader(replicatedLog(appConf, store), replication.WithToken(appConf.ReplicationToken))
+		routerOpts = append(routerOpts, handler.WithReplicationLog(replication.Path, leader))
+	case config.RoleFollower:
+		replica = replicatedLog(appConf, store)
+		if appConf.MigrateFrom != "" {
+			log.Fatal("follower takes links from leader only, unset MIGRATE_FROM")
+		}
+		leaderURL, err := url.Parse(appConf.ReplicationLeader)
+		if err != nil || leaderURL.Host == "" {
+			log.Fatalf("follower needs REPLICATION_LEADER base url, %q is given", appConf.ReplicationLeader)
+		}
+		routerOpts = append(routerOpts, handler.WithWriteForwarding(leaderURL))
+		store = replication.ReadOnly(store)
+	default:
+		log.Fatalf("unknown replication role %q, use leader or follower", appConf.ReplicationRole)
+	}
+
+	// copy links of previous storage, it is safe to leave it set as copied links are skipped
+	if appConf.MigrateFrom != "" {
+		migrateFrom(appConf.MigrateFrom, store, pgOpts)
+	}
+
+	// cache links in front of storage, redirects mostly read a few popular ones
+	var cached *cache.Repository
+	if appConf.CacheSize > 0 {
+		cached = cache.New(store,
+			cache.WithSize(appConf.CacheSize),
+			cache.WithTTL(time.Duration(appConf.CacheTTL)*time.Second),
+			cache.WithNegativeTTL(time.Duration(appConf.CacheNegativeTTL)*time.Second),
+		)
+		metrics.Publish("cache", func() interface{} {
+			return cached.Stats()
+		})
+		store = cached
+	}
+
+	if replica != nil {
+		followerOpts := []replication.Option{replication.WithToken(appConf.ReplicationToken)}
+		if cached != nil {
+			followerOpts = append(followerOpts, replication.WithApplied(func(short string) {
+				cached.Invalidate(short)
+			}))
+		}
+		follower := replication.NewFollower(appConf.ReplicationLeader, replica, followerOpts...)
+		metrics.Publish("replication", func() interface{} {
+			return follower.Stats()
+		})
+		go follower.Run(context.Background())
 	}
 
 	// Domain
@@ -39,14 +110,42 @@ func main() {
 	shortener := domain.NewShortener(gen)
 
 	// Use_cases
-	shortenUsecase := usecase.NewShorten(shortener, store)
-	dbCheckUsecase := usecase.NewLiveliness(pg)
+	usecaseOpts := []usecase.Option{usecase.WithQuerySorting(appConf.SortQuery)}
+
+	if err := usecase.ValidateRedirect(appConf.RedirectCode); err != nil {
+		log.Fatalf("REDIRECT_CODE must be 301, 302, 307 or 308: %v", err)
+	}
+	usecaseOpts = append(usecaseOpts,
+		usecase.WithDefaultRedirect(appConf.RedirectCode),
+		usecase.WithPasswordAttempts(appConf.PasswordAttempts, time.Duration(appConf.PasswordWindow)*time.Second),
+	)
+
+	// destinations policy is optional and reloaded on file changes
+	if appConf.PolicyFile != "" {
+		engine, err := policy.NewEngine(appConf.PolicyFile)
+		if err != nil {
+			log.Fatalf("policy file set, but can't be loaded %v ", err.Error())
+		}
+		if appConf.PolicyReloadInterval > 0 {
+			go engine.Watch(context.Background(), time.Duration(appConf.PolicyReloadInterval)*time.Second)
+		}
+		usecaseOpts = append(usecaseOpts, usecase.WithPolicy(engine))
+		log.Printf("policy loaded with %v rules", engine.Len())
+	}
+
+	shortenUsecase := usecase.NewShorten(shortener, store, usecaseOpts...)
+	dbCheckUsecase := usecase.NewLiveliness(pinger)
 
 	// Application Router
 	appRouter := handler.NewAppRouter(
 		appConf.BaseURL,
 		shortenUsecase,
 		dbCheckUsecase,
+		append(routerOpts,
+			handler.WithWarningPage(appConf.PolicyWarningPage),
+			handler.WithRedirectMaxAge(time.Duration(appConf.RedirectMaxAge)*time.Second),
+			handler.WithStreamTimeout(time.Duration(appConf.ServerTimeout)*time.Second),
+		)...,
 	)
 
 	// Start
@@ -57,8 +156,183 @@ func main() {
 		ReadTimeout:       time.Duration(appConf.ServerTimeout) * time.Second,
 		WriteTimeout:      time.Duration(appConf.ServerTimeout) * time.Second,
 	}
+	if appConf.AdminAddr != "" {
+		admin := http.Server{
+			Addr:              appConf.AdminAddr,
+			Handler:           handler.NewAdminRouter(metrics),
+			ReadHeaderTimeout: time.Duration(appConf.ServerTimeout) * time.Second,
+		}
+		log.Printf("admin server is starting at %v", appConf.AdminAddr)
+		go func() {
+			log.Fatalf("admin server finished with: %v", admin.ListenAndServe())
+		}()
+	}
 	log.Printf("server is starting at %v", appConf.ServerAddr)
 
-	err = server.ListenAndServe()
+	err := server.ListenAndServe()
 	log.Printf("server finished with: %v", err)
 }
+
+// migrateSchema brings database schema to the latest version
+func migrateSchema(dsn string, pgOpts []postgres.Option) {
+	pg, err := postgres.NewDB(context.Background(), dsn, pgOpts...)
+	if err != nil {
+		log.Fatalf("can't migrate database: %v", err)
+	}
+	_ = pg.Close()
+	log.Print("database schema is migrated")
+}
+
+// openStore opens configured storage engine, server does not start with storage
+// it is told to use but can't open, pinger tells if storage is available
+func openStore(appConf *config.AppConfig, pgOpts []postgres.Option) (usecase.Repository, usecase.ServicePinger, func()) {
+	closeWithLog := func(closer io.Closer) func() {
+		return func() {
+			if err := closer.Close(); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	closeStore := func(store usecase.Repository) func() {
+		if closer, ok := store.(io.Closer); ok {
+			return closeWithLog(closer)
+		}
+		return func() {}
+	}
+	ctx := context.Background()
+	// storages without database are reported by ping as not connected, as they always were
+	var noDB *postgres.DB
+
+	switch appConf.StorageEngine {
+	case "":
+		// connect database if connect string configured,
+		// server does not start with a schema it can't migrate
+		pg, err := postgres.NewDB(ctx, appConf.DBConnect, pgOpts...)
+		if errors.Is(err, postgres.ErrMigration) {
+			log.Fatal(err)
+		}
+		if err != nil {
+			log.Printf("can't start database due to: %v", err.Error())
+			// choose storage depending on if specified filepath or not
+			store := newLocalStore(appConf, appConf.FilePath)
+			return store, pg, closeStore(store)
+		}
+		return pg, pg, closeWithLog(pg)
+
+	case config.EngineMemory:
+		store := newLocalStore(appConf, "")
+		return store, noDB, closeStore(store)
+
+	case config.EngineFile:
+		if appConf.FilePath == "" {
+			log.Fatal("file storage engine needs FILE_STORAGE_PATH (-f)")
+		}
+		store := newLocalStore(appConf, appConf.FilePath)
+		return store, noDB, closeStore(store)
+
+	case config.EnginePostgres:
+		pg, err := postgres.NewDB(ctx, appConf.DBConnect, pgOpts...)
+		if err != nil {
+			log.Fatalf("can't start database due to: %v", err)
+		}
+		return pg, pg, closeWithLog(pg)
+
+	case config.EngineBolt:
+		db, err := boltdb.Open(appConf.BoltPath)
+		if err != nil {
+			log.Fatalf("can't open bolt storage %v: %v", appConf.BoltPath, err)
+		}
+		if appConf.BoltBackupPath != "" && appConf.BoltBackupInterval > 0 {
+			go backupPeriodically(db, appConf.BoltBackupPath, time.Duration(appConf.BoltBackupInterval)*time.Second)
+		}
+		return db, db, closeWithLog(db)
+
+	case config.EngineSQLite:
+		db, err := sqlite.Open(ctx, appConf.SQLitePath, storageconf.SQLite(appConf)...)
+		if err != nil {
+			log.Fatalf("can't open sqlite storage %v: %v", appConf.SQLitePath, err)
+		}
+		return db, db, closeWithLog(db)
+
+	default:
+		log.Fatalf("unknown storage engine %q, use memory, file, postgres, bolt or sqlite", appConf.StorageEngine)
+		return nil, nil, nil
+	}
+}
+
+// newLocalStore keeps links in memory and in file log at path if it is set.
+// Memory is bounded if configured, otherwise memory only storage may be sharded
+func newLocalStore(appConf *config.AppConfig, path string) usecase.Repository {
+	// records on disk are sealed if keys are configured
+	keyring, err := storage.LoadKeyring(appConf.FileKeys, appConf.FileKeyFile)
+	if err != nil {
+		log.Fatalf("can't load encryption keys: %v", err)
+	}
+
+	if appConf.MemoryMaxLinks > 0 || appConf.MemoryMaxBytes > 0 {
+		bounded, err := storage.NewBoundedStorage(path,
+			storage.WithMaxLinks(appConf.MemoryMaxLinks),
+			storage.WithMaxBytes(appConf.MemoryMaxBytes),
+			storage.WithEviction(storage.Eviction(appConf.MemoryEviction)),
+			storage.WithLogKeyring(keyring),
+		)
+		if err != nil {
+			log.Fatalf("can't start bounded storage: %v", err)
+		}
+		return bounded
+	}
+	if path == "" && appConf.MemoryShards > 0 {
+		return storage.NewShardedMemoryStorage(appConf.MemoryShards)
+	}
+	return storage.NewStorage(path, storage.WithKeyring(keyring))
+}
+
+// replicatedLog is file storage replication works with, other storages are not replicated
+func replicatedLog(appConf *config.AppConfig, store usecase.Repository) *storage.PersistentStorage {
+	persistent, ok := store.(*storage.PersistentStorage)
+	if !ok {
+		log.Fatalf("%v replicates file storage only, set STORAGE_ENGINE=file without memory bounds", appConf.ReplicationRole)
+	}
+	return persistent
+}
+
+// backupPeriodically copies bolt storage while server is running
+func backupPeriodically(db *boltdb.DB, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		written, err := db.BackupFile(path)
+		if err != nil {
+			log.Printf("bolt backup failed: %v", err)
+			continue
+		}
+		log.Printf("bolt backup of %v bytes is written to %v", written, path)
+	}
+}
+
+// migrateFrom copies every link from storage described by spec into store,
+// server does not start with partially copied links
+func migrateFrom(spec string, store usecase.Repository, pgOpts []postgres.Option) {
+	ctx := context.Background()
+	src, closer, err := transfer.Open(ctx, spec, pgOpts...)
+	if err != nil {
+		log.Fatalf("can't open storage to migrate from: %v", err)
+	}
+	defer func() {
+		if err := closer.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	log.Printf("migrating links from %v", spec)
+	report, err := transfer.Copy(ctx, src, store, transfer.WithProgress(func(p transfer.Progress) {
+		log.Printf("migration: %v links read, %v copied, %v already present", p.Read, p.Copied, p.Skipped)
+	}))
+	if err != nil {
+		log.Fatalf("migration failed: %v", err)
+	}
+	if report.Users > 0 {
+		log.Printf("migration: %v users registered", report.Users)
+	}
+	log.Printf("migration done: %v links verified with checksum %v", report.Read, report.Checksum)
+}
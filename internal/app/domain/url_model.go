@@ -1,11 +1,28 @@
 package domain
 
+import "time"
+
 // URL model represents an url as structure
 // to extend it with new properties
 type URL struct {
-	Orig  string
-	Short string
-	Owner string
+	Orig      string
+	Short     string
+	Owner     string
+	CreatedAt time.Time
+	// Redirect is HTTP status the link redirects with, zero one means server default
+	Redirect int `json:",omitempty"`
+	// PasswordHash is bcrypt hash of the password the link is protected with, links without one are open
+	PasswordHash string `json:",omitempty"`
+	// MaxClicks limits how many times the link is followed, zero means no limit.
+	// ClicksLeft are counted down from it, the link is used up at zero
+	MaxClicks  int `json:",omitempty"`
+	ClicksLeft int `json:",omitempty"`
+	// NotBefore and NotAfter bound when the link works, nil ones are open ends.
+	// Placeholder is followed before the window and Fallback after it
+	NotBefore   *time.Time `json:",omitempty"`
+	NotAfter    *time.Time `json:",omitempty"`
+	Placeholder string     `json:",omitempty"`
+	Fallback    string     `json:",omitempty"`
 }
 
 func NewURL(original, short string) *URL {
@@ -15,3 +32,9 @@ func NewURL(original, short string) *URL {
 		Owner: "",
 	}
 }
+
+// Version is a destination the link had before its original was changed
+type Version struct {
+	Orig       string
+	ReplacedAt time.Time
+}
@@ -0,0 +1,339 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	appMiddle "github.com/aidlatyp/ya-pr-shortener/internal/app/handler/middlewares"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+const (
+	// bulkChunkSize bounds number of items held in memory and written to storage at once
+	bulkChunkSize = 1000
+	// maxBulkLineSize bounds a single NDJSON line
+	maxBulkLineSize = 64 * 1024
+
+	ndjsonContentType = "application/x-ndjson"
+	csvContentType    = "text/csv"
+)
+
+// correlationReader decodes bulk input item by item
+type correlationReader interface {
+	// Read returns io.EOF at the end of input, *itemError for a malformed item
+	// which can be skipped and any other error if input can't be read further
+	Read() (usecase.Correlation, error)
+}
+
+// itemError describes malformed input item, reading can go on after it
+type itemError struct {
+	line          int
+	correlationID string
+	err           error
+}
+
+func (e *itemError) Error() string {
+	return fmt.Sprintf("line %v: %v", e.line, e.err)
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONReader(reader io.Reader) *ndjsonReader {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 4096), maxBulkLineSize)
+	return &ndjsonReader{scanner: scanner}
+}
+
+func (r *ndjsonReader) Read() (usecase.Correlation, error) {
+	var item usecase.Correlation
+	for r.scanner.Scan() {
+		r.line++
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(line, &item); err != nil {
+			return item, &itemError{line: r.line, err: err}
+		}
+		return item, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return item, err
+	}
+	return item, io.EOF
+}
+
+// csvSettings parse optional columns of link settings, empty values are left unset
+var csvSettings = map[string]func(item *usecase.Correlation, value string) error{
+	"redirect": func(item *usecase.Correlation, value string) (err error) {
+		item.Redirect, err = strconv.Atoi(value)
+		return err
+	},
+	"password": func(item *usecase.Correlation, value string) error {
+		item.Password = value
+		return nil
+	},
+	"max_clicks": func(item *usecase.Correlation, value string) (err error) {
+		item.MaxClicks, err = strconv.Atoi(value)
+		return err
+	},
+	"not_before": func(item *usecase.Correlation, value string) error {
+		return parseCSVTime(&item.NotBefore, value)
+	},
+	"not_after": func(item *usecase.Correlation, value string) error {
+		return parseCSVTime(&item.NotAfter, value)
+	},
+	"placeholder_url": func(item *usecase.Correlation, value string) error {
+		item.PlaceholderURL = value
+		return nil
+	},
+	"fallback_url": func(item *usecase.Correlation, value string) error {
+		item.FallbackURL = value
+		return nil
+	},
+}
+
+func parseCSVTime(t **time.Time, value string) error {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return err
+	}
+	*t = &parsed
+	return nil
+}
+
+type csvReader struct {
+	reader    *csv.Reader
+	idColumn  int
+	urlColumn int
+	// settings are optional columns found in header in their order
+	settings []settingColumn
+}
+
+type settingColumn struct {
+	index int
+	parse func(*usecase.Correlation, string) error
+}
+
+// newCSVReader reads header to find correlation_id and original_url columns and optional ones of link settings,
+// which may go in any order along with any other columns
+func newCSVReader(reader io.Reader) (*csvReader, error) {
+	r := &csvReader{
+		reader:    csv.NewReader(reader),
+		idColumn:  -1,
+		urlColumn: -1,
+	}
+	r.reader.FieldsPerRecord = -1
+	r.reader.ReuseRecord = true
+
+	header, err := r.reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("can't read csv header: %w", err)
+	}
+	for i, column := range header {
+		switch column {
+		case "correlation_id":
+			r.idColumn = i
+		case "original_url":
+			r.urlColumn = i
+		default:
+			if parse, ok := csvSettings[column]; ok {
+				r.settings = append(r.settings, settingColumn{index: i, parse: parse})
+			}
+		}
+	}
+	if r.idColumn < 0 || r.urlColumn < 0 {
+		return nil, errors.New("csv header must have correlation_id and original_url columns")
+	}
+	return r, nil
+}
+
+func (r *csvReader) Read() (usecase.Correlation, error) {
+	var item usecase.Correlation
+
+	record, err := r.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return item, &itemError{line: parseErr.Line, err: parseErr.Err}
+		}
+		return item, err
+	}
+
+	line, _ := r.reader.FieldPos(0)
+	if r.idColumn < len(record) {
+		item.CorrelationID = record[r.idColumn]
+	}
+	if r.idColumn >= len(record) || r.urlColumn >= len(record) {
+		return item, &itemError{line: line, correlationID: item.CorrelationID, err: csv.ErrFieldCount}
+	}
+	item.OriginalURL = record[r.urlColumn]
+	for _, column := range r.settings {
+		if column.index >= len(record) || record[column.index] == "" {
+			continue
+		}
+		if err = column.parse(&item, record[column.index]); err != nil {
+			return item, &itemError{line: line, correlationID: item.CorrelationID, err: err}
+		}
+	}
+	return item, nil
+}
+
+func newCorrelationReader(request *http.Request) (correlationReader, error) {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, invalidInput(err, "Please, specify Content-Type as application/x-ndjson or text/csv")
+	}
+	switch mediaType {
+	case ndjsonContentType:
+		return newNDJSONReader(request.Body), nil
+	case csvContentType:
+		r, err := newCSVReader(request.Body)
+		if err != nil {
+			return nil, invalidInput(err, "Please, start csv with header of correlation_id and original_url columns")
+		}
+		return r, nil
+	default:
+		return nil, invalidInput(fmt.Errorf("unsupported content type %v", mediaType),
+			"Please, specify Content-Type as application/x-ndjson or text/csv")
+	}
+}
+
+// handleBulk shortens urls read from NDJSON or CSV body chunk by chunk and writes results back as NDJSON,
+// so the size of input is not bounded by memory. Results are streamed while reading over HTTP/2 and, when
+// built with Go 1.21 or later, over HTTP/1.x. HTTP/1.x server of older Go can't answer before the body is
+// read, so there results are spooled to a temporary file and sent once the whole body is read.
+// Server read and write timeouts are moved on with every chunk, so only a chunk which takes longer
+// than stream timeout cuts the request
+func (a *AppRouter) handleBulk(writer http.ResponseWriter, request *http.Request) {
+
+	ctxUserID, ok := request.Context().Value(appMiddle.UserIDCtxKey).(string)
+	if !ok {
+		a.writeProblem(writer, request, errNoUser)
+		return
+	}
+
+	input, err := newCorrelationReader(request)
+	if err != nil {
+		a.writeProblem(writer, request, err)
+		return
+	}
+	extendDeadline(writer, a.streamTimeout)
+
+	// results are written straight to client when possible,
+	// otherwise spooled to a file until the whole body is read
+	var output io.Writer = writer
+	flush := func() {
+		if flusher, ok := writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	if !enableFullDuplex(writer, request) {
+		spool, err := os.CreateTemp("", "bulk-*.ndjson")
+		if err != nil {
+			a.writeProblem(writer, request, err)
+			return
+		}
+		defer func() {
+			_ = spool.Close()
+			_ = os.Remove(spool.Name())
+		}()
+		output = spool
+		flush = func() {}
+		defer func() {
+			extendDeadline(writer, a.streamTimeout)
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				log.Printf("error while reading bulk spool: %v", err)
+				return
+			}
+			if _, err := io.Copy(writer, spool); err != nil {
+				log.Printf("error while writing answer: %v", err)
+			}
+		}()
+	}
+
+	// status is not written explicitly, the first write does it after body is started to be read,
+	// otherwise clients waiting for 100 Continue would be answered before sending the body
+	writer.Header().Set("Content-Type", ndjsonContentType)
+
+	encoder := json.NewEncoder(output)
+	chunk := make([]usecase.Correlation, 0, bulkChunkSize)
+
+	// writeChunk stores chunk and streams its results, false means processing should stop
+	writeChunk := func() bool {
+		if len(chunk) == 0 {
+			return true
+		}
+		results, err := a.usecase.ShortenBatch(request.Context(), chunk, ctxUserID)
+		if err != nil {
+			// nothing of the chunk is stored, say it for every item
+			results = make([]usecase.OutputBatchItem, 0, len(chunk))
+			for _, item := range chunk {
+				results = append(results, usecase.OutputBatchItem{
+					CorrelationID: item.CorrelationID,
+					Error:         usecase.PrettyOf(err),
+				})
+			}
+		}
+		for _, result := range results {
+			if result.ShortURL != "" {
+				result.ShortURL = a.baseURL + result.ShortURL
+			}
+			if encodeErr := encoder.Encode(result); encodeErr != nil {
+				log.Printf("error while writing answer: %v", encodeErr)
+				return false
+			}
+		}
+		flush()
+		extendDeadline(writer, a.streamTimeout)
+		chunk = chunk[:0]
+		return err == nil
+	}
+
+	for {
+		item, err := input.Read()
+		if err == io.EOF {
+			break
+		}
+
+		var malformed *itemError
+		if errors.As(err, &malformed) {
+			result := usecase.OutputBatchItem{
+				CorrelationID: malformed.correlationID,
+				Error:         malformed.Error(),
+			}
+			if err = encoder.Encode(result); err != nil {
+				log.Printf("error while writing answer: %v", err)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			// the rest of body is lost, stored items are already reported
+			result := usecase.OutputBatchItem{Error: "request body can not be read further: " + err.Error()}
+			if err = encoder.Encode(result); err != nil {
+				log.Printf("error while writing answer: %v", err)
+			}
+			break
+		}
+
+		chunk = append(chunk, item)
+		if len(chunk) == bulkChunkSize && !writeChunk() {
+			return
+		}
+	}
+	writeChunk()
+}
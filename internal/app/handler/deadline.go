@@ -0,0 +1,12 @@
+//go:build !go1.20
+
+package handler
+
+import (
+	"net/http"
+	"time"
+)
+
+// extendDeadline can't move deadlines of older Go servers,
+// streams are cut by server read and write timeouts then
+func extendDeadline(http.ResponseWriter, time.Duration) {}
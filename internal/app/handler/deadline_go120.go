@@ -0,0 +1,15 @@
+//go:build go1.20
+
+package handler
+
+import (
+	"net/http"
+	"time"
+)
+
+// extendDeadline keeps server read and write timeouts from cutting a stream which still moves
+func extendDeadline(writer http.ResponseWriter, d time.Duration) {
+	controller := http.NewResponseController(writer)
+	_ = controller.SetReadDeadline(time.Now().Add(d))
+	_ = controller.SetWriteDeadline(time.Now().Add(d))
+}
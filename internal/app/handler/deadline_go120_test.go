@@ -0,0 +1,85 @@
+//go:build go1.20
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowExportMock takes delay for every exported link
+type slowExportMock struct {
+	*usecaseMock
+	delay time.Duration
+}
+
+func (u slowExportMock) Export(ctx context.Context, user string, fn func(usecase.ExportItem) error) error {
+	return u.usecaseMock.Export(ctx, user, func(item usecase.ExportItem) error {
+		time.Sleep(u.delay)
+		return fn(item)
+	})
+}
+
+func TestAppHandler_ExportOutlivesWriteTimeout(t *testing.T) {
+	uc := slowExportMock{usecaseMock: &usecaseMock{}, delay: 50 * time.Millisecond}
+	for i := 0; i < 6; i++ {
+		uc.p.URLs = append(uc.p.URLs, &domain.URL{Short: "abc", Orig: "http://example.com/"})
+	}
+	h := NewAppRouter("http://localhost:8080/", uc, usecase.NewLiveliness(&pingMock{}), WithStreamTimeout(5*time.Second))
+	server := httptest.NewUnstartedServer(h)
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	response, err := server.Client().Get(server.URL + "/api/user/urls/export?format=ndjson")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err, "export takes longer than write timeout but is not cut")
+	assert.Len(t, body, 6*len(`{"short_url":"http://localhost:8080/abc","original_url":"http://example.com/","created_at":"0001-01-01T00:00:00Z","status":"active"}`+"\n"))
+	assert.Equal(t, "complete", response.Trailer.Get(exportStatusTrailer))
+}
+
+func TestAppHandler_BulkOutlivesTimeouts(t *testing.T) {
+	h := NewAppRouter("http://localhost:8080/", &usecaseMock{s: "xyz"}, usecase.NewLiveliness(&pingMock{}),
+		WithStreamTimeout(5*time.Second))
+	server := httptest.NewUnstartedServer(h)
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	// body is sent slower than server timeouts allow
+	body, input := io.Pipe()
+	go func() {
+		for i := 0; i < 2*bulkChunkSize; i++ {
+			if i%(bulkChunkSize/2) == 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+			fmt.Fprintf(input, "{\"correlation_id\":\"%v\",\"original_url\":\"http://example.com/%v\"}\n", i, i)
+		}
+		_ = input.Close()
+	}()
+	request, err := http.NewRequest(http.MethodPost, server.URL+"/api/shorten/bulk", body)
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/x-ndjson")
+
+	response, err := server.Client().Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, 200, response.StatusCode)
+	results, err := io.ReadAll(response.Body)
+	require.NoError(t, err, "bulk takes longer than server timeouts but is not cut")
+	assert.Equal(t, 2*bulkChunkSize, bytes.Count(results, []byte("\n")))
+}
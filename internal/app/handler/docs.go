@@ -0,0 +1,43 @@
+package handler
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+)
+
+// OpenAPISpec is the machine-readable contract of the public api.
+// It is embedded so the binary always serves the spec it was built with
+//
+//go:embed openapi.json
+var OpenAPISpec []byte
+
+// docsPage is a minimal documentation page which renders OpenAPISpec with Redoc
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8"/>
+  <title>URL shortener API</title>
+</head>
+<body>
+  <redoc spec-url="/api/openapi.json"></redoc>
+  <script src="https://cdn.redoc.ly/redoc/latest/bundles/redoc.standalone.js"></script>
+</body>
+</html>
+`
+
+func (a *AppRouter) handleOpenAPI(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	_, err := writer.Write(OpenAPISpec)
+	if err != nil {
+		log.Printf("error while writing answer: %v", err)
+	}
+}
+
+func (a *AppRouter) handleDocs(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "text/html")
+	_, err := writer.Write([]byte(docsPage))
+	if err != nil {
+		log.Printf("error while writing answer: %v", err)
+	}
+}
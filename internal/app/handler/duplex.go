@@ -0,0 +1,11 @@
+//go:build !go1.21
+
+package handler
+
+import "net/http"
+
+// enableFullDuplex reports if response may be written while request body is still being read.
+// HTTP/1.x server of older Go versions discards unread request body on the first write
+func enableFullDuplex(_ http.ResponseWriter, request *http.Request) bool {
+	return request.ProtoMajor >= 2
+}
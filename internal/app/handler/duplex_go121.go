@@ -0,0 +1,14 @@
+//go:build go1.21
+
+package handler
+
+import "net/http"
+
+// enableFullDuplex lets HTTP/1.x handler write response while request body is still being read,
+// HTTP/2 is full duplex anyway
+func enableFullDuplex(writer http.ResponseWriter, request *http.Request) bool {
+	if request.ProtoMajor >= 2 {
+		return true
+	}
+	return http.NewResponseController(writer).EnableFullDuplex() == nil
+}
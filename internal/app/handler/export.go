@@ -0,0 +1,284 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	appMiddle "github.com/aidlatyp/ya-pr-shortener/internal/app/handler/middlewares"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+const (
+	// exportFlushEvery is a number of items after which written data is pushed to client
+	exportFlushEvery = 1000
+	// exportStatusTrailer tells client if export is complete, body alone can't say it for csv and ndjson
+	exportStatusTrailer = "X-Export-Status"
+)
+
+// exportFormat knows how to write a stream of links in some representation
+type exportFormat struct {
+	contentType string
+	extension   string
+	newEncoder  func(io.Writer) exportEncoder
+}
+
+// exportEncoder writes items one by one, Close finishes the document
+type exportEncoder interface {
+	Encode(usecase.ExportItem) error
+	Close() error
+}
+
+// exportPreference orders formats for media ranges several of them match, like */* or application/*
+var exportPreference = []string{"json", "ndjson", "csv"}
+
+// errNotAcceptable means Accept header allows none of export formats
+var errNotAcceptable = errors.New("no acceptable export format")
+
+var exportFormats = map[string]exportFormat{
+	"json":   {contentType: "application/json", extension: "json", newEncoder: newJSONExportEncoder},
+	"ndjson": {contentType: ndjsonContentType, extension: "ndjson", newEncoder: newNDJSONExportEncoder},
+	"csv":    {contentType: csvContentType, extension: "csv", newEncoder: newCSVExportEncoder},
+}
+
+// jsonExportEncoder writes a JSON array without holding it in memory
+type jsonExportEncoder struct {
+	writer io.Writer
+	count  int
+}
+
+func newJSONExportEncoder(writer io.Writer) exportEncoder {
+	return &jsonExportEncoder{writer: writer}
+}
+
+func (e *jsonExportEncoder) Encode(item usecase.ExportItem) error {
+	prefix := ","
+	if e.count == 0 {
+		prefix = "["
+	}
+	e.count++
+
+	marshaled, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(e.writer, prefix+string(marshaled))
+	return err
+}
+
+func (e *jsonExportEncoder) Close() error {
+	closing := "]"
+	if e.count == 0 {
+		closing = "[]"
+	}
+	_, err := io.WriteString(e.writer, closing)
+	return err
+}
+
+type ndjsonExportEncoder struct {
+	*json.Encoder
+}
+
+func newNDJSONExportEncoder(writer io.Writer) exportEncoder {
+	return ndjsonExportEncoder{json.NewEncoder(writer)}
+}
+
+func (e ndjsonExportEncoder) Encode(item usecase.ExportItem) error {
+	return e.Encoder.Encode(item)
+}
+
+func (e ndjsonExportEncoder) Close() error {
+	return nil
+}
+
+type csvExportEncoder struct {
+	writer *csv.Writer
+	header bool
+}
+
+func newCSVExportEncoder(writer io.Writer) exportEncoder {
+	return &csvExportEncoder{writer: csv.NewWriter(writer)}
+}
+
+func (e *csvExportEncoder) writeHeader() error {
+	if e.header {
+		return nil
+	}
+	e.header = true
+	return e.writer.Write([]string{"short_url", "original_url", "created_at", "status", "clicks", "max_clicks"})
+}
+
+func (e *csvExportEncoder) Encode(item usecase.ExportItem) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	// clicks of links which are not limited are not counted, so they are left empty
+	var clicks, maxClicks string
+	if item.Clicks != nil {
+		clicks = strconv.Itoa(*item.Clicks)
+		maxClicks = strconv.Itoa(item.MaxClicks)
+	}
+	err := e.writer.Write([]string{
+		item.ShortURL,
+		item.OriginalURL,
+		item.CreatedAt.Format(time.RFC3339Nano),
+		item.Status,
+		clicks,
+		maxClicks,
+	})
+	if err != nil {
+		return err
+	}
+	// csv writer is buffered, make items reach client in time
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func (e *csvExportEncoder) Close() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// negotiateExportFormat takes explicit format parameter first and Accept header then,
+// JSON is used if client accepts anything. Accept which allows none of formats is errNotAcceptable
+func negotiateExportFormat(request *http.Request) (exportFormat, error) {
+
+	if name := request.URL.Query().Get("format"); name != "" {
+		format, ok := exportFormats[name]
+		if !ok {
+			return exportFormat{}, invalidInput(errors.New("unknown export format "+name),
+				"Please, specify format as csv, json or ndjson")
+		}
+		return format, nil
+	}
+
+	accept := request.Header.Get("Accept")
+	if accept == "" {
+		return exportFormats["json"], nil
+	}
+
+	bestQuality := 0.0
+	var best *exportFormat
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality <= bestQuality {
+			continue
+		}
+
+		for _, name := range exportPreference {
+			format := exportFormats[name]
+			if matchesMediaRange(mediaType, format.contentType) {
+				best, bestQuality = &format, quality
+				break
+			}
+		}
+	}
+	if best == nil {
+		return exportFormat{}, fmt.Errorf("%w in %v", errNotAcceptable, accept)
+	}
+	return *best, nil
+}
+
+// matchesMediaRange reports if contentType is in media range like text/csv, text/* or */*
+func matchesMediaRange(mediaRange, contentType string) bool {
+	if mediaRange == "*/*" || mediaRange == contentType {
+		return true
+	}
+	return strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(mediaRange, "*"))
+}
+
+// handleExport streams every user link in requested format, if export breaks
+// in the middle the X-Export-Status trailer tells it. Server write timeout is moved on
+// with every flushed part, so only a part which takes longer than stream timeout cuts export
+func (a *AppRouter) handleExport(writer http.ResponseWriter, request *http.Request) {
+
+	ctxUserID, ok := request.Context().Value(appMiddle.UserIDCtxKey).(string)
+	if !ok {
+		a.writeProblem(writer, request, errNoUser)
+		return
+	}
+
+	format, err := negotiateExportFormat(request)
+	if errors.Is(err, errNotAcceptable) {
+		a.writeStatusProblem(writer, request, http.StatusNotAcceptable,
+			"Please, accept text/csv, application/json or application/x-ndjson")
+		return
+	}
+	if err != nil {
+		a.writeProblem(writer, request, err)
+		return
+	}
+
+	var encoder exportEncoder
+	// start answers on first item only, so a storage failure
+	// before anything is written can be reported with a problem
+	start := func() {
+		if encoder != nil {
+			return
+		}
+		writer.Header().Set("Content-Type", format.contentType)
+		writer.Header().Set("Content-Disposition", `attachment; filename="links.`+format.extension+`"`)
+		writer.Header().Set("Trailer", exportStatusTrailer)
+		extendDeadline(writer, a.streamTimeout)
+		writer.WriteHeader(200)
+		encoder = format.newEncoder(writer)
+	}
+	flush := func() {
+		extendDeadline(writer, a.streamTimeout)
+		if flusher, ok := writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	count := 0
+	err = a.usecase.Export(request.Context(), ctxUserID, func(item usecase.ExportItem) error {
+		start()
+		item.ShortURL = a.baseURL + item.ShortURL
+		if err := encoder.Encode(item); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushEvery == 0 {
+			flush()
+		}
+		return nil
+	})
+
+	if err != nil && encoder == nil {
+		a.writeProblem(writer, request, err)
+		return
+	}
+	start()
+
+	if err != nil {
+		log.Printf("export of %v links is broken: %v", ctxUserID, err)
+		writer.Header().Set(exportStatusTrailer, "incomplete")
+		return
+	}
+
+	if err = encoder.Close(); err != nil {
+		log.Printf("error while writing answer: %v", err)
+		return
+	}
+	writer.Header().Set(exportStatusTrailer, "complete")
+}
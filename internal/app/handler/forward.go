@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+// WithWriteForwarding makes every request but reads be served by leader, as follower storage is read only.
+// Writes are forwarded before users are authorized, so leader registers users and signs their cookies.
+// Reads which write anyway, like clicks of limited links, are forwarded once follower storage rejects them
+func WithWriteForwarding(leader *url.URL) RouterOption {
+	return func(a *AppRouter) {
+		proxy := httputil.NewSingleHostReverseProxy(leader)
+		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, err error) {
+			a.writeProblem(writer, request, usecase.NewError(usecase.KindUnavailable, err, "Sorry, links can't be changed now, try again later"))
+		}
+		a.leader = proxy
+	}
+}
+
+// WithReplicationLog serves append log to followers at path
+func WithReplicationLog(path string, log http.Handler) RouterOption {
+	return func(a *AppRouter) {
+		a.replicationPath = path
+		a.replicationLog = log
+	}
+}
+
+// forwardWrites sends requests which are not reads to leader
+func (a *AppRouter) forwardWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(writer, request)
+		default:
+			a.leader.ServeHTTP(writer, request)
+		}
+	})
+}
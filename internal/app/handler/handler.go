@@ -3,9 +3,11 @@ package handler
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	appMiddle "github.com/aidlatyp/ya-pr-shortener/internal/app/handler/middlewares"
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
@@ -13,36 +15,90 @@ import (
 	chiMiddle "github.com/go-chi/chi/middleware"
 )
 
-const minURLlen = 4
-
 type AppRouter struct {
 	usecase    usecase.InputPort
 	liveliness *usecase.Liveliness
 	*chi.Mux
-	baseURL string
+	baseURL     string
+	warningPage bool
+	// redirectMaxAge is how long clients may cache permanent redirects
+	redirectMaxAge time.Duration
+	// streamTimeout is how long each part of a streamed answer may take
+	streamTimeout time.Duration
+	// leader serves writes of a follower, replicationLog serves log of a leader
+	leader          http.Handler
+	replicationPath string
+	replicationLog  http.Handler
+}
+
+// RouterOption configures optional AppRouter behaviour
+type RouterOption func(*AppRouter)
+
+// WithWarningPage makes browsers get a warning page instead of problem for blocked destinations
+func WithWarningPage(enabled bool) RouterOption {
+	return func(a *AppRouter) {
+		a.warningPage = enabled
+	}
+}
+
+// DefaultRedirectMaxAge is how long permanent redirects are cached unless WithRedirectMaxAge says otherwise
+const DefaultRedirectMaxAge = 24 * time.Hour
+
+// WithRedirectMaxAge sets how long clients may cache permanent redirects, temporary ones are never cached
+func WithRedirectMaxAge(maxAge time.Duration) RouterOption {
+	return func(a *AppRouter) {
+		if maxAge >= 0 {
+			a.redirectMaxAge = maxAge
+		}
+	}
+}
+
+// DefaultStreamTimeout is how long each part of a streamed answer may take unless WithStreamTimeout says otherwise
+const DefaultStreamTimeout = 30 * time.Second
+
+// WithStreamTimeout sets how long each part of a streamed answer like export may take. Server read and write
+// timeouts are moved on with every part, so they do not cut a long stream which still moves
+func WithStreamTimeout(timeout time.Duration) RouterOption {
+	return func(a *AppRouter) {
+		if timeout > 0 {
+			a.streamTimeout = timeout
+		}
+	}
 }
 
 func NewAppRouter(
 	baseURL string,
 	appUsecase usecase.InputPort,
 	liveliness *usecase.Liveliness,
+	opts ...RouterOption,
 ) *AppRouter {
 
 	// Root router
 	rootRouter := chi.NewRouter()
 
-	// Root Middlewares
-	rootRouter.Use(chiMiddle.Recoverer)
-	rootRouter.Use(appMiddle.AuthMiddleware)
-
 	// configure application router
 	appRouter := AppRouter{
-		usecase:    appUsecase,
-		Mux:        rootRouter,
-		baseURL:    baseURL,
-		liveliness: liveliness,
+		usecase:        appUsecase,
+		Mux:            rootRouter,
+		baseURL:        baseURL,
+		liveliness:     liveliness,
+		redirectMaxAge: DefaultRedirectMaxAge,
+		streamTimeout:  DefaultStreamTimeout,
+	}
+	for _, opt := range opts {
+		opt(&appRouter)
 	}
 
+	// Root Middlewares
+	rootRouter.Use(chiMiddle.Recoverer)
+	if appRouter.leader != nil {
+		rootRouter.Use(appRouter.forwardWrites)
+	}
+	rootRouter.Use(appMiddle.AuthMiddleware)
+	// sub routers take these when mounted
+	rootRouter.NotFound(appRouter.handleNotFound)
+	rootRouter.MethodNotAllowed(appRouter.handleMethodNotAllowed)
+
 	appRouter.apiRouter()
 	appRouter.infraRouter()
 
@@ -59,12 +115,20 @@ func (a *AppRouter) apiRouter() {
 
 	// Endpoints
 	apiRouter.Get("/{id}", a.handleGet)
+	apiRouter.Post("/{id}", a.handleUnlock)
 	apiRouter.Post("/", a.handlePost)
 
 	// api
 	apiRouter.Post("/api/shorten", a.handleShorten)
 	apiRouter.Get("/api/user/urls", a.handleUserURLs)
+	apiRouter.Get("/api/user/urls/export", a.handleExport)
+	apiRouter.Patch("/api/user/urls/{id}", a.handleUpdate)
 	apiRouter.Post("/api/shorten/batch", a.handleBatch)
+	apiRouter.Post("/api/shorten/bulk", a.handleBulk)
+
+	// api contract
+	apiRouter.Get("/api/openapi.json", a.handleOpenAPI)
+	apiRouter.Get("/api/docs", a.handleDocs)
 
 	// Mount sub router
 	a.Mount("/", apiRouter)
@@ -77,12 +141,17 @@ func (a *AppRouter) infraRouter() {
 	infraRouter.Get("/", a.handlePing)
 	// Mount sub router
 	a.Mount("/ping", infraRouter)
+	// append log stream of replication leader
+	if a.replicationLog != nil {
+		a.Method(http.MethodGet, a.replicationPath, a.replicationLog)
+	}
 }
 
-func (a *AppRouter) handlePing(writer http.ResponseWriter, _ *http.Request) {
-	err := a.liveliness.Do()
+func (a *AppRouter) handlePing(writer http.ResponseWriter, request *http.Request) {
+	err := a.liveliness.Do(request.Context())
 	if err != nil {
-		writer.WriteHeader(500)
+		a.writeProblem(writer, request, usecase.NewError(usecase.KindUnavailable, err, ""))
+		return
 	}
 	writer.WriteHeader(200)
 }
@@ -91,30 +160,33 @@ func (a *AppRouter) handleBatch(writer http.ResponseWriter, request *http.Reques
 
 	ctxUserID, ok := request.Context().Value(appMiddle.UserIDCtxKey).(string)
 	if !ok {
-		writer.WriteHeader(401)
+		a.writeProblem(writer, request, errNoUser)
 		return
 	}
 
 	inputBytes, err := io.ReadAll(request.Body)
 	if err != nil {
-		writer.WriteHeader(400)
+		a.writeProblem(writer, request, invalidInput(err, "Request body can not be read"))
 		return
 	}
 
 	inputCollection := make([]usecase.Correlation, 0)
 	err = json.Unmarshal(inputBytes, &inputCollection)
 	if err != nil {
-		log.Printf("cant unmarshal due to %v", err)
+		a.writeProblem(writer, request, invalidInput(err, "Request body is not a JSON array of correlations"))
+		return
 	}
 
-	outputList, err := a.usecase.ShortenBatch(inputCollection, ctxUserID)
+	outputList, err := a.usecase.ShortenBatch(request.Context(), inputCollection, ctxUserID)
 	if err != nil {
-		writer.WriteHeader(500)
+		a.writeProblem(writer, request, err)
 		return
 	}
 
 	for index := range outputList {
-		outputList[index].ShortURL = a.baseURL + outputList[index].ShortURL
+		if outputList[index].ShortURL != "" {
+			outputList[index].ShortURL = a.baseURL + outputList[index].ShortURL
+		}
 	}
 
 	marshaled, _ := json.Marshal(outputList)
@@ -131,18 +203,37 @@ func (a *AppRouter) handleUserURLs(writer http.ResponseWriter, request *http.Req
 
 	ctxUserID, ok := request.Context().Value(appMiddle.UserIDCtxKey).(string)
 	if !ok {
-		writer.WriteHeader(401)
+		a.writeProblem(writer, request, errNoUser)
 		return
 	}
 
-	resultList, err := a.usecase.ShowAll(ctxUserID)
+	query, err := parsePageQuery(request.URL.Query())
 	if err != nil {
+		a.writeProblem(writer, request, err)
+		return
+	}
+
+	page, err := a.usecase.ShowPage(request.Context(), ctxUserID, query)
+	if err != nil {
+		a.writeProblem(writer, request, err)
+		return
+	}
+
+	if page.Next != nil {
+		next := page.Next.Encode()
+		nextQuery := request.URL.Query()
+		nextQuery.Set("cursor", next)
+		writer.Header().Set("Link", fmt.Sprintf("<%vapi/user/urls?%v>; rel=\"next\"", a.baseURL, nextQuery.Encode()))
+		writer.Header().Set("X-Next-Cursor", next)
+	}
+
+	if len(page.URLs) == 0 {
 		writer.WriteHeader(204)
 		return
 	}
 
-	outputList := make([]usecase.OutputUserLinksListItem, 0, len(resultList))
-	for _, v := range resultList {
+	outputList := make([]usecase.OutputUserLinksListItem, 0, len(page.URLs))
+	for _, v := range page.URLs {
 		p := usecase.OutputUserLinksListItem{
 			ShortURL:    a.baseURL + v.Short,
 			OriginalURL: v.Orig,
@@ -159,76 +250,151 @@ func (a *AppRouter) handleUserURLs(writer http.ResponseWriter, request *http.Req
 
 }
 
-func (a *AppRouter) handleShorten(writer http.ResponseWriter, request *http.Request) {
+// handleUpdate points user link to another original, short url stays the same
+func (a *AppRouter) handleUpdate(writer http.ResponseWriter, request *http.Request) {
 
 	ctxUserID, ok := request.Context().Value(appMiddle.UserIDCtxKey).(string)
 	if !ok {
-		writer.WriteHeader(401)
+		a.writeProblem(writer, request, errNoUser)
 		return
 	}
 
 	inputBytes, err := io.ReadAll(request.Body)
 	if err != nil {
-		writer.WriteHeader(400)
+		a.writeProblem(writer, request, invalidInput(err, "Request body can not be read"))
 		return
 	}
 
-	// A touch of a map approach instead of dto
-	input := make(map[string]string, 1)
+	var input struct {
+		OriginalURL *string `json:"original_url"`
+	}
 	err = json.Unmarshal(inputBytes, &input)
 	if err != nil {
-		writer.WriteHeader(400)
+		a.writeProblem(writer, request, invalidInput(err, "Request body is not a valid JSON object"))
+		return
+	}
+	if input.OriginalURL == nil {
+		a.writeProblem(writer, request, invalidInput(errors.New("original_url field is missing"), "Please, specify original_url field"))
 		return
 	}
 
-	if origURL, ok := input["url"]; ok {
-
-		responseCode := 201
-		id, err := a.usecase.Shorten(origURL, ctxUserID)
-		if err != nil {
-			// This [ErrAlreadyExists] is an usecase layer error should
-			// have error message for user and error context
-			if errors.As(err, &usecase.ErrAlreadyExists{}) {
-				errAlreadyExists := err.(usecase.ErrAlreadyExists)
-				id = errAlreadyExists.ExistShortenID
-				// show to user errAlreadyExists.Error() message...
-				responseCode = 409
-			}
-		}
-
-		output := map[string]string{
-			"result": a.baseURL + id,
-		}
-		marshalled, err := json.Marshal(output)
-		if err != nil {
-			writer.WriteHeader(500)
+	versions, err := a.usecase.ChangeOrigin(request.Context(), chi.URLParam(request, "id"), *input.OriginalURL, ctxUserID)
+	if err != nil {
+		var errAlreadyExists usecase.ErrAlreadyExists
+		if errors.As(err, &errAlreadyExists) {
+			a.writeConflict(writer, request, errAlreadyExists)
 			return
 		}
+		a.writeProblem(writer, request, err)
+		return
+	}
+	versions.ShortURL = a.baseURL + versions.ShortURL
+
+	marshaled, _ := json.Marshal(versions)
+	writer.Header().Set("Content-Type", "application/json")
+	_, err = writer.Write(marshaled)
+	if err != nil {
+		log.Printf("error while writing answer: %v", err)
+	}
+}
+
+func (a *AppRouter) handleShorten(writer http.ResponseWriter, request *http.Request) {
+
+	ctxUserID, ok := request.Context().Value(appMiddle.UserIDCtxKey).(string)
+	if !ok {
+		a.writeProblem(writer, request, errNoUser)
+		return
+	}
+
+	inputBytes, err := io.ReadAll(request.Body)
+	if err != nil {
+		a.writeProblem(writer, request, invalidInput(err, "Request body can not be read"))
+		return
+	}
+
+	var input struct {
+		URL *string `json:"url"`
+		usecase.LinkSettings
+	}
+	err = json.Unmarshal(inputBytes, &input)
+	if err != nil {
+		a.writeProblem(writer, request, invalidInput(err, "Request body is not a valid JSON object"))
+		return
+	}
+
+	if input.URL == nil {
+		a.writeProblem(writer, request, invalidInput(errors.New("url field is missing"), "Please, specify url field"))
+		return
+	}
 
-		writer.Header().Set("Content-Type", "application/json")
-		writer.WriteHeader(responseCode)
-		_, err = writer.Write(marshalled)
-		if err != nil {
-			log.Printf("error while writing answer: %v", err)
+	id, err := a.usecase.Shorten(request.Context(), *input.URL, ctxUserID, input.LinkSettings)
+	if err != nil {
+		// This [ErrAlreadyExists] is an usecase layer error should
+		// have error message for user and error context
+		var errAlreadyExists usecase.ErrAlreadyExists
+		if errors.As(err, &errAlreadyExists) {
+			a.writeConflict(writer, request, errAlreadyExists)
+			return
 		}
+		a.writeProblem(writer, request, err)
+		return
+	}
 
-	} else {
-		writer.WriteHeader(400)
+	output := map[string]string{
+		"result": a.baseURL + id,
+	}
+	marshalled, err := json.Marshal(output)
+	if err != nil {
+		a.writeProblem(writer, request, err)
 		return
 	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(201)
+	_, err = writer.Write(marshalled)
+	if err != nil {
+		log.Printf("error while writing answer: %v", err)
+	}
 }
 
 func (a *AppRouter) handleGet(writer http.ResponseWriter, request *http.Request) {
 
 	id := chi.URLParam(request, "id")
-	response, err := a.usecase.RestoreOrigin(id)
+	redirect, err := a.usecase.RestoreOrigin(request.Context(), id, linkPassword(request))
+	// clicks of limited links are counted down by leader only, so it follows them
+	if err != nil && a.leader != nil && errors.Is(err, usecase.ErrReadOnly) {
+		a.leader.ServeHTTP(writer, request)
+		return
+	}
 	if err != nil {
-		writer.WriteHeader(404)
+		a.writeRestoreError(writer, request, redirect, err)
 		return
 	}
+	a.writeRedirect(writer, redirect, redirect.Status)
+}
 
-	writer.Header().Set("Location", response)
-	writer.WriteHeader(307)
+// writeRestoreError answers a link which can't be followed
+func (a *AppRouter) writeRestoreError(writer http.ResponseWriter, request *http.Request, redirect usecase.Redirect, err error) {
+	if usecase.KindOf(err) == usecase.KindBlocked && a.warningPage && acceptsHTML(request) {
+		a.writeWarningPage(writer, redirect.Location)
+		return
+	}
+	if a.writePasswordRequired(writer, request, err) {
+		return
+	}
+	a.writeProblem(writer, request, err)
+}
+
+func (a *AppRouter) writeRedirect(writer http.ResponseWriter, redirect usecase.Redirect, status int) {
+	// permanent redirects are cached by browsers, so changed originals reach them after max age only.
+	// Protected and limited ones are never cached, every click is checked
+	if redirect.Cacheable() {
+		writer.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(a.redirectMaxAge/time.Second)))
+	} else {
+		writer.Header().Set("Cache-Control", "no-store")
+	}
+	writer.Header().Set("Location", redirect.Location)
+	writer.WriteHeader(status)
 }
 
 func (a *AppRouter) handlePost(writer http.ResponseWriter, request *http.Request) {
@@ -236,28 +402,26 @@ func (a *AppRouter) handlePost(writer http.ResponseWriter, request *http.Request
 	ctxUserID, _ := request.Context().Value(appMiddle.UserIDCtxKey).(string)
 
 	input, err := io.ReadAll(request.Body)
-	if err != nil || len(input) < minURLlen {
-		writer.WriteHeader(400)
+	if err != nil {
+		a.writeProblem(writer, request, invalidInput(err, "Request body can not be read"))
 		return
 	}
 
-	id, err := a.usecase.Shorten(string(input), ctxUserID)
+	status := http.StatusCreated
+	id, err := a.usecase.Shorten(request.Context(), string(input), ctxUserID, usecase.LinkSettings{})
 	if err != nil {
-		if errors.As(err, &usecase.ErrAlreadyExists{}) {
-			e := err.(usecase.ErrAlreadyExists)
-			id = e.ExistShortenID
-			writer.Header().Set("Content-Type", "text/plain")
-			writer.WriteHeader(409)
-			_, err = writer.Write([]byte(a.baseURL + id))
-			if err != nil {
-				log.Printf("error while writing answer: %v", err)
-			}
+		var errAlreadyExists usecase.ErrAlreadyExists
+		if !errors.As(err, &errAlreadyExists) {
+			a.writeProblem(writer, request, err)
 			return
 		}
+		// plain text endpoint answers conflicts with existing short url as is
+		id = errAlreadyExists.ExistShortenID
+		status = http.StatusConflict
 	}
 
 	writer.Header().Set("Content-Type", "text/plain")
-	writer.WriteHeader(201)
+	writer.WriteHeader(status)
 
 	_, err = writer.Write([]byte(a.baseURL + id))
 	if err != nil {
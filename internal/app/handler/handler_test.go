@@ -1,12 +1,19 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
@@ -16,7 +23,7 @@ import (
 
 type pingMock struct{}
 
-func (p *pingMock) Ping() error {
+func (p *pingMock) Ping(_ context.Context) error {
 	return nil
 }
 
@@ -24,23 +31,99 @@ type usecaseMock struct {
 	s string // short
 	o string // orig
 	e bool   // err
-}
+	x bool   // already exists
+
+	q usecase.PageQuery // last requested page
+	p usecase.Page      // page to answer
+	b int               // batches shortened
 
-func (u *usecaseMock) Shorten(_ string, _ string) (string, error) {
+	r int                  // redirect status, 307 if not set
+	l usecase.LinkSettings // settings of the last shortened link
+	w string               // password of the link, it is open if not set
+	c int                  // clicks left, the link is not limited if not set and used up if negative
+}
 
+func (u *usecaseMock) Shorten(_ context.Context, _ string, _ string, settings usecase.LinkSettings) (string, error) {
+	u.l = settings
+	if u.x {
+		return "", usecase.ErrAlreadyExists{ExistShortenID: u.s, Orig: u.o}
+	}
 	return u.s, nil
 }
-func (u *usecaseMock) RestoreOrigin(_ string) (string, error) {
+func (u *usecaseMock) RestoreOrigin(_ context.Context, _ string, password string) (usecase.Redirect, error) {
 	if u.e {
-		return "", errors.New("usecase error")
+		return usecase.Redirect{}, usecase.NewError(usecase.KindNotFound, errors.New("usecase error"), "")
+	}
+	if password == "too many" {
+		return usecase.Redirect{}, usecase.NewError(usecase.KindRateLimited, errors.New("usecase error"), "")
+	}
+	if u.w != "" && password != u.w {
+		return usecase.Redirect{}, usecase.NewError(usecase.KindUnauthorized, usecase.ErrPasswordRequired, "")
 	}
-	return u.o, nil
+	if u.c < 0 {
+		return usecase.Redirect{}, usecase.NewError(usecase.KindGone, usecase.ErrExhausted, "")
+	}
+	redirect := usecase.Redirect{Location: u.o, Status: u.r, Protected: u.w != "", Limited: u.c > 0}
+	if redirect.Status == 0 {
+		redirect.Status = 307
+	}
+	return redirect, nil
 }
-func (u *usecaseMock) ShowAll(_ string) ([]*domain.URL, error) {
-	return nil, nil
+func (u *usecaseMock) ShowPage(_ context.Context, _ string, query usecase.PageQuery) (usecase.Page, error) {
+	u.q = query
+	return u.p, nil
 }
-func (u *usecaseMock) ShortenBatch(input []usecase.Correlation, user string) ([]usecase.OutputBatchItem, error) {
-	return nil, nil
+func (u *usecaseMock) Export(_ context.Context, _ string, fn func(usecase.ExportItem) error) error {
+	for _, url := range u.p.URLs {
+		item := usecase.ExportItem{
+			ShortURL:    url.Short,
+			OriginalURL: url.Orig,
+			CreatedAt:   url.CreatedAt,
+			Status:      usecase.StatusActive,
+			MaxClicks:   url.MaxClicks,
+		}
+		if url.MaxClicks > 0 {
+			clicks := url.MaxClicks - url.ClicksLeft
+			item.Clicks = &clicks
+			if url.ClicksLeft == 0 {
+				item.Status = usecase.StatusUsedUp
+			}
+		}
+		err := fn(item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *usecaseMock) ChangeOrigin(_ context.Context, id string, url string, _ string) (usecase.LinkVersions, error) {
+	if u.e {
+		return usecase.LinkVersions{}, usecase.NewError(usecase.KindNotFound, errors.New("usecase error"), "")
+	}
+	if u.x {
+		return usecase.LinkVersions{}, usecase.ErrAlreadyExists{ExistShortenID: u.s, Orig: url}
+	}
+	return usecase.LinkVersions{
+		ShortURL:    id,
+		OriginalURL: url,
+		Version:     2,
+		History: []usecase.LinkVersion{
+			{Version: 1, OriginalURL: u.o, ReplacedAt: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)},
+		},
+	}, nil
+}
+
+func (u *usecaseMock) ShortenBatch(_ context.Context, input []usecase.Correlation, _ string) ([]usecase.OutputBatchItem, error) {
+	u.b++
+	output := make([]usecase.OutputBatchItem, 0, len(input))
+	for _, item := range input {
+		output = append(output, usecase.OutputBatchItem{
+			CorrelationID: item.CorrelationID,
+			ShortURL:      u.s + item.CorrelationID,
+		})
+	}
+	return output, nil
 }
 
 func TestAppHandler_HandleMain(t *testing.T) {
@@ -55,11 +138,12 @@ func TestAppHandler_HandleMain(t *testing.T) {
 		l := usecase.NewLiveliness(&pingMock{})
 
 		// Main App router
-		h := NewAppRouter("http://localhost:8080/", uc, l)
+		h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l))
 
 		// POST request
 		body := bytes.NewBufferString("http://example.com")
 		request := httptest.NewRequest(http.MethodPost, "/", body)
+		request.Header.Set("Content-Type", "text/plain")
 
 		w := httptest.NewRecorder()
 		h.ServeHTTP(w, request)
@@ -76,6 +160,22 @@ func TestAppHandler_HandleMain(t *testing.T) {
 		err = response.Body.Close()
 		require.NoError(t, err)
 
+		// POST already shortened URL
+		uc.x = true
+		request = httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("http://example.com"))
+		request.Header.Set("Content-Type", "text/plain")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		response = w.Result()
+
+		assert.Equal(t, 409, response.StatusCode)
+		assert.Equal(t, "text/plain", response.Header.Get("Content-Type"))
+		content, err = ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "http://localhost:8080/xyz", string(content))
+		require.NoError(t, response.Body.Close())
+		uc.x = false
+
 		// GET request
 		request = httptest.NewRequest(http.MethodGet, "/xyz", nil)
 		w = httptest.NewRecorder()
@@ -99,6 +199,7 @@ func TestAppHandler_HandleMain(t *testing.T) {
 		response = w.Result()
 
 		assert.Equal(t, 404, response.StatusCode)
+		assert.Equal(t, "application/problem+json", response.Header.Get("Content-Type"))
 
 		err = response.Body.Close()
 		require.NoError(t, err)
@@ -118,13 +219,14 @@ func TestAppHandler_ApiJson_ShortURL(t *testing.T) {
 		l := usecase.NewLiveliness(&pingMock{})
 
 		// Main App router
-		h := NewAppRouter("http://localhost:8080/", uc, l)
+		h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l))
 
 		// OK
 		// Prepare request json
 		requestJSON := "{ \"url\" : \"http://example.com\"}"
 		body := bytes.NewBufferString(requestJSON)
 		request := httptest.NewRequest(http.MethodPost, "/api/shorten", body)
+		request.Header.Set("Content-Type", "application/json")
 
 		w := httptest.NewRecorder()
 		h.ServeHTTP(w, request)
@@ -146,6 +248,7 @@ func TestAppHandler_ApiJson_ShortURL(t *testing.T) {
 		requestBadJSON := "{ \"url\" : http://example.com\"}"
 		body = bytes.NewBufferString(requestBadJSON)
 		request = httptest.NewRequest(http.MethodPost, "/api/shorten", body)
+		request.Header.Set("Content-Type", "application/json")
 
 		w = httptest.NewRecorder()
 		h.ServeHTTP(w, request)
@@ -160,6 +263,7 @@ func TestAppHandler_ApiJson_ShortURL(t *testing.T) {
 		requestWrongJSON := "{ \"urlBad\" : http://example.com\"}"
 		body = bytes.NewBufferString(requestWrongJSON)
 		request = httptest.NewRequest(http.MethodPost, "/api/shorten", body)
+		request.Header.Set("Content-Type", "application/json")
 
 		w = httptest.NewRecorder()
 		h.ServeHTTP(w, request)
@@ -170,5 +274,668 @@ func TestAppHandler_ApiJson_ShortURL(t *testing.T) {
 		err = response.Body.Close()
 		require.NoError(t, err)
 
+		// Conflict - still carries existing short url
+		uc.x = true
+		body = bytes.NewBufferString(requestJSON)
+		request = httptest.NewRequest(http.MethodPost, "/api/shorten", body)
+		request.Header.Set("Content-Type", "application/json")
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+
+		response = w.Result()
+		assert.Equal(t, 409, response.StatusCode)
+		assert.Equal(t, "application/problem+json", response.Header.Get("Content-Type"))
+
+		content, err = ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+
+		assert.JSONEq(t, `{
+			"type": "/problems/conflict",
+			"title": "Conflict",
+			"status": 409,
+			"detail": "Sorry, you have already saved this url http://example.com ",
+			"instance": "/api/shorten",
+			"result": "http://localhost:8080/xyz"
+		}`, string(content))
+
+		err = response.Body.Close()
+		require.NoError(t, err)
+
 	})
 }
+
+func TestAppHandler_UserURLs(t *testing.T) {
+	t.Run("Test Handler user urls pagination", func(t *testing.T) {
+
+		created := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+		uc := &usecaseMock{
+			p: usecase.Page{
+				URLs: []*domain.URL{{Orig: "http://example.com", Short: "xyz", CreatedAt: created}},
+				Next: &usecase.Cursor{CreatedAt: created, Short: "xyz"},
+			},
+		}
+		l := usecase.NewLiveliness(&pingMock{})
+
+		h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l))
+
+		// First page
+		request := httptest.NewRequest(http.MethodGet,
+			"/api/user/urls?limit=1&sort=-created_at&contains=example&created_after=2022-01-01T00:00:00Z", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		response := w.Result()
+
+		assert.Equal(t, 200, response.StatusCode)
+		assert.Equal(t, usecase.PageQuery{
+			Limit:        1,
+			Desc:         true,
+			Contains:     "example",
+			CreatedAfter: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		}, uc.q)
+
+		next := response.Header.Get("X-Next-Cursor")
+		assert.Equal(t, uc.p.Next.Encode(), next)
+		assert.Contains(t, response.Header.Get("Link"), "cursor="+next)
+
+		content, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `[{"short_url":"http://localhost:8080/xyz","original_url":"http://example.com"}]`, string(content))
+
+		err = response.Body.Close()
+		require.NoError(t, err)
+
+		// Last page is empty
+		uc.p = usecase.Page{}
+		request = httptest.NewRequest(http.MethodGet, "/api/user/urls?cursor="+next, nil)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		response = w.Result()
+
+		assert.Equal(t, 204, response.StatusCode)
+		require.NotNil(t, uc.q.After)
+		assert.Equal(t, "xyz", uc.q.After.Short)
+		assert.True(t, created.Equal(uc.q.After.CreatedAt))
+
+		err = response.Body.Close()
+		require.NoError(t, err)
+
+		// Bad parameters
+		for _, query := range []string{"limit=0", "cursor=!!!", "sort=orig", "created_after=yesterday"} {
+			request = httptest.NewRequest(http.MethodGet, "/api/user/urls?"+query, nil)
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, request)
+			response = w.Result()
+
+			assert.Equal(t, 400, response.StatusCode, query)
+
+			err = response.Body.Close()
+			require.NoError(t, err)
+		}
+	})
+}
+
+func TestAppHandler_Redirects(t *testing.T) {
+	uc := &usecaseMock{s: "xyz", o: "http://example.com"}
+	l := usecase.NewLiveliness(&pingMock{})
+	h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l, WithRedirectMaxAge(time.Hour)))
+
+	// creator chooses redirect
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewBufferString(`{"url":"http://example.com","redirect":308}`))
+	request.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, request)
+	assert.Equal(t, 201, w.Code)
+	assert.Equal(t, usecase.LinkSettings{Redirect: 308}, uc.l)
+
+	tests := []struct {
+		status       int
+		cacheControl string
+	}{
+		{301, "public, max-age=3600"},
+		{302, "no-store"},
+		{307, "no-store"},
+		{308, "public, max-age=3600"},
+	}
+	for _, tt := range tests {
+		uc.r = tt.status
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/xyz", nil))
+		assert.Equal(t, tt.status, w.Code)
+		assert.Equal(t, "http://example.com", w.Header().Get("Location"))
+		assert.Equal(t, tt.cacheControl, w.Header().Get("Cache-Control"), tt.status)
+	}
+}
+
+func TestAppHandler_Password(t *testing.T) {
+	uc := &usecaseMock{s: "xyz", o: "http://example.com", r: 308, w: "secret"}
+	l := usecase.NewLiveliness(&pingMock{})
+	h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l))
+
+	get := func(prepare func(*http.Request)) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/xyz", nil)
+		prepare(request)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		return w
+	}
+
+	// api clients are challenged with Basic auth
+	w := get(func(*http.Request) {})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="protected link"`, w.Header().Get("WWW-Authenticate"))
+	assert.Empty(t, w.Header().Get("Location"))
+
+	// browsers get a form
+	w = get(func(request *http.Request) { request.Header.Set("Accept", "text/html") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "text/html", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+	assert.Contains(t, w.Body.String(), `<form method="post">`)
+
+	w = get(func(request *http.Request) { request.SetBasicAuth("", "secret") })
+	assert.Equal(t, 308, w.Code)
+	assert.Equal(t, "http://example.com", w.Header().Get("Location"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"), "protected redirects are not cached")
+
+	w = get(func(request *http.Request) { request.Header.Set("X-Link-Password", "secret") })
+	assert.Equal(t, 308, w.Code)
+
+	w = get(func(request *http.Request) { request.Header.Set("X-Link-Password", "too many") })
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	post := func(password string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/xyz", bytes.NewBufferString(url.Values{"password": {password}}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		return w
+	}
+	w = post("wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), `<form method="post">`)
+
+	w = post("secret")
+	assert.Equal(t, http.StatusSeeOther, w.Code, "password is not posted again to the destination")
+	assert.Equal(t, "http://example.com", w.Header().Get("Location"))
+}
+
+func TestAppHandler_LimitedClicks(t *testing.T) {
+	uc := &usecaseMock{s: "xyz", o: "http://example.com", r: 301, c: 1}
+	l := usecase.NewLiveliness(&pingMock{})
+	h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l))
+
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewBufferString(`{"url":"http://example.com","max_clicks":1}`))
+	request.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, request)
+	assert.Equal(t, 201, w.Code)
+	assert.Equal(t, usecase.LinkSettings{MaxClicks: 1}, uc.l)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/xyz", nil))
+	assert.Equal(t, 301, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"), "every click of a limited link reaches the server")
+
+	uc.c = -1
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/xyz", nil))
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+}
+
+func TestAppHandler_Window(t *testing.T) {
+	uc := &usecaseMock{s: "xyz", o: "http://example.com"}
+	l := usecase.NewLiveliness(&pingMock{})
+	h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l))
+
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewBufferString(
+		`{"url":"http://example.com","not_before":"2022-03-04T05:06:07Z","placeholder_url":"http://example.com/soon"}`))
+	request.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, request)
+	assert.Equal(t, 201, w.Code)
+
+	launch := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	require.NotNil(t, uc.l.NotBefore)
+	assert.True(t, launch.Equal(*uc.l.NotBefore))
+	assert.Equal(t, "http://example.com/soon", uc.l.PlaceholderURL)
+}
+
+func TestAppHandler_Update(t *testing.T) {
+	uc := &usecaseMock{s: "abc", o: "http://example.com"}
+	l := usecase.NewLiveliness(&pingMock{})
+	h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l))
+
+	update := func(body string) *http.Response {
+		request := httptest.NewRequest(http.MethodPatch, "/api/user/urls/xyz", bytes.NewBufferString(body))
+		request.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	response := update(`{"original_url":"http://example.org"}`)
+	assert.Equal(t, 200, response.StatusCode)
+	content, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	assert.JSONEq(t, `{
+		"short_url":"http://localhost:8080/xyz",
+		"original_url":"http://example.org",
+		"version":2,
+		"history":[{"version":1,"original_url":"http://example.com","replaced_at":"2022-06-01T12:00:00Z"}]
+	}`, string(content))
+
+	// original is required
+	response = update(`{}`)
+	assert.Equal(t, 400, response.StatusCode)
+	require.NoError(t, response.Body.Close())
+
+	// original the user has shortened under another id
+	uc.x = true
+	response = update(`{"original_url":"http://example.org"}`)
+	assert.Equal(t, 409, response.StatusCode)
+	content, err = ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	assert.Contains(t, string(content), `"result":"http://localhost:8080/abc"`)
+
+	// link of another user or a missing one
+	uc.x, uc.e = false, true
+	response = update(`{"original_url":"http://example.org"}`)
+	assert.Equal(t, 404, response.StatusCode)
+	require.NoError(t, response.Body.Close())
+}
+
+func TestAppHandler_Bulk(t *testing.T) {
+	t.Run("Test Handler streaming bulk import", func(t *testing.T) {
+
+		uc := &usecaseMock{s: "xyz"}
+		l := usecase.NewLiveliness(&pingMock{})
+
+		h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l))
+
+		tests := []struct {
+			name        string
+			contentType string
+			body        string
+			want        []usecase.OutputBatchItem
+		}{
+			{
+				name:        "ndjson",
+				contentType: "application/x-ndjson",
+				body: `{"correlation_id":"1","original_url":"http://example.com/1"}
+{"correlation_id":"2",
+{"correlation_id":"3","original_url":"http://example.com/3"}
+`,
+				want: []usecase.OutputBatchItem{
+					{Error: "line 2: unexpected end of JSON input"},
+					{CorrelationID: "1", ShortURL: "http://localhost:8080/xyz1"},
+					{CorrelationID: "3", ShortURL: "http://localhost:8080/xyz3"},
+				},
+			},
+			{
+				name:        "csv",
+				contentType: "text/csv; charset=utf-8",
+				body:        "original_url,comment,correlation_id\nhttp://example.com/1,first,1\nhttp://example.com/2\nhttp://example.com/3,,3\n",
+				want: []usecase.OutputBatchItem{
+					{Error: "line 3: wrong number of fields"},
+					{CorrelationID: "1", ShortURL: "http://localhost:8080/xyz1"},
+					{CorrelationID: "3", ShortURL: "http://localhost:8080/xyz3"},
+				},
+			},
+		}
+		for _, tt := range tests {
+			request := httptest.NewRequest(http.MethodPost, "/api/shorten/bulk", bytes.NewBufferString(tt.body))
+			request.Header.Set("Content-Type", tt.contentType)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, request)
+			response := w.Result()
+
+			assert.Equal(t, 200, response.StatusCode, tt.name)
+			assert.Equal(t, "application/x-ndjson", response.Header.Get("Content-Type"), tt.name)
+
+			got := make([]usecase.OutputBatchItem, 0)
+			decoder := json.NewDecoder(response.Body)
+			for decoder.More() {
+				var item usecase.OutputBatchItem
+				require.NoError(t, decoder.Decode(&item))
+				got = append(got, item)
+			}
+			assert.Equal(t, tt.want, got, tt.name)
+
+			err := response.Body.Close()
+			require.NoError(t, err)
+		}
+
+		// Input is stored in bounded chunks
+		uc.b = 0
+		var body bytes.Buffer
+		for i := 0; i < bulkChunkSize*2+1; i++ {
+			fmt.Fprintf(&body, "{\"correlation_id\":\"%v\",\"original_url\":\"http://example.com/%v\"}\n", i, i)
+		}
+		request := httptest.NewRequest(http.MethodPost, "/api/shorten/bulk", &body)
+		request.Header.Set("Content-Type", "application/x-ndjson")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		response := w.Result()
+
+		assert.Equal(t, 200, response.StatusCode)
+		assert.Equal(t, 3, uc.b)
+		assert.Equal(t, bulkChunkSize*2+1, bytes.Count(w.Body.Bytes(), []byte("\n")))
+
+		err := response.Body.Close()
+		require.NoError(t, err)
+
+		// Unsupported input
+		request = httptest.NewRequest(http.MethodPost, "/api/shorten/bulk", bytes.NewBufferString("[]"))
+		request.Header.Set("Content-Type", "application/json")
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		response = w.Result()
+
+		assert.Equal(t, 400, response.StatusCode)
+
+		err = response.Body.Close()
+		require.NoError(t, err)
+	})
+}
+
+func TestAppHandler_BulkStreams(t *testing.T) {
+	// streaming is not seen through contract check, it records the whole answer first
+	h := NewAppRouter("http://localhost:8080/", &usecaseMock{s: "xyz"}, usecase.NewLiveliness(&pingMock{}))
+	server := httptest.NewUnstartedServer(h)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	body, input := io.Pipe()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/api/shorten/bulk", body)
+	require.NoError(t, err)
+	request.Header.Set("Content-Type", "application/x-ndjson")
+
+	// the first chunk is sent, the body is still open
+	go func() {
+		for i := 0; i < bulkChunkSize; i++ {
+			fmt.Fprintf(input, "{\"correlation_id\":\"%v\",\"original_url\":\"http://example.com/%v\"}\n", i, i)
+		}
+	}()
+	response, err := server.Client().Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, 2, response.ProtoMajor)
+	assert.Equal(t, 200, response.StatusCode)
+
+	reader := bufio.NewReader(response.Body)
+	line, err := reader.ReadBytes('\n')
+	require.NoError(t, err, "results of the first chunk arrive before the body ends")
+	var item usecase.OutputBatchItem
+	require.NoError(t, json.Unmarshal(line, &item))
+	assert.Equal(t, usecase.OutputBatchItem{CorrelationID: "0", ShortURL: "http://localhost:8080/xyz0"}, item)
+
+	fmt.Fprintf(input, "{\"correlation_id\":\"last\",\"original_url\":\"http://example.com/last\"}\n")
+	require.NoError(t, input.Close())
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, bulkChunkSize, bytes.Count(rest, []byte("\n")))
+}
+
+func TestCSVReader_Settings(t *testing.T) {
+	body := "correlation_id,original_url,max_clicks,redirect,not_before,placeholder_url\n" +
+		"1,http://example.com/1,3,308,2022-03-04T05:06:07Z,http://example.com/soon\n" +
+		"2,http://example.com/2,,,,\n" +
+		"3,http://example.com/3,many,,,\n"
+	reader, err := newCSVReader(bytes.NewBufferString(body))
+	require.NoError(t, err)
+
+	launch := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	item, err := reader.Read()
+	require.NoError(t, err)
+	assert.Equal(t, usecase.Correlation{
+		CorrelationID: "1",
+		OriginalURL:   "http://example.com/1",
+		LinkSettings: usecase.LinkSettings{
+			Redirect:       308,
+			MaxClicks:      3,
+			NotBefore:      &launch,
+			PlaceholderURL: "http://example.com/soon",
+		},
+	}, item)
+
+	item, err = reader.Read()
+	require.NoError(t, err)
+	assert.Equal(t, usecase.Correlation{CorrelationID: "2", OriginalURL: "http://example.com/2"}, item, "empty settings are not set")
+
+	_, err = reader.Read()
+	var itemErr *itemError
+	require.True(t, errors.As(err, &itemErr), "got %v", err)
+	assert.Equal(t, "3", itemErr.correlationID)
+}
+
+func TestAppHandler_Export(t *testing.T) {
+	t.Run("Test Handler export user urls", func(t *testing.T) {
+
+		created := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+		uc := &usecaseMock{
+			p: usecase.Page{
+				URLs: []*domain.URL{
+					{Orig: "http://example.com/1", Short: "abc", CreatedAt: created},
+					{Orig: "http://example.com/2?a=1,2", Short: "xyz", CreatedAt: created.Add(time.Second)},
+					{Orig: "http://example.com/3", Short: "lim", CreatedAt: created.Add(2 * time.Second), MaxClicks: 2},
+				},
+			},
+		}
+		l := usecase.NewLiveliness(&pingMock{})
+
+		h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l))
+
+		tests := []struct {
+			name        string
+			query       string
+			accept      string
+			contentType string
+			want        string
+		}{
+			{
+				name:        "json by default",
+				contentType: "application/json",
+				want: `[{"short_url":"http://localhost:8080/abc","original_url":"http://example.com/1","created_at":"2022-06-01T12:00:00Z","status":"active"},` +
+					`{"short_url":"http://localhost:8080/xyz","original_url":"http://example.com/2?a=1,2","created_at":"2022-06-01T12:00:01Z","status":"active"},` +
+					`{"short_url":"http://localhost:8080/lim","original_url":"http://example.com/3","created_at":"2022-06-01T12:00:02Z","status":"used_up","clicks":2,"max_clicks":2}]`,
+			},
+			{
+				name:        "csv by format",
+				query:       "?format=csv",
+				accept:      "application/json",
+				contentType: "text/csv",
+				want: "short_url,original_url,created_at,status,clicks,max_clicks\n" +
+					"http://localhost:8080/abc,http://example.com/1,2022-06-01T12:00:00Z,active,,\n" +
+					"http://localhost:8080/xyz,\"http://example.com/2?a=1,2\",2022-06-01T12:00:01Z,active,,\n" +
+					"http://localhost:8080/lim,http://example.com/3,2022-06-01T12:00:02Z,used_up,2,2\n",
+			},
+			{
+				name:        "ndjson by accept",
+				accept:      "text/csv;q=0.5, application/x-ndjson",
+				contentType: "application/x-ndjson",
+				want: `{"short_url":"http://localhost:8080/abc","original_url":"http://example.com/1","created_at":"2022-06-01T12:00:00Z","status":"active"}` + "\n" +
+					`{"short_url":"http://localhost:8080/xyz","original_url":"http://example.com/2?a=1,2","created_at":"2022-06-01T12:00:01Z","status":"active"}` + "\n" +
+					`{"short_url":"http://localhost:8080/lim","original_url":"http://example.com/3","created_at":"2022-06-01T12:00:02Z","status":"used_up","clicks":2,"max_clicks":2}` + "\n",
+			},
+			{
+				name:        "csv by text range",
+				accept:      "text/*",
+				contentType: "text/csv",
+				want: "short_url,original_url,created_at,status,clicks,max_clicks\n" +
+					"http://localhost:8080/abc,http://example.com/1,2022-06-01T12:00:00Z,active,,\n" +
+					"http://localhost:8080/xyz,\"http://example.com/2?a=1,2\",2022-06-01T12:00:01Z,active,,\n" +
+					"http://localhost:8080/lim,http://example.com/3,2022-06-01T12:00:02Z,used_up,2,2\n",
+			},
+			{
+				name:        "json by application range",
+				accept:      "application/*",
+				contentType: "application/json",
+				want: `[{"short_url":"http://localhost:8080/abc","original_url":"http://example.com/1","created_at":"2022-06-01T12:00:00Z","status":"active"},` +
+					`{"short_url":"http://localhost:8080/xyz","original_url":"http://example.com/2?a=1,2","created_at":"2022-06-01T12:00:01Z","status":"active"},` +
+					`{"short_url":"http://localhost:8080/lim","original_url":"http://example.com/3","created_at":"2022-06-01T12:00:02Z","status":"used_up","clicks":2,"max_clicks":2}]`,
+			},
+		}
+		for _, tt := range tests {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/urls/export"+tt.query, nil)
+			if tt.accept != "" {
+				request.Header.Set("Accept", tt.accept)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, request)
+			response := w.Result()
+
+			assert.Equal(t, 200, response.StatusCode, tt.name)
+			assert.Equal(t, tt.contentType, response.Header.Get("Content-Type"), tt.name)
+			assert.Equal(t, tt.want, w.Body.String(), tt.name)
+			assert.Equal(t, "complete", w.Header().Get("X-Export-Status"), tt.name)
+
+			err := response.Body.Close()
+			require.NoError(t, err)
+		}
+
+		// Nothing acceptable
+		for _, accept := range []string{"application/xml", "image/*", "text/csv;q=0"} {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/urls/export", nil)
+			request.Header.Set("Accept", accept)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, request)
+			assert.Equal(t, http.StatusNotAcceptable, w.Code, accept)
+			assert.Equal(t, problemContentType, w.Header().Get("Content-Type"), accept)
+		}
+
+		// Unknown format
+		request := httptest.NewRequest(http.MethodGet, "/api/user/urls/export?format=xml", nil)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestAppHandler_WriteForwarding(t *testing.T) {
+	var forwarded []string
+	leader := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, err := request.Cookie("user_id")
+		forwarded = append(forwarded, fmt.Sprintf("%v %v %v", request.Method, request.URL.Path, err == nil))
+		writer.WriteHeader(http.StatusCreated)
+		_, _ = writer.Write([]byte("http://localhost:8080/abc"))
+	}))
+	leaderURL, err := url.Parse(leader.URL)
+	require.NoError(t, err)
+
+	uc := &usecaseMock{o: "http://ya.ru/"}
+	h := withContract(t, NewAppRouter("http://localhost:8080/", uc, usecase.NewLiveliness(&pingMock{}), WithWriteForwarding(leaderURL)))
+
+	// writes go to leader before follower registers user
+	request := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("http://ya.ru/"))
+	request.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "http://localhost:8080/abc", w.Body.String())
+	assert.Empty(t, w.Header().Get("Set-Cookie"))
+	assert.Equal(t, []string{"POST / false"}, forwarded)
+
+	// reads are served by follower
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/abc", nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Len(t, forwarded, 1)
+
+	// leader which is down is reported as unavailable
+	leader.Close()
+	request = httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewBufferString(`{"url":"http://ya.ru/"}`))
+	request.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, problemContentType, w.Header().Get("Content-Type"))
+}
+
+func TestAdminRouter_Metrics(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.Publish("cache", func() interface{} {
+		return map[string]int{"hits": 1}
+	})
+
+	w := httptest.NewRecorder()
+	NewAdminRouter(metrics).ServeHTTP(w, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"cache":{"hits":1}}`, w.Body.String(), "command line and runtime stats are not published")
+
+	// public router does not serve metrics, spec places them on admin listener so contract is not checked
+	w = httptest.NewRecorder()
+	NewAppRouter("http://localhost:8080/", &usecaseMock{}, usecase.NewLiveliness(&pingMock{})).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAppHandler_Problems(t *testing.T) {
+	h := NewAppRouter("http://localhost:8080/", &usecaseMock{}, usecase.NewLiveliness(&pingMock{}))
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		status  int
+		typ     string
+	}{
+		{
+			name:    "unknown route",
+			request: httptest.NewRequest(http.MethodGet, "/api/unknown/route", nil),
+			status:  http.StatusNotFound,
+			typ:     "/problems/not-found",
+		},
+		{
+			name:    "unknown method",
+			request: httptest.NewRequest(http.MethodDelete, "/api/shorten", nil),
+			status:  http.StatusMethodNotAllowed,
+			typ:     "/problems/method-not-allowed",
+		},
+		{
+			name:    "unknown method of infrastructure route",
+			request: httptest.NewRequest(http.MethodPost, "/ping", nil),
+			status:  http.StatusMethodNotAllowed,
+			typ:     "/problems/method-not-allowed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.request)
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, problemContentType, w.Header().Get("Content-Type"))
+
+			var p problem
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+			assert.Equal(t, tt.typ, p.Type)
+			assert.Equal(t, tt.status, p.Status)
+			assert.Equal(t, tt.request.URL.Path, p.Instance)
+		})
+	}
+}
+
+func TestAppHandler_CorruptGzip(t *testing.T) {
+	h := withContract(t, NewAppRouter("http://localhost:8080/", &usecaseMock{}, usecase.NewLiveliness(&pingMock{})))
+
+	request := httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewBufferString(`{"url":"http://ya.ru/"}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, problemContentType, w.Header().Get("Content-Type"))
+}
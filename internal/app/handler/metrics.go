@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Metrics serves named application metrics as one JSON object. Unlike expvar it publishes
+// nothing on its own, command line with its secrets and runtime memory stats stay private
+type Metrics struct {
+	mutex sync.RWMutex
+	vars  map[string]func() interface{}
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{vars: make(map[string]func() interface{})}
+}
+
+// Publish serves what fn returns under name, fn is called on every request
+func (m *Metrics) Publish(name string, fn func() interface{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.vars[name] = fn
+}
+
+func (m *Metrics) ServeHTTP(writer http.ResponseWriter, _ *http.Request) {
+	m.mutex.RLock()
+	values := make(map[string]interface{}, len(m.vars))
+	for name, fn := range m.vars {
+		values[name] = fn()
+	}
+	m.mutex.RUnlock()
+
+	marshaled, err := json.Marshal(values)
+	if err != nil {
+		log.Printf("error while marshal metrics: %v", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err = writer.Write(marshaled); err != nil {
+		log.Printf("error while writing answer: %v", err)
+	}
+}
+
+// NewAdminRouter serves metrics apart from public api, it is meant for a listener reachable by operators only
+func NewAdminRouter(metrics *Metrics) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, metrics)
+	return mux
+}
+
+// MetricsPath is where admin router serves metrics
+const MetricsPath = "/debug/vars"
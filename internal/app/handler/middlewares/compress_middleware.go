@@ -16,12 +16,15 @@ var compressible = map[string]string{
 	"application/javascript":   "",
 	"application/x-javascript": "",
 	"application/json":         "",
+	"application/problem+json": "",
 	"application/atom+xml":     "",
 }
 
 type gzipResponseWriter struct {
 	http.ResponseWriter
-	gzipWriter io.Writer
+	gzipWriter *gzip.Writer
+	// compressed is set once anything was written through gzipWriter
+	compressed bool
 }
 
 // canCompress checks if the Content-Type header represent a compressible type of content.
@@ -32,15 +35,8 @@ func (grw *gzipResponseWriter) canCompress() bool {
 
 func (grw *gzipResponseWriter) Write(b []byte) (int, error) {
 	if grw.canCompress() {
-		if closer, ok := (grw.gzipWriter).(*gzip.Writer); ok {
-			defer func() {
-				err := closer.Close()
-				if err != nil {
-					log.Printf("error while closing gzip writer, %v", err)
-				}
-			}()
-		}
-		// compressed
+		// compressed, gzip stream is closed when handler is done
+		grw.compressed = true
 		return grw.gzipWriter.Write(b)
 	}
 
@@ -55,28 +51,45 @@ func (grw *gzipResponseWriter) WriteHeader(statusCode int) {
 	grw.ResponseWriter.WriteHeader(statusCode)
 }
 
+// Flush sends everything written so far, so streaming responses reach client in time
+func (grw *gzipResponseWriter) Flush() {
+	if grw.compressed {
+		err := grw.gzipWriter.Flush()
+		if err != nil {
+			log.Printf("error while flushing gzip writer, %v", err)
+		}
+	}
+	if flusher, ok := grw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap gives access to original writer for http.ResponseController
+func (grw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return grw.ResponseWriter
+}
+
+// failingReader fails every read with err
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
 func CompressMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 
-		// decompress Request
-		var req http.Request
+		// decompress Request, a body which is not gzip fails to be read,
+		// so handlers answer it as any other unreadable body
 		if request.Header.Get(`Content-Encoding`) == "gzip" {
-			req = *request
-			gzReader, err := gzip.NewReader(req.Body)
+			gzReader, err := gzip.NewReader(request.Body)
 			if err != nil {
-				http.Error(writer, err.Error(), http.StatusInternalServerError)
-				return
+				request.Body = io.NopCloser(&failingReader{err: err})
+			} else {
+				request.Body = gzReader
 			}
-			request.Body = gzReader
-
-			defer func() {
-				err := gzReader.Close()
-				if err != nil {
-					log.Printf("error while decompress request boby, %v", err)
-					writer.WriteHeader(400)
-				}
-			}()
-
 		}
 		if !strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") {
 			next.ServeHTTP(writer, request)
@@ -92,5 +105,12 @@ func CompressMiddleware(next http.Handler) http.Handler {
 		}
 
 		next.ServeHTTP(&gzw, request)
+
+		if gzw.compressed {
+			err := gzWriter.Close()
+			if err != nil {
+				log.Printf("error while closing gzip writer, %v", err)
+			}
+		}
 	})
 }
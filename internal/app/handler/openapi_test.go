@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// contractHandler checks every request and response passing through the wrapped handler
+// against OpenAPISpec. Requests that violate the spec on purpose are allowed,
+// but then the handler is required to reject them with a client error
+type contractHandler struct {
+	t      *testing.T
+	router routers.Router
+	next   http.Handler
+}
+
+func init() {
+	// html pages and streams are checked as plain strings
+	plain := openapi3filter.RegisteredBodyDecoder("text/plain")
+	openapi3filter.RegisterBodyDecoder("text/html", plain)
+	openapi3filter.RegisterBodyDecoder("text/csv", plain)
+	openapi3filter.RegisterBodyDecoder("application/x-ndjson", plain)
+}
+
+func withContract(t *testing.T, next http.Handler) http.Handler {
+	t.Helper()
+
+	doc, err := openapi3.NewLoader().LoadFromData(OpenAPISpec)
+	require.NoError(t, err)
+	require.NoError(t, doc.Validate(context.Background()))
+
+	router, err := gorillamux.NewRouter(doc)
+	require.NoError(t, err)
+
+	return &contractHandler{t: t, router: router, next: next}
+}
+
+func (c *contractHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	c.t.Helper()
+	ctx := request.Context()
+
+	route, pathParams, err := c.router.FindRoute(request)
+	require.NoError(c.t, err, "%v %v is not described in spec", request.Method, request.URL.Path)
+
+	requestInput := &openapi3filter.RequestValidationInput{
+		Request:    request,
+		PathParams: pathParams,
+		Route:      route,
+	}
+	requestErr := openapi3filter.ValidateRequest(ctx, requestInput)
+
+	recorder := httptest.NewRecorder()
+	c.next.ServeHTTP(recorder, request)
+
+	if requestErr != nil {
+		assert.GreaterOrEqual(c.t, recorder.Code, 400,
+			"request violates spec (%v) but was accepted", requestErr)
+		assert.Less(c.t, recorder.Code, 500,
+			"request violates spec (%v) and caused server error", requestErr)
+	}
+
+	responseInput := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: requestInput,
+		Status:                 recorder.Code,
+		Header:                 recorder.Header(),
+		Body:                   ioutil.NopCloser(bytes.NewReader(recorder.Body.Bytes())),
+		Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+	}
+	err = openapi3filter.ValidateResponse(ctx, responseInput)
+	assert.NoError(c.t, err, "%v %v response violates spec", request.Method, request.URL.Path)
+
+	for k, v := range recorder.Header() {
+		writer.Header()[k] = v
+	}
+	writer.WriteHeader(recorder.Code)
+	if recorder.Body.Len() > 0 {
+		_, err = writer.Write(recorder.Body.Bytes())
+		require.NoError(c.t, err)
+	}
+}
+
+func TestAppHandler_OpenAPI(t *testing.T) {
+	t.Run("Test OpenAPI spec and docs are served", func(t *testing.T) {
+
+		uc := &usecaseMock{}
+		l := usecase.NewLiveliness(&pingMock{})
+
+		h := withContract(t, NewAppRouter("http://localhost:8080/", uc, l))
+
+		// Spec
+		request := httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		response := w.Result()
+
+		assert.Equal(t, 200, response.StatusCode)
+		assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+
+		content, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		assert.Equal(t, OpenAPISpec, content)
+
+		err = response.Body.Close()
+		require.NoError(t, err)
+
+		// Docs
+		request = httptest.NewRequest(http.MethodGet, "/api/docs", nil)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		response = w.Result()
+
+		assert.Equal(t, 200, response.StatusCode)
+		assert.Equal(t, "text/html", response.Header.Get("Content-Type"))
+
+		err = response.Body.Close()
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+// parsePageQuery reads pagination, sorting and filtering parameters of links listing:
+// limit, cursor, sort (created_at or -created_at), contains and created_after (RFC 3339)
+func parsePageQuery(values url.Values) (usecase.PageQuery, error) {
+	query := usecase.PageQuery{}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return query, invalidInput(err, "Please, specify limit as a positive number")
+		}
+		query.Limit = n
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := usecase.DecodeCursor(cursor)
+		if err != nil {
+			return query, err
+		}
+		query.After = after
+	}
+
+	switch values.Get("sort") {
+	case "", "created_at":
+	case "-created_at":
+		query.Desc = true
+	default:
+		return query, invalidInput(nil, "Please, sort by created_at or -created_at")
+	}
+
+	query.Contains = values.Get("contains")
+
+	if createdAfter := values.Get("created_after"); createdAfter != "" {
+		t, err := time.Parse(time.RFC3339, createdAfter)
+		if err != nil {
+			return query, invalidInput(err, "Please, specify created_after in RFC 3339 format")
+		}
+		query.CreatedAfter = t
+	}
+
+	return query, nil
+}
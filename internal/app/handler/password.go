@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/go-chi/chi"
+)
+
+// passwordHeader carries password of a protected link for clients which do not use Basic auth
+const passwordHeader = "X-Link-Password"
+
+var passwordPage = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8"/>
+  <title>Protected link</title>
+</head>
+<body>
+  <h1>This link is protected</h1>
+  <p>{{.}}</p>
+  <form method="post">
+    <input type="password" name="password" autofocus required/>
+    <button type="submit">Follow</button>
+  </form>
+</body>
+</html>
+`))
+
+// linkPassword takes password from the header or from Basic auth, user name of Basic auth is ignored
+func linkPassword(request *http.Request) string {
+	if password := request.Header.Get(passwordHeader); password != "" {
+		return password
+	}
+	_, password, _ := request.BasicAuth()
+	return password
+}
+
+// handleUnlock follows a protected link with password posted by the form
+func (a *AppRouter) handleUnlock(writer http.ResponseWriter, request *http.Request) {
+
+	if err := request.ParseForm(); err != nil {
+		a.writeProblem(writer, request, invalidInput(err, "Request body is not a valid form"))
+		return
+	}
+
+	id := chi.URLParam(request, "id")
+	redirect, err := a.usecase.RestoreOrigin(request.Context(), id, request.PostForm.Get("password"))
+	if err != nil {
+		a.writeRestoreError(writer, request, redirect, err)
+		return
+	}
+	// the form is not posted again to the destination
+	a.writeRedirect(writer, redirect, http.StatusSeeOther)
+}
+
+// writePasswordRequired asks browsers for password with a form and others with Basic auth challenge,
+// it reports false for errors which are not about password
+func (a *AppRouter) writePasswordRequired(writer http.ResponseWriter, request *http.Request, err error) bool {
+	kind := usecase.KindOf(err)
+	if kind != usecase.KindRateLimited && !errors.Is(err, usecase.ErrPasswordRequired) {
+		return false
+	}
+	if !acceptsHTML(request) {
+		if kind == usecase.KindUnauthorized {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="protected link"`)
+		}
+		a.writeProblem(writer, request, err)
+		return true
+	}
+
+	writer.Header().Set("Content-Type", "text/html")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(statusOf(kind))
+	if err = passwordPage.Execute(writer, usecase.PrettyOf(err)); err != nil {
+		log.Printf("error while writing answer: %v", err)
+	}
+	return true
+}
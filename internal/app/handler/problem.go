@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+const problemContentType = "application/problem+json"
+
+// problem is a RFC 7807 error response body
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Result is an extension member which holds already existing short url on conflicts
+	Result string `json:"result,omitempty"`
+}
+
+// statusOf maps usecase layer error kinds onto http statuses
+func statusOf(kind usecase.ErrorKind) int {
+	switch kind {
+	case usecase.KindInvalidInput:
+		return http.StatusBadRequest
+	case usecase.KindUnauthorized:
+		return http.StatusUnauthorized
+	case usecase.KindNotFound:
+		return http.StatusNotFound
+	case usecase.KindConflict:
+		return http.StatusConflict
+	case usecase.KindUnavailable:
+		return http.StatusServiceUnavailable
+	case usecase.KindBlocked:
+		return http.StatusUnavailableForLegalReasons
+	case usecase.KindRateLimited:
+		return http.StatusTooManyRequests
+	case usecase.KindGone:
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func newProblem(request *http.Request, err error) problem {
+	kind := usecase.KindOf(err)
+	status := statusOf(kind)
+	return problem{
+		Type:     "/problems/" + kind.String(),
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   usecase.PrettyOf(err),
+		Instance: request.URL.RequestURI(),
+	}
+}
+
+// writeProblem answers with problem+json body which describes given error
+func (a *AppRouter) writeProblem(writer http.ResponseWriter, request *http.Request, err error) {
+	a.writeProblemBody(writer, newProblem(request, err), err)
+}
+
+// writeConflict answers with problem+json body which still carries existing short url
+func (a *AppRouter) writeConflict(writer http.ResponseWriter, request *http.Request, err usecase.ErrAlreadyExists) {
+	p := newProblem(request, err)
+	p.Result = a.baseURL + err.ExistShortenID
+	a.writeProblemBody(writer, p, err)
+}
+
+// writeStatusProblem answers with problem+json body of http status no usecase error kind stands for
+func (a *AppRouter) writeStatusProblem(writer http.ResponseWriter, request *http.Request, status int, detail string) {
+	title := http.StatusText(status)
+	a.writeProblemBody(writer, problem{
+		Type:     "/problems/" + strings.ReplaceAll(strings.ToLower(title), " ", "-"),
+		Title:    title,
+		Status:   status,
+		Detail:   detail,
+		Instance: request.URL.RequestURI(),
+	}, nil)
+}
+
+// handleNotFound answers requests no route matches
+func (a *AppRouter) handleNotFound(writer http.ResponseWriter, request *http.Request) {
+	a.writeProblem(writer, request, usecase.NewError(usecase.KindNotFound, nil, ""))
+}
+
+// handleMethodNotAllowed answers requests of a route which does not take their method
+func (a *AppRouter) handleMethodNotAllowed(writer http.ResponseWriter, request *http.Request) {
+	a.writeStatusProblem(writer, request, http.StatusMethodNotAllowed,
+		fmt.Sprintf("Sorry, %v is not allowed here", request.Method))
+}
+
+func (a *AppRouter) writeProblemBody(writer http.ResponseWriter, p problem, err error) {
+	if p.Status >= http.StatusInternalServerError {
+		log.Printf("%v %v", p.Instance, err)
+	}
+
+	marshaled, _ := json.Marshal(p)
+	writer.Header().Set("Content-Type", problemContentType)
+	writer.WriteHeader(p.Status)
+
+	_, err = writer.Write(marshaled)
+	if err != nil {
+		log.Printf("error while writing answer: %v", err)
+	}
+}
+
+// invalidInput wraps handler level errors of request parsing
+func invalidInput(err error, prettyMsg string) error {
+	return usecase.NewError(usecase.KindInvalidInput, err, prettyMsg)
+}
+
+// errNoUser is an error for requests which have no user in context
+var errNoUser = usecase.NewError(usecase.KindUnauthorized, nil, "")
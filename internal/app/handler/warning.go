@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var warningPage = template.Must(template.New("warning").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8"/>
+  <title>Blocked destination</title>
+</head>
+<body>
+  <h1>This link is blocked</h1>
+  <p>The short link leads to a destination which is considered unsafe and is not followed:</p>
+  <p><code>{{.}}</code></p>
+</body>
+</html>
+`))
+
+// acceptsHTML reports if request came from a browser
+func acceptsHTML(request *http.Request) bool {
+	return strings.Contains(request.Header.Get("Accept"), "text/html")
+}
+
+// writeWarningPage shows blocked destination as text, so it can't be followed by a click
+func (a *AppRouter) writeWarningPage(writer http.ResponseWriter, destination string) {
+	writer.Header().Set("Content-Type", "text/html")
+	writer.WriteHeader(http.StatusUnavailableForLegalReasons)
+
+	err := warningPage.Execute(writer, destination)
+	if err != nil {
+		log.Printf("error while writing answer: %v", err)
+	}
+}
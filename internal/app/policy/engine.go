@@ -0,0 +1,103 @@
+package policy
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Engine checks destinations against rules loaded from a file
+// and picks up changes of that file without restart
+type Engine struct {
+	path    string
+	mutex   sync.RWMutex
+	rules   *Rules
+	modTime time.Time
+}
+
+// NewEngine loads rules from path, an error is returned if the file can't be parsed
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{path: path}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload reads rules file again, current rules stay in use if new ones are invalid
+func (e *Engine) Reload() error {
+
+	file, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	rules, err := ParseRules(file)
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.rules = rules
+	e.modTime = info.ModTime()
+	return nil
+}
+
+// Watch polls rules file every interval and reloads it when modified, until ctx is done.
+// Interval which is not positive does not watch, rules are loaded once
+func (e *Engine) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(e.path)
+			if err != nil {
+				log.Printf("can't stat policy file: %v", err)
+				continue
+			}
+
+			e.mutex.RLock()
+			modified := !info.ModTime().Equal(e.modTime)
+			e.mutex.RUnlock()
+			if !modified {
+				continue
+			}
+
+			if err := e.Reload(); err != nil {
+				log.Printf("policy file is not reloaded, previous rules are in use: %v", err)
+				continue
+			}
+			log.Printf("policy reloaded with %v rules", e.Len())
+		}
+	}
+}
+
+func (e *Engine) Len() int {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.rules.Len()
+}
+
+// Check satisfies usecase.DestinationPolicy
+func (e *Engine) Check(destination string) error {
+	e.mutex.RLock()
+	rules := e.rules
+	e.mutex.RUnlock()
+	return rules.Check(destination)
+}
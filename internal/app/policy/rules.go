@@ -0,0 +1,154 @@
+package policy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ErrBlocked is returned for destinations which are not allowed by rules
+var ErrBlocked = errors.New("destination is blocked by policy")
+
+// Rules is a parsed immutable set of destination rules.
+//
+// Rules file is line based, empty lines and lines starting with # are ignored:
+//
+//	mode allowlist          # only allowed hosts may be shortened, default is blocklist
+//	allow example.com       # exact host
+//	allow *.example.com     # any subdomain of example.com, not example.com itself
+//	deny  *.evil.com        # hosts matched by no rule are allowed in blocklist mode only
+//	deny-path ^/wp-login    # regular expression matched against URL path of any host
+//
+// The most specific host rule wins: an exact host is more specific than any wildcard and
+// a longer wildcard than a shorter one, so "allow safe.evil.com" is an exception of
+// "deny *.evil.com". Equally specific allow and deny rules deny. A wildcard does not match
+// the apex domain, so both example.com and *.example.com are needed for a whole domain
+type Rules struct {
+	allowlist  bool
+	allow      hostSet
+	deny       hostSet
+	denyPaths  []*regexp.Regexp
+	ruleNumber int
+}
+
+// hostSet matches exact hosts and wildcard domain suffixes
+type hostSet struct {
+	exact    map[string]struct{}
+	suffixes []string
+}
+
+func (h *hostSet) add(pattern string) {
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		// keep leading dot, so *.example.com does not match badexample.com
+		h.suffixes = append(h.suffixes, pattern[1:])
+		return
+	}
+	if h.exact == nil {
+		h.exact = make(map[string]struct{})
+	}
+	h.exact[pattern] = struct{}{}
+}
+
+// match reports how specific the most specific pattern matching host is, zero means no match.
+// Exact host is longer than any suffix it matches, so it is the most specific one
+func (h *hostSet) match(host string) int {
+	if _, ok := h.exact[host]; ok {
+		return len(host) + 1
+	}
+	specificity := 0
+	for _, suffix := range h.suffixes {
+		if strings.HasSuffix(host, suffix) && len(suffix) > specificity {
+			specificity = len(suffix)
+		}
+	}
+	return specificity
+}
+
+// ParseRules reads rules in the format described at Rules
+func ParseRules(reader io.Reader) (*Rules, error) {
+
+	rules := &Rules{}
+	sc := bufio.NewScanner(reader)
+	line := 0
+	for sc.Scan() {
+		line++
+
+		text := sc.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %v: expected directive and value, got %q", line, text)
+		}
+
+		directive, value := fields[0], fields[1]
+		switch directive {
+		case "mode":
+			switch value {
+			case "allowlist":
+				rules.allowlist = true
+			case "blocklist":
+				rules.allowlist = false
+			default:
+				return nil, fmt.Errorf("line %v: unknown mode %q", line, value)
+			}
+			continue
+		case "allow":
+			rules.allow.add(value)
+		case "deny":
+			rules.deny.add(value)
+		case "deny-path":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+			rules.denyPaths = append(rules.denyPaths, re)
+		default:
+			return nil, fmt.Errorf("line %v: unknown directive %q", line, directive)
+		}
+		rules.ruleNumber++
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Len returns number of host and path rules
+func (r *Rules) Len() int {
+	return r.ruleNumber
+}
+
+// Check returns ErrBlocked wrapped with the reason if destination is not allowed
+func (r *Rules) Check(destination string) error {
+
+	parsed, err := url.Parse(destination)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBlocked, err)
+	}
+	// fully qualified evil.com. is the same host as evil.com
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+
+	denied, allowed := r.deny.match(host), r.allow.match(host)
+	if denied > 0 && denied >= allowed {
+		return fmt.Errorf("%w: host %v is denied", ErrBlocked, host)
+	}
+	for _, re := range r.denyPaths {
+		if re.MatchString(parsed.Path) {
+			return fmt.Errorf("%w: path %v matches %v", ErrBlocked, parsed.Path, re)
+		}
+	}
+	if r.allowlist && allowed == 0 {
+		return fmt.Errorf("%w: host %v is not in allowlist", ErrBlocked, host)
+	}
+	return nil
+}
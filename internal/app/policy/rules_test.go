@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRules_Check(t *testing.T) {
+	tests := []struct {
+		name        string
+		rules       string
+		destination string
+		blocked     bool
+	}{
+		{"empty rules allow all", "", "http://example.com/", false},
+		{"exact host", "deny evil.com", "http://evil.com/a", true},
+		{"exact host is case insensitive", "deny Evil.com", "http://EVIL.com/a", true},
+		{"trailing dot of exact host", "deny evil.com", "http://evil.com./a", true},
+		{"trailing dot of wildcard host", "deny *.evil.com", "http://www.Evil.com./a", true},
+		{"exact host does not match subdomain", "deny evil.com", "http://www.evil.com/a", false},
+		{"wildcard matches subdomain", "deny *.evil.com", "http://a.b.evil.com/", true},
+		{"wildcard does not match apex", "deny *.evil.com", "http://evil.com/", false},
+		{"wildcard does not match suffix", "deny *.evil.com", "http://notevil.com/", false},
+		{"path regexp", "deny-path ^/wp-login", "https://blog.com/wp-login.php", true},
+		{"path regexp no match", "deny-path ^/wp-login", "https://blog.com/post/wp-login", false},
+		{"allowlist allows listed", "mode allowlist\nallow *.corp.com", "https://wiki.corp.com/", false},
+		{"allowlist blocks unlisted", "mode allowlist\nallow *.corp.com", "https://example.com/", true},
+		{"exact deny wins over wildcard allow", "mode allowlist\nallow *.corp.com\ndeny bad.corp.com", "https://bad.corp.com/", true},
+		{"exact allow is exception of wildcard deny", "deny *.evil.com\nallow safe.evil.com", "https://safe.evil.com/", false},
+		{"exception does not allow siblings", "deny *.evil.com\nallow safe.evil.com", "https://other.evil.com/", true},
+		{"longer wildcard allow wins", "deny *.evil.com\nallow *.docs.evil.com", "https://a.docs.evil.com/", false},
+		{"longer wildcard deny wins", "allow *.corp.com\ndeny *.lab.corp.com\nmode allowlist", "https://x.lab.corp.com/", true},
+		{"equally specific rules deny", "allow evil.com\ndeny evil.com", "http://evil.com/", true},
+		{"allowed host still has denied paths", "deny *.evil.com\nallow safe.evil.com\ndeny-path ^/admin", "https://safe.evil.com/admin", true},
+		{"wildcard allow does not cover apex", "mode allowlist\nallow *.corp.com", "https://corp.com/", true},
+		{"apex and wildcard cover domain", "mode allowlist\nallow corp.com\nallow *.corp.com", "https://corp.com/", false},
+		{"comments ignored", "# deny example.com\n\ndeny evil.com # phishing", "http://example.com/", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseRules(strings.NewReader(tt.rules))
+			require.NoError(t, err)
+
+			err = rules.Check(tt.destination)
+			if tt.blocked {
+				assert.ErrorIs(t, err, ErrBlocked)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseRules_Invalid(t *testing.T) {
+	for _, rules := range []string{
+		"block evil.com",
+		"deny",
+		"deny a.com b.com",
+		"mode greylist",
+		"deny-path ([",
+	} {
+		t.Run(rules, func(t *testing.T) {
+			_, err := ParseRules(strings.NewReader(rules))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestEngine_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	require.NoError(t, os.WriteFile(path, []byte("deny evil.com\n"), 0644))
+
+	engine, err := NewEngine(path)
+	require.NoError(t, err)
+	assert.Error(t, engine.Check("http://evil.com/"))
+	assert.NoError(t, engine.Check("http://phish.com/"))
+
+	// invalid rules keep previous ones in use
+	require.NoError(t, os.WriteFile(path, []byte("deny\n"), 0644))
+	assert.Error(t, engine.Reload())
+	assert.Error(t, engine.Check("http://evil.com/"))
+
+	require.NoError(t, os.WriteFile(path, []byte("deny phish.com\n"), 0644))
+	require.NoError(t, engine.Reload())
+	assert.NoError(t, engine.Check("http://evil.com/"))
+	assert.Error(t, engine.Check("http://phish.com/"))
+}
+
+func TestEngine_WatchDisabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	require.NoError(t, os.WriteFile(path, []byte("deny evil.com\n"), 0644))
+	engine, err := NewEngine(path)
+	require.NoError(t, err)
+
+	// zero interval does not watch, it must not panic on ticker
+	done := make(chan struct{})
+	go func() {
+		engine.Watch(context.Background(), 0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watch with zero interval does not return")
+	}
+	assert.Error(t, engine.Check("http://evil.com/"))
+}
@@ -0,0 +1,521 @@
+// Package boltdb keeps links in an embedded bbolt file, so a single binary has durable storage
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the file. Links are JSON by short id, every user has a nested bucket in users
+// ordered by creation time and short id, originals maps owner and original url to short id,
+// versions holds JSON of previous originals by short id of changed links
+var (
+	linksBucket     = []byte("links")
+	usersBucket     = []byte("users")
+	originalsBucket = []byte("originals")
+	versionsBucket  = []byte("versions")
+)
+
+// iterateChunk is a number of links read in a single transaction while iterating,
+// a read transaction is not held while caller handles links
+const iterateChunk = 1000
+
+type DB struct {
+	db *bolt.DB
+}
+
+// Open opens or creates a file at path, waiting for a second if another process holds it
+func Open(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{linksBucket, usersBucket, originalsBucket, versionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &DB{db: db}, nil
+}
+
+// userKey orders user links by creation time and short id, as usecase.Cursor does
+func userKey(createdAt time.Time, short string) []byte {
+	key := make([]byte, 12, 12+len(short))
+	// flipped sign bit keeps negative seconds before positive ones
+	binary.BigEndian.PutUint64(key, uint64(createdAt.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(key[8:], uint32(createdAt.Nanosecond()))
+	return append(key, short...)
+}
+
+func originalKey(owner, orig string) []byte {
+	return []byte(owner + "\x00" + orig)
+}
+
+func getURL(tx *bolt.Tx, key string) (*domain.URL, error) {
+	data := tx.Bucket(linksBucket).Get([]byte(key))
+	if data == nil {
+		return nil, fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	var url domain.URL
+	if err := json.Unmarshal(data, &url); err != nil {
+		return nil, fmt.Errorf("link %v is broken: %w", key, err)
+	}
+	return &url, nil
+}
+
+// put writes link and its indexes, a link of original the owner has already shortened
+// under another id is not written and reported with ErrAlreadyExists
+func put(tx *bolt.Tx, url *domain.URL) error {
+	originals := tx.Bucket(originalsBucket)
+	if existing := originals.Get(originalKey(url.Owner, url.Orig)); existing != nil && string(existing) != url.Short {
+		return usecase.ErrAlreadyExists{
+			Err:            errors.New("duplicate entry, given entity record already exists"),
+			ExistShortenID: string(existing),
+			Orig:           url.Orig,
+		}
+	}
+
+	stored, err := getURL(tx, url.Short)
+	if err == nil {
+		if err = unindex(tx, stored); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, usecase.ErrNotFound) {
+		return err
+	}
+
+	data, err := json.Marshal(url)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(linksBucket).Put([]byte(url.Short), data); err != nil {
+		return err
+	}
+	if err = originals.Put(originalKey(url.Owner, url.Orig), []byte(url.Short)); err != nil {
+		return err
+	}
+	if url.Owner == "" {
+		// anonymous links are not listed by user
+		return nil
+	}
+	user, err := tx.Bucket(usersBucket).CreateBucketIfNotExists([]byte(url.Owner))
+	if err != nil {
+		return err
+	}
+	return user.Put(userKey(url.CreatedAt, url.Short), nil)
+}
+
+// unindex removes link from user and original indexes, user without links is removed
+func unindex(tx *bolt.Tx, url *domain.URL) error {
+	if err := tx.Bucket(originalsBucket).Delete(originalKey(url.Owner, url.Orig)); err != nil {
+		return err
+	}
+	if url.Owner == "" {
+		return nil
+	}
+	users := tx.Bucket(usersBucket)
+	user := users.Bucket([]byte(url.Owner))
+	if user == nil {
+		return nil
+	}
+	if err := user.Delete(userKey(url.CreatedAt, url.Short)); err != nil {
+		return err
+	}
+	if first, _ := user.Cursor().First(); first == nil {
+		return users.DeleteBucket([]byte(url.Owner))
+	}
+	return nil
+}
+
+func (d *DB) Store(ctx context.Context, url *domain.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, url)
+	})
+}
+
+// BatchWrite writes links in one transaction, links whose owners have already
+// shortened the same originals are skipped and reported with ErrBatchConflicts
+func (d *DB) BatchWrite(ctx context.Context, urls []domain.URL) error {
+	if len(urls) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	conflicts := make(map[int]usecase.ErrAlreadyExists)
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		for i := range urls {
+			err := put(tx, &urls[i])
+			var exists usecase.ErrAlreadyExists
+			if errors.As(err, &exists) {
+				conflicts[i] = exists
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return usecase.ErrBatchConflicts{Conflicts: conflicts}
+	}
+	return nil
+}
+
+func (d *DB) FindByKey(ctx context.Context, key string) (*domain.URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var url *domain.URL
+	err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		url, err = getURL(tx, key)
+		return err
+	})
+	return url, err
+}
+
+func (d *DB) FindAll(ctx context.Context, key string) []*domain.URL {
+	result := make([]*domain.URL, 0)
+	err := d.ForEach(ctx, key, func(url *domain.URL) error {
+		result = append(result, url)
+		return nil
+	})
+	if err != nil {
+		return []*domain.URL{}
+	}
+	return result
+}
+
+// FindPage seeks to the cursor in user index, so deep pages cost the same as the first one
+func (d *DB) FindPage(ctx context.Context, key string, query usecase.PageQuery) (usecase.Page, error) {
+	if err := ctx.Err(); err != nil {
+		return usecase.Page{}, err
+	}
+
+	page := usecase.Page{URLs: make([]*domain.URL, 0)}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if key == "" {
+			return nil
+		}
+		user := tx.Bucket(usersBucket).Bucket([]byte(key))
+		if user == nil {
+			return nil
+		}
+		cursor := user.Cursor()
+
+		var k []byte
+		next := cursor.Next
+		switch {
+		case query.After == nil && query.Desc:
+			k, _ = cursor.Last()
+			next = cursor.Prev
+		case query.After == nil:
+			k, _ = cursor.First()
+		default:
+			after := userKey(query.After.CreatedAt, query.After.Short)
+			k, _ = cursor.Seek(after)
+			if query.Desc {
+				next = cursor.Prev
+				// seek stops at the first key not less than cursor, that is after it
+				if k == nil {
+					k, _ = cursor.Last()
+				} else {
+					k, _ = cursor.Prev()
+				}
+			} else if bytes.Equal(k, after) {
+				k, _ = cursor.Next()
+			}
+		}
+
+		for ; k != nil; k, _ = next() {
+			url, err := getURL(tx, string(k[12:]))
+			if err != nil {
+				return err
+			}
+			if !query.Match(url) {
+				continue
+			}
+			if len(page.URLs) == query.Limit {
+				last := page.URLs[len(page.URLs)-1]
+				page.Next = &usecase.Cursor{CreatedAt: last.CreatedAt, Short: last.Short}
+				break
+			}
+			page.URLs = append(page.URLs, url)
+		}
+		return nil
+	})
+	return page, err
+}
+
+// ForEach visits user links in creation order, reading them by chunks
+func (d *DB) ForEach(ctx context.Context, key string, fn func(*domain.URL) error) error {
+	return d.iterate(ctx, fn, func(tx *bolt.Tx) (*bolt.Bucket, func([]byte) string) {
+		if key == "" {
+			return nil, nil
+		}
+		return tx.Bucket(usersBucket).Bucket([]byte(key)), func(k []byte) string {
+			return string(k[12:])
+		}
+	})
+}
+
+// Dump visits every link in order of short ids, reading them by chunks
+func (d *DB) Dump(ctx context.Context, fn func(*domain.URL) error) error {
+	return d.iterate(ctx, fn, func(tx *bolt.Tx) (*bolt.Bucket, func([]byte) string) {
+		return tx.Bucket(linksBucket), func(k []byte) string {
+			return string(k)
+		}
+	})
+}
+
+// iterate walks keys of a bucket which tell short ids of links, fn is called out of transaction
+func (d *DB) iterate(ctx context.Context, fn func(*domain.URL) error,
+	bucket func(*bolt.Tx) (*bolt.Bucket, func([]byte) string)) error {
+
+	var last []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk := make([]*domain.URL, 0, iterateChunk)
+		err := d.db.View(func(tx *bolt.Tx) error {
+			b, short := bucket(tx)
+			if b == nil {
+				return nil
+			}
+			cursor := b.Cursor()
+			k, _ := cursor.First()
+			if last != nil {
+				k, _ = cursor.Seek(last)
+				if bytes.Equal(k, last) {
+					k, _ = cursor.Next()
+				}
+			}
+			for ; k != nil && len(chunk) < iterateChunk; k, _ = cursor.Next() {
+				url, err := getURL(tx, short(k))
+				if err != nil {
+					return err
+				}
+				chunk = append(chunk, url)
+				// keys are valid during transaction only
+				last = append(last[:0], k...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, url := range chunk {
+			if err = fn(url); err != nil {
+				return err
+			}
+		}
+		if len(chunk) < iterateChunk {
+			return nil
+		}
+	}
+}
+
+func (d *DB) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		url, err := getURL(tx, key)
+		if err != nil {
+			return err
+		}
+		if err = unindex(tx, url); err != nil {
+			return err
+		}
+		if err = tx.Bucket(versionsBucket).Delete([]byte(key)); err != nil {
+			return err
+		}
+		return tx.Bucket(linksBucket).Delete([]byte(key))
+	})
+}
+
+// Update rewrites the link and its history in one write transaction
+func (d *DB) Update(ctx context.Context, key string, orig string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		url, err := getURL(tx, key)
+		if err != nil {
+			return err
+		}
+		if url.Orig == orig {
+			return nil
+		}
+		history, err := getHistory(tx, key)
+		if err != nil {
+			return err
+		}
+		history = append(history, domain.Version{Orig: url.Orig, ReplacedAt: at})
+
+		url.Orig = orig
+		if err = put(tx, url); err != nil {
+			return err
+		}
+		data, err := json.Marshal(history)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(versionsBucket).Put([]byte(key), data)
+	})
+}
+
+// Click counts the link down in a write transaction, bolt has one writer at a time
+func (d *DB) Click(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		url, err := getURL(tx, key)
+		if err != nil {
+			return err
+		}
+		if url.MaxClicks == 0 {
+			return nil
+		}
+		if url.ClicksLeft <= 0 {
+			return fmt.Errorf("link %v: %w", key, usecase.ErrExhausted)
+		}
+		url.ClicksLeft--
+		return put(tx, url)
+	})
+}
+
+func (d *DB) History(ctx context.Context, key string) ([]domain.Version, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var history []domain.Version
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if _, err := getURL(tx, key); err != nil {
+			return err
+		}
+		var err error
+		history, err = getHistory(tx, key)
+		return err
+	})
+	return history, err
+}
+
+func getHistory(tx *bolt.Tx, key string) ([]domain.Version, error) {
+	history := make([]domain.Version, 0)
+	data := tx.Bucket(versionsBucket).Get([]byte(key))
+	if data == nil {
+		return history, nil
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("history of %v is broken: %w", key, err)
+	}
+	return history, nil
+}
+
+func (d *DB) Reassign(ctx context.Context, key string, owner string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		url, err := getURL(tx, key)
+		if err != nil {
+			return err
+		}
+		url.Owner = owner
+		return put(tx, url)
+	})
+}
+
+// CountUsers counts users who own links
+func (d *DB) CountUsers(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	count := 0
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(_, _ []byte) error {
+			count++
+			return nil
+		})
+	})
+	return count, err
+}
+
+// Backup writes a consistent copy of the file while it is in use,
+// the copy is a read transaction snapshot so writers are not blocked
+func (d *DB) Backup(w io.Writer) (int64, error) {
+	var written int64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		written, err = tx.WriteTo(w)
+		return err
+	})
+	return written, err
+}
+
+// BackupFile writes backup to a temporary file and replaces path with it,
+// so path holds either the previous backup or the complete new one
+func (d *DB) BackupFile(path string) (int64, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	written, err := d.Backup(file)
+	if err != nil {
+		return 0, err
+	}
+	if err = file.Sync(); err != nil {
+		return 0, err
+	}
+	if err = file.Close(); err != nil {
+		return 0, err
+	}
+	return written, os.Rename(file.Name(), path)
+}
+
+func (d *DB) Ping(_ context.Context) error {
+	if d == nil {
+		return errors.New("storage is not opened")
+	}
+	return nil
+}
+
+func (d *DB) Close() error {
+	return d.db.Close()
+}
@@ -0,0 +1,150 @@
+package boltdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/storagetest"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTemp(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "links.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func shorts(urls []*domain.URL) []string {
+	result := make([]string, 0, len(urls))
+	for _, url := range urls {
+		result = append(result, url.Short)
+	}
+	return result
+}
+
+func TestDB_StoreAndFind(t *testing.T) {
+	ctx := context.Background()
+	db := openTemp(t)
+
+	url := &domain.URL{Short: "a", Orig: "http://a.com/", Owner: "u1", CreatedAt: time.Now().UTC()}
+	require.NoError(t, db.Store(ctx, url))
+
+	found, err := db.FindByKey(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, url.Orig, found.Orig)
+	assert.True(t, url.CreatedAt.Equal(found.CreatedAt))
+
+	_, err = db.FindByKey(ctx, "b")
+	assert.True(t, errors.Is(err, usecase.ErrNotFound))
+
+	// the same original of the same owner is a conflict
+	err = db.Store(ctx, &domain.URL{Short: "b", Orig: "http://a.com/", Owner: "u1"})
+	var exists usecase.ErrAlreadyExists
+	require.True(t, errors.As(err, &exists))
+	assert.Equal(t, "a", exists.ExistShortenID)
+
+	// reassigned link moves between users
+	require.NoError(t, db.Reassign(ctx, "a", "u2"))
+	assert.Empty(t, db.FindAll(ctx, "u1"))
+	assert.Equal(t, []string{"a"}, shorts(db.FindAll(ctx, "u2")))
+	users, err := db.CountUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, users)
+
+	require.NoError(t, db.Delete(ctx, "a"))
+	assert.True(t, errors.Is(db.Delete(ctx, "a"), usecase.ErrNotFound))
+	// original is free after delete
+	require.NoError(t, db.Store(ctx, &domain.URL{Short: "c", Orig: "http://a.com/", Owner: "u2"}))
+}
+
+func TestDB_BatchWriteAndPages(t *testing.T) {
+	ctx := context.Background()
+	db := openTemp(t)
+
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	var urls []domain.URL
+	for i := 0; i < 5; i++ {
+		urls = append(urls, domain.URL{
+			Short:     fmt.Sprintf("s%v", i),
+			Orig:      fmt.Sprintf("http://%v.com/", i),
+			Owner:     "u1",
+			CreatedAt: created.Add(time.Duration(i) * time.Second),
+		})
+	}
+	// a duplicate original within the batch
+	urls = append(urls, domain.URL{Short: "dup", Orig: "http://0.com/", Owner: "u1", CreatedAt: created})
+
+	err := db.BatchWrite(ctx, urls)
+	var conflicts usecase.ErrBatchConflicts
+	require.True(t, errors.As(err, &conflicts))
+	assert.Equal(t, "s0", conflicts.Conflicts[5].ExistShortenID)
+	assert.Len(t, conflicts.Conflicts, 1)
+	assert.NoError(t, db.BatchWrite(ctx, nil))
+
+	page, err := db.FindPage(ctx, "u1", usecase.PageQuery{Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"s0", "s1"}, shorts(page.URLs))
+	require.NotNil(t, page.Next)
+
+	page, err = db.FindPage(ctx, "u1", usecase.PageQuery{Limit: 2, After: page.Next})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"s2", "s3"}, shorts(page.URLs))
+
+	page, err = db.FindPage(ctx, "u1", usecase.PageQuery{Limit: 10, Desc: true, After: page.Next})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"s2", "s1", "s0"}, shorts(page.URLs))
+	assert.Nil(t, page.Next)
+
+	page, err = db.FindPage(ctx, "u1", usecase.PageQuery{Limit: 10, Desc: true, Contains: "4"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"s4"}, shorts(page.URLs))
+}
+
+func TestDB_IterateAndBackup(t *testing.T) {
+	ctx := context.Background()
+	db := openTemp(t)
+
+	count := iterateChunk*2 + 1
+	urls := make([]domain.URL, 0, count)
+	for i := 0; i < count; i++ {
+		urls = append(urls, domain.URL{Short: fmt.Sprintf("%05d", i), Orig: fmt.Sprintf("http://%v.com/", i), Owner: "u1"})
+	}
+	require.NoError(t, db.BatchWrite(ctx, urls))
+
+	visited := 0
+	require.NoError(t, db.ForEach(ctx, "u1", func(*domain.URL) error {
+		visited++
+		return nil
+	}))
+	assert.Equal(t, count, visited)
+
+	backup := filepath.Join(t.TempDir(), "backup.db")
+	_, err := db.BackupFile(backup)
+	require.NoError(t, err)
+
+	restored, err := Open(backup)
+	require.NoError(t, err)
+	defer restored.Close()
+
+	dumped := 0
+	require.NoError(t, restored.Dump(ctx, func(*domain.URL) error {
+		dumped++
+		return nil
+	}))
+	assert.Equal(t, count, dumped)
+}
+
+func TestDB_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) usecase.Repository {
+		return openTemp(t)
+	})
+}
@@ -0,0 +1,809 @@
+package storage
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+// Eviction tells what bounded storage does with cold links when it is over its limits
+type Eviction string
+
+const (
+	// EvictSpill keeps evicted links in the append log and reads them back on demand
+	EvictSpill Eviction = "spill"
+	// EvictDrop forgets evicted links, so storage without a log is a cache of recent links
+	EvictDrop Eviction = "drop"
+)
+
+// Memory estimates, Go does not tell sizes of maps, so these are rough numbers
+// of a link struct with its map slots and LRU element, of its index entry and of a previous original
+const (
+	linkOverhead    = 200
+	indexOverhead   = 120
+	versionOverhead = 40
+)
+
+// MemoryUsage is what bounded storage holds in memory, byte counts are estimates
+type MemoryUsage struct {
+	// Links are all known links, Resident ones are held in memory
+	Links         int   `json:"links"`
+	Resident      int   `json:"resident"`
+	ResidentBytes int64 `json:"resident_bytes"`
+	// IndexBytes is taken by ids, owners and log offsets of every link, evicted ones too,
+	// and by previous originals of changed links
+	IndexBytes int64 `json:"index_bytes"`
+	// Evictions are links evicted since start, Dropped ones of them are forgotten,
+	// Restores are evicted links read back from the log
+	Evictions int64 `json:"evictions"`
+	Dropped   int64 `json:"dropped"`
+	Restores  int64 `json:"restores"`
+}
+
+// boundedLink indexes a link whether it is in memory or not
+type boundedLink struct {
+	short     string
+	owner     string
+	createdAt time.Time
+	// origHash finds links of originals the owner has shortened without keeping originals in memory
+	origHash uint64
+	// offset and size locate the last record of the link in the log
+	offset int64
+	size   int
+	// url is nil while link is evicted, element is its place in LRU list otherwise
+	url     *domain.URL
+	element *list.Element
+}
+
+func (l *boundedLink) cursor() *domain.URL {
+	return &domain.URL{Short: l.short, CreatedAt: l.createdAt}
+}
+
+func (l *boundedLink) indexBytes() int64 {
+	return int64(len(l.short)+len(l.owner)) + indexOverhead
+}
+
+func linkBytes(url *domain.URL) int64 {
+	return int64(len(url.Short)+len(url.Orig)+len(url.Owner)+len(url.PasswordHash)+len(url.Placeholder)+len(url.Fallback)) + linkOverhead
+}
+
+// BoundedStorage holds at most a configured number or bytes of links in memory,
+// the least recently used ones are evicted past the limits. Links are written to
+// the append log in the format of PersistentStorage, so with a log evicted links are
+// read back from it when asked for. Index of every link stays in memory, it takes
+// about IndexBytes of MemoryUsage. A read-write lock guards storage, resident links are
+// found and the log is read under its read side, so redirects do not wait for each other
+type BoundedStorage struct {
+	maxLinks int
+	maxBytes int64
+	eviction Eviction
+
+	mutex sync.RWMutex
+	// recency guards LRU order for readers, writers change it under exclusive mutex
+	recency sync.Mutex
+	// log is nil when evicted links are dropped, spillPath is a log removed on close
+	log       *os.File
+	logSize   int64
+	spillPath string
+	keyring   *Keyring
+
+	links map[string]*boundedLink
+	// users lists links of every user ordered by creation time and short id
+	users     map[string][]*boundedLink
+	originals map[uint64][]*boundedLink
+	// history holds previous originals of changed links, it is small and never evicted
+	history map[string][]domain.Version
+	// recent holds resident links from the most to the least recently used
+	recent *list.List
+	usage  MemoryUsage
+}
+
+// BoundedOption configures bounded storage
+type BoundedOption func(*BoundedStorage)
+
+// WithMaxLinks bounds number of links held in memory, zero is no bound
+func WithMaxLinks(links int) BoundedOption {
+	return func(b *BoundedStorage) {
+		b.maxLinks = links
+	}
+}
+
+// WithMaxBytes bounds estimated bytes of links held in memory, zero is no bound
+func WithMaxBytes(bytes int64) BoundedOption {
+	return func(b *BoundedStorage) {
+		b.maxBytes = bytes
+	}
+}
+
+// WithEviction sets what is done with evicted links when there is no log path,
+// with a path they are always read back from the log
+func WithEviction(eviction Eviction) BoundedOption {
+	return func(b *BoundedStorage) {
+		b.eviction = eviction
+	}
+}
+
+// WithLogKeyring seals records written to the log and opens sealed ones read from it
+func WithLogKeyring(keyring *Keyring) BoundedOption {
+	return func(b *BoundedStorage) {
+		b.keyring = keyring
+	}
+}
+
+// NewBoundedStorage opens append log at path and indexes links from it. Without path
+// evicted links spill to a temporary log removed on close or are dropped, as eviction says
+func NewBoundedStorage(path string, opts ...BoundedOption) (*BoundedStorage, error) {
+	b := &BoundedStorage{
+		eviction:  EvictSpill,
+		links:     make(map[string]*boundedLink),
+		users:     make(map[string][]*boundedLink),
+		originals: make(map[uint64][]*boundedLink),
+		history:   make(map[string][]domain.Version),
+		recent:    list.New(),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	var err error
+	switch {
+	case path != "":
+		b.log, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err = b.replay(); err != nil {
+			_ = b.log.Close()
+			return nil, err
+		}
+	case b.eviction == EvictSpill:
+		b.log, err = os.CreateTemp("", "shortener-spill-*.log")
+		if err != nil {
+			return nil, err
+		}
+		b.spillPath = b.log.Name()
+	case b.eviction == EvictDrop:
+	default:
+		return nil, fmt.Errorf("unknown eviction %q, use spill or drop", b.eviction)
+	}
+	return b, nil
+}
+
+// replay indexes records of the log keeping their offsets, the latest links stay in memory
+func (b *BoundedStorage) replay() error {
+	reader := bufio.NewReader(b.log)
+	for {
+		line, err := reader.ReadBytes(LineBreak)
+		if len(line) > 0 {
+			size := len(line)
+			if line[size-1] == LineBreak {
+				size--
+			}
+			rec, decodeErr := b.keyring.decode(line[:size])
+			if decodeErr != nil {
+				return fmt.Errorf("error while unmarshal from file %w ", decodeErr)
+			}
+			switch rec.Op {
+			case opPut:
+				b.put(&rec.URL, b.logSize, size)
+			case opDelete:
+				if link, ok := b.links[rec.Short]; ok {
+					b.unindex(link)
+					b.forgetHistory(link.short)
+				}
+			case opUpdate:
+				if rec.At == nil {
+					return fmt.Errorf("update of %v has no time", rec.Short)
+				}
+				if err := b.update(&rec.URL, *rec.At, b.logSize, size); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unknown operation %q", rec.Op)
+			}
+			b.logSize += int64(len(line))
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading file %v ", err)
+		}
+	}
+}
+
+// appendRecords writes records with a single write and returns their offsets and sizes
+func (b *BoundedStorage) appendRecords(records ...record) ([]int64, []int, error) {
+	offsets := make([]int64, len(records))
+	sizes := make([]int, len(records))
+	if b.log == nil {
+		return offsets, sizes, nil
+	}
+
+	var bytes []byte
+	for i, rec := range records {
+		line, err := b.keyring.encode(rec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while marshaling data  %v ", err)
+		}
+		offsets[i] = b.logSize + int64(len(bytes))
+		sizes[i] = len(line)
+		bytes = append(bytes, line...)
+		bytes = append(bytes, LineBreak)
+	}
+	if _, err := b.log.Write(bytes); err != nil {
+		// a partial write moves the end of the log anyway
+		if info, statErr := b.log.Stat(); statErr == nil {
+			b.logSize = info.Size()
+		}
+		return nil, nil, fmt.Errorf("error while writing to file %v ", err)
+	}
+	b.logSize += int64(len(bytes))
+	return offsets, sizes, nil
+}
+
+// put indexes link written at offset and keeps it in memory, it does not check originals
+func (b *BoundedStorage) put(url *domain.URL, offset int64, size int) {
+	if prev, ok := b.links[url.Short]; ok {
+		b.unindex(prev)
+	}
+	link := &boundedLink{
+		short:     url.Short,
+		owner:     url.Owner,
+		createdAt: url.CreatedAt,
+		origHash:  hashOriginal(url.Owner, url.Orig),
+		offset:    offset,
+		size:      size,
+	}
+	b.links[link.short] = link
+	b.originals[link.origHash] = append(b.originals[link.origHash], link)
+	if link.owner != "" {
+		b.insertUserLink(link)
+	}
+	b.usage.IndexBytes += link.indexBytes()
+
+	stored := *url
+	b.admit(link, &stored)
+}
+
+// update indexes link written at offset with a changed original, the previous one goes to history
+func (b *BoundedStorage) update(url *domain.URL, at time.Time, offset int64, size int) error {
+	if prev, ok := b.links[url.Short]; ok {
+		stored, err := b.load(prev)
+		if err != nil {
+			return err
+		}
+		if stored.Orig != url.Orig {
+			version := domain.Version{Orig: stored.Orig, ReplacedAt: at}
+			b.history[url.Short] = append(b.history[url.Short], version)
+			b.usage.IndexBytes += int64(len(version.Orig)) + versionOverhead
+		}
+	}
+	b.put(url, offset, size)
+	return nil
+}
+
+// forgetHistory drops previous originals of a deleted link
+func (b *BoundedStorage) forgetHistory(short string) {
+	for _, version := range b.history[short] {
+		b.usage.IndexBytes -= int64(len(version.Orig)) + versionOverhead
+	}
+	delete(b.history, short)
+}
+
+// unindex forgets link
+func (b *BoundedStorage) unindex(link *boundedLink) {
+	delete(b.links, link.short)
+	b.originals[link.origHash] = removeLink(b.originals[link.origHash], link)
+	if len(b.originals[link.origHash]) == 0 {
+		delete(b.originals, link.origHash)
+	}
+	if link.owner != "" {
+		b.removeUserLink(link)
+	}
+	b.usage.IndexBytes -= link.indexBytes()
+	b.release(link)
+}
+
+func removeLink(links []*boundedLink, link *boundedLink) []*boundedLink {
+	for i := range links {
+		if links[i] == link {
+			return append(links[:i], links[i+1:]...)
+		}
+	}
+	return links
+}
+
+// insertUserLink puts link into its place in user index, links mostly come in creation order
+func (b *BoundedStorage) insertUserLink(link *boundedLink) {
+	links := b.users[link.owner]
+	cursor := usecase.Cursor{CreatedAt: link.createdAt, Short: link.short}
+	pos := sort.Search(len(links), func(i int) bool {
+		return cursor.After(links[i].cursor())
+	})
+	links = append(links, nil)
+	copy(links[pos+1:], links[pos:])
+	links[pos] = link
+	b.users[link.owner] = links
+}
+
+func (b *BoundedStorage) removeUserLink(link *boundedLink) {
+	links := removeLink(b.users[link.owner], link)
+	if len(links) == 0 {
+		delete(b.users, link.owner)
+		return
+	}
+	b.users[link.owner] = links
+}
+
+// admit keeps link in memory as the most recently used one and evicts cold links past limits
+func (b *BoundedStorage) admit(link *boundedLink, url *domain.URL) {
+	link.url = url
+	link.element = b.recent.PushFront(link)
+	b.usage.Resident++
+	b.usage.ResidentBytes += linkBytes(url)
+
+	for b.overLimits() {
+		cold := b.recent.Back().Value.(*boundedLink)
+		b.usage.Evictions++
+		if b.log == nil {
+			b.usage.Dropped++
+			b.unindex(cold)
+			b.forgetHistory(cold.short)
+			continue
+		}
+		b.release(cold)
+	}
+}
+
+// overLimits keeps the most recent link in memory even if it alone is over limits
+func (b *BoundedStorage) overLimits() bool {
+	if b.recent.Len() <= 1 {
+		return false
+	}
+	return (b.maxLinks > 0 && b.usage.Resident > b.maxLinks) ||
+		(b.maxBytes > 0 && b.usage.ResidentBytes > b.maxBytes)
+}
+
+// release lets link go from memory, it stays in the index
+func (b *BoundedStorage) release(link *boundedLink) {
+	if link.url == nil {
+		return
+	}
+	b.recent.Remove(link.element)
+	b.usage.Resident--
+	b.usage.ResidentBytes -= linkBytes(link.url)
+	link.url, link.element = nil, nil
+}
+
+// load returns link from memory or reads it from the log, a read link is not kept in memory
+func (b *BoundedStorage) load(link *boundedLink) (*domain.URL, error) {
+	if link.url != nil {
+		return link.url, nil
+	}
+	line := make([]byte, link.size)
+	if _, err := b.log.ReadAt(line, link.offset); err != nil {
+		return nil, fmt.Errorf("error while reading link %v from file %v ", link.short, err)
+	}
+	rec, err := b.keyring.decode(line)
+	if err != nil {
+		return nil, fmt.Errorf("error while unmarshal link %v from file %v ", link.short, err)
+	}
+	return &rec.URL, nil
+}
+
+// touch makes a resident link the most recently used one, it is called under read lock
+func (b *BoundedStorage) touch(link *boundedLink) {
+	b.recency.Lock()
+	b.recent.MoveToFront(link.element)
+	b.recency.Unlock()
+}
+
+// restore returns link making it the most recently used one, an evicted link is read back
+func (b *BoundedStorage) restore(link *boundedLink) (*domain.URL, error) {
+	if link.url != nil {
+		b.recent.MoveToFront(link.element)
+		return link.url, nil
+	}
+	url, err := b.load(link)
+	if err != nil {
+		return nil, err
+	}
+	b.usage.Restores++
+	b.admit(link, url)
+	return url, nil
+}
+
+// shortenedBefore finds the link the owner has already shortened the original with under another id,
+// links of the same hash are read to compare originals
+func (b *BoundedStorage) shortenedBefore(url *domain.URL) (string, bool, error) {
+	for _, link := range b.originals[hashOriginal(url.Owner, url.Orig)] {
+		if link.owner != url.Owner {
+			continue
+		}
+		stored, err := b.load(link)
+		if err != nil {
+			return "", false, err
+		}
+		if stored.Orig == url.Orig {
+			return link.short, link.short != url.Short, nil
+		}
+	}
+	return "", false, nil
+}
+
+// hashOriginal is FNV-1a of owner and original
+func hashOriginal(owner, orig string) uint64 {
+	h := uint64(14695981039346656037)
+	for _, part := range []string{owner, "\x00", orig} {
+		for i := 0; i < len(part); i++ {
+			h ^= uint64(part[i])
+			h *= 1099511628211
+		}
+	}
+	return h
+}
+
+// Store reports a link of original the owner has already shortened with ErrAlreadyExists
+func (b *BoundedStorage) Store(ctx context.Context, url *domain.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.store(url)
+}
+
+func (b *BoundedStorage) store(url *domain.URL) error {
+	existing, found, err := b.shortenedBefore(url)
+	if err != nil {
+		return err
+	}
+	if found {
+		return alreadyExists(uniqID(existing), url.Orig)
+	}
+	offsets, sizes, err := b.appendRecords(record{URL: *url})
+	if err != nil {
+		return err
+	}
+	b.put(url, offsets[0], sizes[0])
+	return nil
+}
+
+// BatchWrite writes links with a single write, links whose owners have already
+// shortened the same originals are skipped and reported with ErrBatchConflicts
+func (b *BoundedStorage) BatchWrite(ctx context.Context, urls []domain.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	conflicts := make(map[int]usecase.ErrAlreadyExists)
+	// originals taken by earlier links of the batch
+	batch := make(map[original]string)
+	records := make([]record, 0, len(urls))
+	for i := range urls {
+		url := &urls[i]
+		existing, found, err := b.shortenedBefore(url)
+		if err != nil {
+			return err
+		}
+		if short, taken := batch[original{url.Owner, url.Orig}]; taken && !found {
+			existing, found = short, short != url.Short
+		}
+		if found {
+			conflicts[i] = alreadyExists(uniqID(existing), url.Orig)
+			continue
+		}
+		batch[original{url.Owner, url.Orig}] = url.Short
+		records = append(records, record{URL: *url})
+	}
+
+	offsets, sizes, err := b.appendRecords(records...)
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		b.put(&records[i].URL, offsets[i], sizes[i])
+	}
+	if len(conflicts) > 0 {
+		return usecase.ErrBatchConflicts{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// FindByKey takes exclusive lock only to read an evicted link back
+func (b *BoundedStorage) FindByKey(_ context.Context, key string) (*domain.URL, error) {
+	b.mutex.RLock()
+	link, ok := b.links[key]
+	if ok && link.url != nil {
+		b.touch(link)
+		found := *link.url
+		b.mutex.RUnlock()
+		return &found, nil
+	}
+	b.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// the link may have been changed or deleted meanwhile
+	link, ok = b.links[key]
+	if !ok {
+		return nil, fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	url, err := b.restore(link)
+	if err != nil {
+		return nil, err
+	}
+	found := *url
+	return &found, nil
+}
+
+// FindAll skips links it can't read back from the log, there is no way to report them
+func (b *BoundedStorage) FindAll(ctx context.Context, userKey string) []*domain.URL {
+	result := make([]*domain.URL, 0)
+	err := b.ForEach(ctx, userKey, func(url *domain.URL) error {
+		result = append(result, url)
+		return nil
+	})
+	if err != nil {
+		log.Printf("links of %v are not all found: %v", userKey, err)
+	}
+	return result
+}
+
+// FindPage reads evicted links of the page from the log without keeping them in memory
+func (b *BoundedStorage) FindPage(_ context.Context, userKey string, query usecase.PageQuery) (usecase.Page, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	links := b.users[userKey]
+
+	// start right after the cursor, index is ordered so it is a binary search
+	start, step := 0, 1
+	if query.Desc {
+		start, step = len(links)-1, -1
+	}
+	if query.After != nil {
+		after := sort.Search(len(links), func(i int) bool {
+			return query.After.After(links[i].cursor())
+		})
+		start = after
+		if query.Desc {
+			// last one before the cursor, cursor link itself is skipped
+			start = after - 1
+			if start >= 0 && links[start].short == query.After.Short {
+				start--
+			}
+		}
+	}
+
+	page := usecase.Page{URLs: make([]*domain.URL, 0)}
+	for i := start; i >= 0 && i < len(links); i += step {
+		url, err := b.load(links[i])
+		if err != nil {
+			return usecase.Page{}, err
+		}
+		if !query.Match(url) {
+			continue
+		}
+		if len(page.URLs) == query.Limit {
+			last := page.URLs[len(page.URLs)-1]
+			page.Next = &usecase.Cursor{CreatedAt: last.CreatedAt, Short: last.Short}
+			break
+		}
+		found := *url
+		page.URLs = append(page.URLs, &found)
+	}
+	return page, nil
+}
+
+// ForEach does not hold the lock while fn is called, links stored after the call started are not visited
+func (b *BoundedStorage) ForEach(ctx context.Context, userKey string, fn func(*domain.URL) error) error {
+	b.mutex.RLock()
+	links := make([]*boundedLink, len(b.users[userKey]))
+	copy(links, b.users[userKey])
+	b.mutex.RUnlock()
+
+	return b.visit(ctx, links, fn)
+}
+
+// visit reads links one by one, links deleted or replaced since they were listed are skipped
+func (b *BoundedStorage) visit(ctx context.Context, links []*boundedLink, fn func(*domain.URL) error) error {
+	for _, link := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b.mutex.RLock()
+		var url *domain.URL
+		var err error
+		if b.links[link.short] == link {
+			url, err = b.load(link)
+		}
+		b.mutex.RUnlock()
+		if err != nil {
+			return err
+		}
+		if url == nil {
+			continue
+		}
+		found := *url
+		if err = fn(&found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BoundedStorage) Delete(_ context.Context, key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	link, ok := b.links[key]
+	if !ok {
+		return fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	if _, _, err := b.appendRecords(record{URL: domain.URL{Short: key}, Op: opDelete}); err != nil {
+		return err
+	}
+	b.unindex(link)
+	b.forgetHistory(key)
+	return nil
+}
+
+// Update logs the link as it is after the update, so the record restores the whole link
+func (b *BoundedStorage) Update(ctx context.Context, key string, orig string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	link, ok := b.links[key]
+	if !ok {
+		return fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	url, err := b.load(link)
+	if err != nil {
+		return err
+	}
+	if url.Orig == orig {
+		return nil
+	}
+	updated := *url
+	updated.Orig = orig
+	existing, found, err := b.shortenedBefore(&updated)
+	if err != nil {
+		return err
+	}
+	if found {
+		return alreadyExists(uniqID(existing), orig)
+	}
+	offsets, sizes, err := b.appendRecords(record{URL: updated, Op: opUpdate, At: &at})
+	if err != nil {
+		return err
+	}
+	return b.update(&updated, at, offsets[0], sizes[0])
+}
+
+// Click logs the link with clicks left, so the record restores the whole link
+func (b *BoundedStorage) Click(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	link, ok := b.links[key]
+	if !ok {
+		return fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	url, err := b.restore(link)
+	if err != nil {
+		return err
+	}
+	if url.MaxClicks == 0 {
+		return nil
+	}
+	if url.ClicksLeft <= 0 {
+		return fmt.Errorf("link %v: %w", key, usecase.ErrExhausted)
+	}
+	clicked := *url
+	clicked.ClicksLeft--
+	offsets, sizes, err := b.appendRecords(record{URL: clicked})
+	if err != nil {
+		return err
+	}
+	b.put(&clicked, offsets[0], sizes[0])
+	return nil
+}
+
+func (b *BoundedStorage) History(ctx context.Context, key string) ([]domain.Version, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if _, ok := b.links[key]; !ok {
+		return nil, fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	history := make([]domain.Version, len(b.history[key]))
+	copy(history, b.history[key])
+	return history, nil
+}
+
+func (b *BoundedStorage) Reassign(_ context.Context, key string, owner string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	link, ok := b.links[key]
+	if !ok {
+		return fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	url, err := b.load(link)
+	if err != nil {
+		return err
+	}
+	reassigned := *url
+	reassigned.Owner = owner
+	return b.store(&reassigned)
+}
+
+// CountUsers counts users who own links, like memory storage it does not know about others
+func (b *BoundedStorage) CountUsers(_ context.Context) (int, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return len(b.users), nil
+}
+
+// Dump visits every link, like ForEach lock is not held while fn is called
+func (b *BoundedStorage) Dump(ctx context.Context, fn func(*domain.URL) error) error {
+	b.mutex.RLock()
+	links := make([]*boundedLink, 0, len(b.links))
+	for _, link := range b.links {
+		links = append(links, link)
+	}
+	b.mutex.RUnlock()
+
+	return b.visit(ctx, links, fn)
+}
+
+// Usage reports memory taken by storage
+func (b *BoundedStorage) Usage() MemoryUsage {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	usage := b.usage
+	usage.Links = len(b.links)
+	return usage
+}
+
+// Close closes the log, a temporary one is removed
+func (b *BoundedStorage) Close() error {
+	if b.log == nil {
+		return nil
+	}
+	err := b.log.Close()
+	if b.spillPath != "" {
+		if removeErr := os.Remove(b.spillPath); err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/storagetest"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openBounded(t *testing.T, path string, opts ...BoundedOption) *BoundedStorage {
+	t.Helper()
+	bounded, err := NewBoundedStorage(path, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = bounded.Close() })
+	return bounded
+}
+
+func TestBoundedStorage(t *testing.T) {
+	// limits are tiny so the suite reads most links back from the log
+	t.Run("log", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) usecase.Repository {
+			return openBounded(t, filepath.Join(t.TempDir(), "links.log"), WithMaxLinks(3))
+		})
+	})
+	t.Run("spill", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) usecase.Repository {
+			return openBounded(t, "", WithMaxBytes(1024))
+		})
+	})
+}
+
+func storeLinks(t *testing.T, repo usecase.Repository, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		url := &domain.URL{Short: fmt.Sprintf("s%v", i), Orig: fmt.Sprintf("http://%v.com/", i), Owner: "u1"}
+		require.NoError(t, repo.Store(context.Background(), url))
+	}
+}
+
+func TestBoundedStorage_SpillRestores(t *testing.T) {
+	ctx := context.Background()
+	bounded := openBounded(t, "", WithMaxLinks(2))
+	storeLinks(t, bounded, 5)
+
+	usage := bounded.Usage()
+	assert.Equal(t, 5, usage.Links)
+	assert.Equal(t, 2, usage.Resident)
+	assert.Equal(t, int64(3), usage.Evictions)
+
+	// the coldest link is read back and becomes resident
+	found, err := bounded.FindByKey(ctx, "s0")
+	require.NoError(t, err)
+	assert.Equal(t, "http://0.com/", found.Orig)
+	usage = bounded.Usage()
+	assert.Equal(t, int64(1), usage.Restores)
+	assert.Equal(t, 2, usage.Resident)
+
+	// evicted originals are still checked
+	err = bounded.Store(ctx, &domain.URL{Short: "x", Orig: "http://1.com/", Owner: "u1"})
+	assert.IsType(t, usecase.ErrAlreadyExists{}, err)
+
+	// listing does not make links resident
+	assert.Len(t, bounded.FindAll(ctx, "u1"), 5)
+	assert.Equal(t, int64(1), bounded.Usage().Restores)
+}
+
+func TestBoundedStorage_ConcurrentReads(t *testing.T) {
+	ctx := context.Background()
+	bounded := openBounded(t, "", WithMaxLinks(2))
+	storeLinks(t, bounded, 2)
+
+	// resident links read under read lock still become the most recently used ones
+	_, err := bounded.FindByKey(ctx, "s0")
+	require.NoError(t, err)
+	require.NoError(t, bounded.Store(ctx, &domain.URL{Short: "s2", Orig: "http://2.com/", Owner: "u1"}))
+	_, err = bounded.FindByKey(ctx, "s0")
+	require.NoError(t, err)
+	assert.Zero(t, bounded.Usage().Restores, "s1 is evicted, not s0")
+
+	// readers of resident and evicted links go along with writers
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := bounded.FindByKey(ctx, fmt.Sprintf("s%v", (i+j)%3))
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	for i := 3; i < 20; i++ {
+		require.NoError(t, bounded.Store(ctx, &domain.URL{Short: fmt.Sprintf("s%v", i), Orig: fmt.Sprintf("http://%v.com/", i), Owner: "u1"}))
+	}
+	wg.Wait()
+	assert.Equal(t, 2, bounded.Usage().Resident)
+}
+
+func TestBoundedStorage_Drop(t *testing.T) {
+	ctx := context.Background()
+	bounded := openBounded(t, "", WithMaxLinks(2), WithEviction(EvictDrop))
+	storeLinks(t, bounded, 5)
+
+	_, err := bounded.FindByKey(ctx, "s0")
+	assert.ErrorIs(t, err, usecase.ErrNotFound)
+	_, err = bounded.FindByKey(ctx, "s4")
+	assert.NoError(t, err)
+
+	usage := bounded.Usage()
+	assert.Equal(t, 2, usage.Links)
+	assert.Equal(t, int64(3), usage.Dropped)
+	// original of a dropped link is free
+	assert.NoError(t, bounded.Store(ctx, &domain.URL{Short: "x", Orig: "http://0.com/", Owner: "u1"}))
+}
+
+func TestBoundedStorage_MaxBytes(t *testing.T) {
+	bounded := openBounded(t, "", WithMaxBytes(3*linkOverhead))
+	storeLinks(t, bounded, 10)
+
+	usage := bounded.Usage()
+	assert.LessOrEqual(t, usage.ResidentBytes, int64(3*linkOverhead))
+	assert.Equal(t, 10, usage.Links)
+	assert.Positive(t, usage.IndexBytes)
+}
+
+func TestBoundedStorage_SharesLogWithPersistentStorage(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+
+	file, err := NewPersistentStorage(path)
+	require.NoError(t, err)
+	storeLinks(t, file, 5)
+	require.NoError(t, file.Delete(ctx, "s1"))
+	require.NoError(t, file.Close())
+
+	bounded, err := NewBoundedStorage(path, WithMaxLinks(2))
+	require.NoError(t, err)
+	usage := bounded.Usage()
+	assert.Equal(t, 4, usage.Links)
+	assert.Equal(t, 2, usage.Resident)
+
+	found, err := bounded.FindByKey(ctx, "s0")
+	require.NoError(t, err)
+	assert.Equal(t, "http://0.com/", found.Orig)
+	require.NoError(t, bounded.Reassign(ctx, "s2", "u2"))
+	require.NoError(t, bounded.Close())
+
+	// and back, what bounded storage wrote is read by persistent one
+	file, err = NewPersistentStorage(path)
+	require.NoError(t, err)
+	defer file.Close()
+	assert.Len(t, file.FindAll(ctx, "u1"), 3)
+	assert.Len(t, file.FindAll(ctx, "u2"), 1)
+}
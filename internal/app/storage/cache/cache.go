@@ -0,0 +1,371 @@
+// Package cache keeps recently read links in front of a slower repository
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"golang.org/x/sync/singleflight"
+)
+
+// Defaults used if options do not say otherwise
+const (
+	DefaultSize        = 10000
+	DefaultTTL         = time.Minute
+	DefaultNegativeTTL = 5 * time.Second
+)
+
+var errNotAdmin = errors.New("cached repository can't be maintained")
+
+// Stats are counters of cache usage since it is created
+type Stats struct {
+	// Hits are lookups answered by cache, NegativeHits are ones answered with a cached miss
+	Hits         int64 `json:"hits"`
+	NegativeHits int64 `json:"negative_hits"`
+	// Misses are lookups which went to repository, Shared ones waited for a lookup of another caller
+	Misses int64 `json:"misses"`
+	Shared int64 `json:"shared"`
+	// Evictions are entries dropped to keep cache size bounded
+	Evictions int64 `json:"evictions"`
+	Size      int   `json:"size"`
+}
+
+// entry is a cached link, url is nil for a link known to be missing
+type entry struct {
+	key     string
+	url     *domain.URL
+	expires time.Time
+}
+
+// Repository is a read-through LRU cache of FindByKey, entries live for TTL at most.
+// Writes go through and invalidate cached keys, other reads are not cached
+type Repository struct {
+	repo        usecase.Repository
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	// recent holds entries from the most to the least recently used
+	recent *list.List
+	// flights are keys being looked up in repository, invalidation of a key bumps its version,
+	// so its lookup started before is not cached. Other keys are cached as usual
+	flights map[string]*flight
+
+	group singleflight.Group
+	stats Stats
+}
+
+// flight counts lookups of a key in progress
+type flight struct {
+	loads   int
+	version uint64
+}
+
+// Option configures cache
+type Option func(*Repository)
+
+// WithSize bounds number of cached links
+func WithSize(size int) Option {
+	return func(r *Repository) {
+		if size > 0 {
+			r.size = size
+		}
+	}
+}
+
+// WithTTL sets how long a found link is cached
+func WithTTL(ttl time.Duration) Option {
+	return func(r *Repository) {
+		if ttl > 0 {
+			r.ttl = ttl
+		}
+	}
+}
+
+// WithNegativeTTL sets how long a missing link is cached, negative value disables negative caching
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(r *Repository) {
+		if ttl != 0 {
+			r.negativeTTL = ttl
+		}
+	}
+}
+
+func New(repo usecase.Repository, opts ...Option) *Repository {
+	r := &Repository{
+		repo:        repo,
+		size:        DefaultSize,
+		ttl:         DefaultTTL,
+		negativeTTL: DefaultNegativeTTL,
+		now:         time.Now,
+		entries:     make(map[string]*list.Element),
+		recent:      list.New(),
+		flights:     make(map[string]*flight),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Stats returns current counters
+func (r *Repository) Stats() Stats {
+	r.mutex.Lock()
+	size := r.recent.Len()
+	r.mutex.Unlock()
+
+	return Stats{
+		Hits:         atomic.LoadInt64(&r.stats.Hits),
+		NegativeHits: atomic.LoadInt64(&r.stats.NegativeHits),
+		Misses:       atomic.LoadInt64(&r.stats.Misses),
+		Shared:       atomic.LoadInt64(&r.stats.Shared),
+		Evictions:    atomic.LoadInt64(&r.stats.Evictions),
+		Size:         size,
+	}
+}
+
+// FindByKey answers from cache if it can, concurrent misses of a key make a single repository call
+func (r *Repository) FindByKey(ctx context.Context, key string) (*domain.URL, error) {
+	if url, found, ok := r.get(key); ok {
+		if !found {
+			atomic.AddInt64(&r.stats.NegativeHits, 1)
+			return nil, fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+		}
+		atomic.AddInt64(&r.stats.Hits, 1)
+		return url, nil
+	}
+	atomic.AddInt64(&r.stats.Misses, 1)
+
+	result := r.group.DoChan(key, func() (interface{}, error) {
+		return r.load(ctx, key)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-result:
+		if res.Shared {
+			atomic.AddInt64(&r.stats.Shared, 1)
+		}
+		// lookup of another caller may be cancelled by its context, this caller still can look up
+		if res.Err != nil && isContextErr(res.Err) && ctx.Err() == nil {
+			return r.load(ctx, key)
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		url := *res.Val.(*domain.URL)
+		return &url, nil
+	}
+}
+
+// load reads a key from repository and caches the answer unless the key was invalidated meanwhile
+func (r *Repository) load(ctx context.Context, key string) (*domain.URL, error) {
+	version := r.startLoad(key)
+
+	url, err := r.repo.FindByKey(ctx, key)
+	switch {
+	case err == nil:
+		r.finishLoad(key, version, url, r.ttl)
+	case errors.Is(err, usecase.ErrNotFound) && r.negativeTTL > 0:
+		r.finishLoad(key, version, nil, r.negativeTTL)
+	default:
+		r.finishLoad(key, version, nil, 0)
+	}
+	return url, err
+}
+
+// startLoad registers a lookup of key and returns version of the key it starts at
+func (r *Repository) startLoad(key string) uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	f, ok := r.flights[key]
+	if !ok {
+		f = &flight{}
+		r.flights[key] = f
+	}
+	f.loads++
+	return f.version
+}
+
+// finishLoad finishes a lookup of key and caches its answer for ttl if the key is still of the version,
+// zero ttl caches nothing
+func (r *Repository) finishLoad(key string, version uint64, url *domain.URL, ttl time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	f := r.flights[key]
+	f.loads--
+	if f.loads == 0 {
+		delete(r.flights, key)
+	}
+	if f.version != version || ttl == 0 {
+		return
+	}
+	r.put(key, url, ttl)
+}
+
+// get returns cached entry, ok is false if there is no live entry and found is false for a cached miss
+func (r *Repository) get(key string) (url *domain.URL, found bool, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	element, ok := r.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	cached := element.Value.(*entry)
+	if !r.now().Before(cached.expires) {
+		r.remove(element)
+		return nil, false, false
+	}
+	r.recent.MoveToFront(element)
+	if cached.url == nil {
+		return nil, false, true
+	}
+	copied := *cached.url
+	return &copied, true, true
+}
+
+// put caches url under lock
+func (r *Repository) put(key string, url *domain.URL, ttl time.Duration) {
+	if element, ok := r.entries[key]; ok {
+		r.remove(element)
+	}
+
+	var copied *domain.URL
+	if url != nil {
+		u := *url
+		copied = &u
+	}
+	r.entries[key] = r.recent.PushFront(&entry{key: key, url: copied, expires: r.now().Add(ttl)})
+
+	for r.recent.Len() > r.size {
+		r.remove(r.recent.Back())
+		atomic.AddInt64(&r.stats.Evictions, 1)
+	}
+}
+
+func (r *Repository) remove(element *list.Element) {
+	r.recent.Remove(element)
+	delete(r.entries, element.Value.(*entry).key)
+}
+
+// invalidate drops keys, lookups running now are not cached and following ones go to repository
+func (r *Repository) invalidate(keys ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, key := range keys {
+		if element, ok := r.entries[key]; ok {
+			r.remove(element)
+		}
+		if f, ok := r.flights[key]; ok {
+			f.version++
+		}
+		r.group.Forget(key)
+	}
+}
+
+// Invalidate drops keys changed behind cache, like links a replica applies from its leader
+func (r *Repository) Invalidate(keys ...string) {
+	r.invalidate(keys...)
+}
+
+func (r *Repository) Store(ctx context.Context, url *domain.URL) error {
+	defer r.invalidate(url.Short)
+	return r.repo.Store(ctx, url)
+}
+
+func (r *Repository) BatchWrite(ctx context.Context, urls []domain.URL) error {
+	keys := make([]string, 0, len(urls))
+	for _, url := range urls {
+		keys = append(keys, url.Short)
+	}
+	defer r.invalidate(keys...)
+	return r.repo.BatchWrite(ctx, urls)
+}
+
+func (r *Repository) Update(ctx context.Context, key string, orig string, at time.Time) error {
+	defer r.invalidate(key)
+	return r.repo.Update(ctx, key, orig, at)
+}
+
+func (r *Repository) Click(ctx context.Context, key string) error {
+	defer r.invalidate(key)
+	return r.repo.Click(ctx, key)
+}
+
+// History is not cached, it is asked for after updates only
+func (r *Repository) History(ctx context.Context, key string) ([]domain.Version, error) {
+	return r.repo.History(ctx, key)
+}
+
+func (r *Repository) FindAll(ctx context.Context, key string) []*domain.URL {
+	return r.repo.FindAll(ctx, key)
+}
+
+func (r *Repository) FindPage(ctx context.Context, key string, query usecase.PageQuery) (usecase.Page, error) {
+	return r.repo.FindPage(ctx, key, query)
+}
+
+func (r *Repository) ForEach(ctx context.Context, key string, fn func(*domain.URL) error) error {
+	return r.repo.ForEach(ctx, key, fn)
+}
+
+// admin returns repository as AdminRepository if it is one
+func (r *Repository) admin() (usecase.AdminRepository, error) {
+	admin, ok := r.repo.(usecase.AdminRepository)
+	if !ok {
+		return nil, errNotAdmin
+	}
+	return admin, nil
+}
+
+func (r *Repository) Delete(ctx context.Context, key string) error {
+	admin, err := r.admin()
+	if err != nil {
+		return err
+	}
+	defer r.invalidate(key)
+	return admin.Delete(ctx, key)
+}
+
+func (r *Repository) Reassign(ctx context.Context, key string, owner string) error {
+	admin, err := r.admin()
+	if err != nil {
+		return err
+	}
+	defer r.invalidate(key)
+	return admin.Reassign(ctx, key, owner)
+}
+
+func (r *Repository) CountUsers(ctx context.Context) (int, error) {
+	admin, err := r.admin()
+	if err != nil {
+		return 0, err
+	}
+	return admin.CountUsers(ctx)
+}
+
+func (r *Repository) Dump(ctx context.Context, fn func(*domain.URL) error) error {
+	admin, err := r.admin()
+	if err != nil {
+		return err
+	}
+	return admin.Dump(ctx, fn)
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
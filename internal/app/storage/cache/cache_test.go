@@ -0,0 +1,189 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/storagetest"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingRepository counts lookups, release blocks them until closed if set
+type countingRepository struct {
+	usecase.Repository
+	mutex   sync.Mutex
+	links   map[string]domain.URL
+	calls   int64
+	release chan struct{}
+}
+
+func newCountingRepository(links ...domain.URL) *countingRepository {
+	r := &countingRepository{links: make(map[string]domain.URL)}
+	for _, link := range links {
+		r.links[link.Short] = link
+	}
+	return r
+}
+
+func (r *countingRepository) FindByKey(_ context.Context, key string) (*domain.URL, error) {
+	atomic.AddInt64(&r.calls, 1)
+	if r.release != nil {
+		<-r.release
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	url, ok := r.links[key]
+	if !ok {
+		return nil, fmt.Errorf("key %v: %w", key, usecase.ErrNotFound)
+	}
+	return &url, nil
+}
+
+func (r *countingRepository) Store(_ context.Context, url *domain.URL) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.links[url.Short] = *url
+	return nil
+}
+
+func TestRepository_ReadThrough(t *testing.T) {
+	ctx := context.Background()
+	repo := newCountingRepository(domain.URL{Short: "a", Orig: "http://a.com/"})
+	cache := New(repo)
+
+	for i := 0; i < 3; i++ {
+		url, err := cache.FindByKey(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, "http://a.com/", url.Orig)
+	}
+	assert.EqualValues(t, 1, repo.calls)
+
+	// a miss is cached as well
+	for i := 0; i < 3; i++ {
+		_, err := cache.FindByKey(ctx, "b")
+		assert.True(t, errors.Is(err, usecase.ErrNotFound))
+	}
+	assert.EqualValues(t, 2, repo.calls)
+
+	stats := cache.Stats()
+	assert.Equal(t, Stats{Hits: 2, NegativeHits: 2, Misses: 2, Size: 2}, stats)
+}
+
+func TestRepository_Invalidation(t *testing.T) {
+	ctx := context.Background()
+	repo := newCountingRepository()
+	cache := New(repo)
+
+	_, err := cache.FindByKey(ctx, "a")
+	require.True(t, errors.Is(err, usecase.ErrNotFound))
+
+	require.NoError(t, cache.Store(ctx, &domain.URL{Short: "a", Orig: "http://a.com/"}))
+	url, err := cache.FindByKey(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "http://a.com/", url.Orig)
+
+	require.NoError(t, cache.Store(ctx, &domain.URL{Short: "a", Orig: "http://b.com/"}))
+	url, err = cache.FindByKey(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "http://b.com/", url.Orig)
+}
+
+func TestRepository_TTLAndEviction(t *testing.T) {
+	ctx := context.Background()
+	repo := newCountingRepository(
+		domain.URL{Short: "a", Orig: "http://a.com/"},
+		domain.URL{Short: "b", Orig: "http://b.com/"},
+		domain.URL{Short: "c", Orig: "http://c.com/"},
+	)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := New(repo, WithSize(2), WithTTL(time.Minute))
+	cache.now = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		_, err := cache.FindByKey(ctx, key)
+		require.NoError(t, err)
+	}
+	// b is the least recently used one
+	assert.EqualValues(t, 3, repo.calls)
+	assert.EqualValues(t, 1, cache.Stats().Evictions)
+	_, _ = cache.FindByKey(ctx, "a")
+	assert.EqualValues(t, 3, repo.calls)
+	_, _ = cache.FindByKey(ctx, "b")
+	assert.EqualValues(t, 4, repo.calls)
+
+	now = now.Add(time.Minute)
+	_, _ = cache.FindByKey(ctx, "b")
+	assert.EqualValues(t, 5, repo.calls)
+}
+
+func TestRepository_CollapsesMisses(t *testing.T) {
+	ctx := context.Background()
+	repo := newCountingRepository(domain.URL{Short: "a", Orig: "http://a.com/"})
+	repo.release = make(chan struct{})
+	cache := New(repo)
+
+	const callers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			url, err := cache.FindByKey(ctx, "a")
+			assert.NoError(t, err)
+			assert.Equal(t, "http://a.com/", url.Orig)
+		}()
+	}
+	// let callers pile up on the first lookup
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&repo.calls) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(repo.release)
+	wg.Wait()
+
+	assert.EqualValues(t, 1, repo.calls)
+}
+
+func TestRepository_InvalidatesOnlyChangedKey(t *testing.T) {
+	ctx := context.Background()
+	repo := newCountingRepository(domain.URL{Short: "a", Orig: "http://a.com/"}, domain.URL{Short: "b", Orig: "http://b.com/"})
+	repo.release = make(chan struct{})
+	cache := New(repo)
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			_, err := cache.FindByKey(ctx, key)
+			assert.NoError(t, err)
+		}(key)
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&repo.calls) == 2 }, time.Second, time.Millisecond)
+	// a is written while both lookups are in flight
+	cache.Invalidate("a")
+	close(repo.release)
+	wg.Wait()
+
+	// lookup of b is cached, the one of a may hold what was there before the write
+	_, err := cache.FindByKey(ctx, "b")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, repo.calls)
+	_, err = cache.FindByKey(ctx, "a")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, repo.calls)
+	assert.Empty(t, cache.flights, "finished lookups are forgotten")
+}
+
+func TestRepository_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) usecase.Repository {
+		return New(storage.NewStorage(""))
+	})
+}
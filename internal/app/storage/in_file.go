@@ -2,10 +2,14 @@ package storage
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
@@ -13,16 +17,48 @@ import (
 
 const LineBreak byte = '\n'
 
+// Operations of append log records
+const (
+	opPut    = ""
+	opDelete = "delete"
+	opUpdate = "update"
+)
+
+// record is a line of the append log, lines written before operations
+// were introduced are plain URLs and so are puts
+type record struct {
+	domain.URL
+	Op string `json:"op,omitempty"`
+	// At is when an update replaced the previous original
+	At *time.Time `json:"at,omitempty"`
+}
+
 type PersistentStorage struct {
-	cache usecase.Repository
+	cache *URLMemoryStorage
 	file  *os.File
+	// keyring seals records, they are written in plain text without it
+	keyring *Keyring
+	// writes keeps records in the log in the order cache has taken them
+	writes sync.Mutex
+	// tail tells replicas how long log is and when it grows
+	tail logTail
 }
 
-func NewStorage(path string) usecase.Repository {
+// PersistentOption configures file storage
+type PersistentOption func(*PersistentStorage)
+
+// WithKeyring seals records written to the log and opens sealed ones read from it
+func WithKeyring(keyring *Keyring) PersistentOption {
+	return func(p *PersistentStorage) {
+		p.keyring = keyring
+	}
+}
+
+func NewStorage(path string, opts ...PersistentOption) usecase.Repository {
 
 	var store usecase.Repository = newURLMemoryStorage()
 	if path != "" {
-		persistentStorage, err := newPersistentStorage(path, store)
+		persistentStorage, err := NewPersistentStorage(path, opts...)
 		if err != nil {
 			log.Fatalf("filepath set, but can't start in persistent mode %v ", err.Error())
 		}
@@ -31,59 +67,230 @@ func NewStorage(path string) usecase.Repository {
 	return store
 }
 
-func newPersistentStorage(path string, cache usecase.Repository) (*PersistentStorage, error) {
+// NewPersistentStorage opens append log at path and restores links from it
+func NewPersistentStorage(path string, opts ...PersistentOption) (*PersistentStorage, error) {
+	p := &PersistentStorage{cache: newURLMemoryStorage()}
+	for _, opt := range opts {
+		opt(p)
+	}
 
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
 
-	sc := bufio.NewScanner(file)
+	if err = replay(file, p.cache, p.keyring); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	p.file = file
+	p.tail.reset(info.Size())
+	return p, nil
+}
+
+// replay applies records read from reader to cache, links are restored as they were written.
+// Sealed records are opened with keyring
+func replay(reader io.Reader, cache *URLMemoryStorage, keyring *Keyring) error {
+	ctx := context.Background()
+	sc := bufio.NewScanner(reader)
 	for sc.Scan() {
 
-		var url *domain.URL
-		line := sc.Bytes()
-		err = json.Unmarshal(line, &url)
+		rec, err := keyring.decode(sc.Bytes())
 		if err != nil {
-			return nil, fmt.Errorf("error while unmarshal from file %v ", err)
+			return fmt.Errorf("error while unmarshal from file %w ", err)
 		}
 
-		err = cache.Store(url)
+		switch rec.Op {
+		case opPut:
+			cache.restore(&rec.URL)
+		case opDelete:
+			err = cache.Delete(ctx, rec.Short)
+		case opUpdate:
+			err = restoreUpdate(cache, rec)
+		default:
+			err = fmt.Errorf("unknown operation %q", rec.Op)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("error while filling cache %v ", err)
+			return fmt.Errorf("error while filling cache %v ", err)
 		}
 	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("error while reading file %v ", err)
+	}
+	return nil
+}
 
-	return &PersistentStorage{
-		file:  file,
-		cache: cache,
-	}, nil
+// restoreUpdate applies an update record, the record holds the link as it is after the update
+func restoreUpdate(cache *URLMemoryStorage, rec record) error {
+	if rec.At == nil {
+		return fmt.Errorf("update of %v has no time", rec.Short)
+	}
+	cache.restoreUpdate(&rec.URL, *rec.At)
+	return nil
 }
 
-func (p *PersistentStorage) Store(url *domain.URL) error {
-	bytes, err := json.Marshal(url)
-	if err != nil {
-		return fmt.Errorf("error while marshaling data  %v ", err)
+// appendRecords writes records with a single write, so a batch is not interleaved with other writes
+func (p *PersistentStorage) appendRecords(records ...record) error {
+	var bytes []byte
+	for _, rec := range records {
+		line, err := p.keyring.encode(rec)
+		if err != nil {
+			return fmt.Errorf("error while marshaling data  %v ", err)
+		}
+		bytes = append(bytes, line...)
+		bytes = append(bytes, LineBreak)
 	}
-	bytes = append(bytes, LineBreak)
-	_, err = p.file.Write(bytes)
+	return p.appendLines(bytes)
+}
+
+// appendLines writes lines to the log and lets replicas know of them
+func (p *PersistentStorage) appendLines(bytes []byte) error {
+	_, err := p.file.Write(bytes)
 	if err != nil {
+		// a partial write moves the end of the log anyway
+		if info, statErr := p.file.Stat(); statErr == nil {
+			p.tail.reset(info.Size())
+		}
 		return fmt.Errorf("error while writing to file %v ", err)
 	}
-	err = p.cache.Store(url)
+	p.tail.grow(int64(len(bytes)))
+	return nil
+}
+
+// Store logs a link once cache has taken it, so rejected duplicates are not logged
+func (p *PersistentStorage) Store(ctx context.Context, url *domain.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.writes.Lock()
+	defer p.writes.Unlock()
+
+	if err := p.cache.Store(ctx, url); err != nil {
+		return err
+	}
+	return p.appendRecords(record{URL: *url})
+}
+
+func (p *PersistentStorage) FindByKey(ctx context.Context, key string) (*domain.URL, error) {
+	return p.cache.FindByKey(ctx, key)
+}
+
+func (p *PersistentStorage) FindAll(ctx context.Context, key string) []*domain.URL {
+	return p.cache.FindAll(ctx, key)
+}
+
+func (p *PersistentStorage) FindPage(ctx context.Context, key string, query usecase.PageQuery) (usecase.Page, error) {
+	return p.cache.FindPage(ctx, key, query)
+}
+
+func (p *PersistentStorage) ForEach(ctx context.Context, key string, fn func(*domain.URL) error) error {
+	return p.cache.ForEach(ctx, key, fn)
+}
+
+func (p *PersistentStorage) BatchWrite(ctx context.Context, urls []domain.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.writes.Lock()
+	defer p.writes.Unlock()
+
+	// links reported as conflicts are not written, the rest of the batch is
+	err := p.cache.BatchWrite(ctx, urls)
+	var conflicts usecase.ErrBatchConflicts
+	if err != nil && !errors.As(err, &conflicts) {
+		return err
+	}
+	records := make([]record, 0, len(urls))
+	for i, url := range urls {
+		if _, conflict := conflicts.Conflicts[i]; !conflict {
+			records = append(records, record{URL: url})
+		}
+	}
+	if appendErr := p.appendRecords(records...); appendErr != nil {
+		return appendErr
+	}
 	return err
 }
 
-func (p *PersistentStorage) FindByKey(key string) (*domain.URL, error) {
-	return p.cache.FindByKey(key)
+func (p *PersistentStorage) Delete(ctx context.Context, key string) error {
+	p.writes.Lock()
+	defer p.writes.Unlock()
+
+	_, err := p.cache.FindByKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	err = p.appendRecords(record{URL: domain.URL{Short: key}, Op: opDelete})
+	if err != nil {
+		return err
+	}
+	return p.cache.Delete(ctx, key)
+}
+
+func (p *PersistentStorage) Reassign(ctx context.Context, key string, owner string) error {
+	url, err := p.cache.FindByKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	url.Owner = owner
+	return p.Store(ctx, url)
+}
+
+// Update logs the link as it is after the update, so the record restores the whole link
+func (p *PersistentStorage) Update(ctx context.Context, key string, orig string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.writes.Lock()
+	defer p.writes.Unlock()
+
+	url, err := p.cache.FindByKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	if url.Orig == orig {
+		return nil
+	}
+	if err = p.cache.Update(ctx, key, orig, at); err != nil {
+		return err
+	}
+	url.Orig = orig
+	return p.appendRecords(record{URL: *url, Op: opUpdate, At: &at})
+}
+
+// Click logs the link with clicks left, so the record restores the whole link
+func (p *PersistentStorage) Click(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.writes.Lock()
+	defer p.writes.Unlock()
+
+	p.cache.mutex.Lock()
+	url, err := p.cache.click(key)
+	p.cache.mutex.Unlock()
+	if err != nil || url.MaxClicks == 0 {
+		return err
+	}
+	return p.appendRecords(record{URL: url})
+}
+
+func (p *PersistentStorage) History(ctx context.Context, key string) ([]domain.Version, error) {
+	return p.cache.History(ctx, key)
 }
 
-func (p *PersistentStorage) FindAll(key string) []*domain.URL {
-	return p.cache.FindAll(key)
+func (p *PersistentStorage) CountUsers(ctx context.Context) (int, error) {
+	return p.cache.CountUsers(ctx)
 }
 
-func (p *PersistentStorage) BatchWrite(urls []domain.URL) error {
-	return p.cache.BatchWrite(urls)
+func (p *PersistentStorage) Dump(ctx context.Context, fn func(*domain.URL) error) error {
+	return p.cache.Dump(ctx, fn)
 }
 
 func (p *PersistentStorage) Close() error {
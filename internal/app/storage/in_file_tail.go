@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+// ErrLogDiverged is returned when a replica asks for log from an offset
+// the log does not have a record at, replica log is not a copy of this one
+var ErrLogDiverged = errors.New("log does not continue at offset")
+
+// logTail is the end of append log, grown is closed and replaced every time log grows
+type logTail struct {
+	mutex sync.Mutex
+	size  int64
+	grown chan struct{}
+}
+
+func (t *logTail) reset(size int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.size = size
+	t.notify()
+}
+
+func (t *logTail) grow(written int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.size += written
+	t.notify()
+}
+
+func (t *logTail) notify() {
+	if t.grown != nil {
+		close(t.grown)
+	}
+	t.grown = make(chan struct{})
+}
+
+func (t *logTail) get() (int64, <-chan struct{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.size, t.grown
+}
+
+// LogSize is the length of append log in bytes, it is the offset the next record is written at
+func (p *PersistentStorage) LogSize() int64 {
+	size, _ := p.tail.get()
+	return size
+}
+
+// LogChanged returns a channel closed once log grows beyond its current size
+func (p *PersistentStorage) LogChanged() <-chan struct{} {
+	_, grown := p.tail.get()
+	return grown
+}
+
+// ReadLog calls fn with records of the log from offset to its current end as they are written,
+// sealed ones stay sealed. Offset must be 0 or the end of a record. It returns the end of the last record read
+func (p *PersistentStorage) ReadLog(ctx context.Context, from int64, fn func(offset int64, line []byte) error) (int64, error) {
+	size := p.LogSize()
+	if from < 0 || from > size {
+		return from, fmt.Errorf("%w %v, log is %v bytes", ErrLogDiverged, from, size)
+	}
+	if from > 0 {
+		last := make([]byte, 1)
+		if _, err := p.file.ReadAt(last, from-1); err != nil {
+			return from, err
+		}
+		if last[0] != LineBreak {
+			return from, fmt.Errorf("%w %v, it is inside of a record", ErrLogDiverged, from)
+		}
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(p.file, from, size-from))
+	offset := from
+	for {
+		if err := ctx.Err(); err != nil {
+			return offset, err
+		}
+		line, err := reader.ReadBytes(LineBreak)
+		if errors.Is(err, io.EOF) {
+			// a record without line break is being written, it is read next time
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		if err = fn(offset, line[:len(line)-1]); err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// ApplyLog appends a record read from log of another storage as it is and applies it to links,
+// so the log stays a byte to byte copy of that one. It returns id of the link the record is of
+func (p *PersistentStorage) ApplyLog(line []byte) (string, error) {
+	rec, err := p.keyring.decode(line)
+	if err != nil {
+		return "", fmt.Errorf("error while unmarshal replicated record %w ", err)
+	}
+
+	p.writes.Lock()
+	defer p.writes.Unlock()
+
+	appended := make([]byte, 0, len(line)+1)
+	appended = append(appended, line...)
+	appended = append(appended, LineBreak)
+	if err = p.appendLines(appended); err != nil {
+		return "", err
+	}
+
+	switch rec.Op {
+	case opPut:
+		p.cache.restore(&rec.URL)
+	case opDelete:
+		// a link deleted twice is not a reason to stop replication
+		if err = p.cache.Delete(context.Background(), rec.Short); errors.Is(err, usecase.ErrNotFound) {
+			err = nil
+		}
+	case opUpdate:
+		err = restoreUpdate(p.cache, rec)
+	default:
+		err = fmt.Errorf("unknown operation %q", rec.Op)
+	}
+	return rec.Short, err
+}
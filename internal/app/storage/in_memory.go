@@ -1,78 +1,409 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
 )
 
 type URLMemoryStorage struct {
-	linksStorage map[uniqID]string
+	linksStorage map[uniqID]domain.URL
 	mutex        sync.RWMutex
 	userLinks    map[string][]uniqID
+	// originals finds a link the owner has already shortened the original with
+	originals map[original]uniqID
+	// history holds previous originals of changed links from the oldest one
+	history map[uniqID][]domain.Version
 }
 
 type uniqID string
 
+type original struct {
+	owner string
+	orig  string
+}
+
 func newURLMemoryStorage() *URLMemoryStorage {
 	// Do not have duplications of URLs, do not fall into full maps scan for any use cases, etc,
 	// userLinks is map of slices, each slice is a list of refs (keys)
 	// to a users links in linksStorage map. To make this ref approach more explicit,
-	// redundant [uniqID] type declared
+	// redundant [uniqID] type declared.
+	// Each slice is kept ordered by creation time and short id, so it is an index for pagination
 	return &URLMemoryStorage{
 		userLinks:    make(map[string][]uniqID),
-		linksStorage: make(map[uniqID]string),
+		linksStorage: make(map[uniqID]domain.URL),
+		originals:    make(map[original]uniqID),
+		history:      make(map[uniqID][]domain.Version),
 	}
 }
 
-func (u *URLMemoryStorage) BatchWrite(urls []domain.URL) error {
-	for _, v := range urls {
-		// reserved error api
-		_ = u.Store(&v)
+// BatchWrite writes links under one lock, links whose owners have already
+// shortened the same originals are skipped and reported with ErrBatchConflicts
+func (u *URLMemoryStorage) BatchWrite(ctx context.Context, urls []domain.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	conflicts := make(map[int]usecase.ErrAlreadyExists)
+	for i := range urls {
+		if existing, ok := u.shortenedBefore(&urls[i]); ok {
+			conflicts[i] = alreadyExists(existing, urls[i].Orig)
+			continue
+		}
+		u.put(&urls[i])
+	}
+	if len(conflicts) > 0 {
+		return usecase.ErrBatchConflicts{Conflicts: conflicts}
 	}
 	return nil
 }
 
-func (u *URLMemoryStorage) Store(url *domain.URL) error {
+// Store reports a link of original the owner has already shortened with ErrAlreadyExists
+func (u *URLMemoryStorage) Store(ctx context.Context, url *domain.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
-	u.linksStorage[uniqID(url.Short)] = url.Orig
 
-	if url.Owner != "" {
-		u.userLinks[url.Owner] = append(u.userLinks[url.Owner], uniqID(url.Short))
+	if existing, ok := u.shortenedBefore(url); ok {
+		return alreadyExists(existing, url.Orig)
 	}
+	u.put(url)
 	return nil
 }
 
-func (u *URLMemoryStorage) FindByKey(key string) (*domain.URL, error) {
+// shortenedBefore finds the link the owner has already shortened the original with under another id
+func (u *URLMemoryStorage) shortenedBefore(url *domain.URL) (uniqID, bool) {
+	existing, ok := u.originals[original{url.Owner, url.Orig}]
+	if !ok || existing == uniqID(url.Short) {
+		return "", false
+	}
+	return existing, true
+}
+
+func alreadyExists(existing uniqID, orig string) usecase.ErrAlreadyExists {
+	return usecase.ErrAlreadyExists{
+		Err:            errors.New("duplicate entry, given entity record already exists"),
+		ExistShortenID: string(existing),
+		Orig:           orig,
+	}
+}
+
+// put writes link by its id and moves it between indexes, it does not check originals,
+// so logs written before originals were checked are restored with every link they hold
+func (u *URLMemoryStorage) put(url *domain.URL) {
+	stored, exists := u.linksStorage[uniqID(url.Short)]
+	if exists {
+		u.removeOriginal(&stored)
+	}
+	if exists && stored.Owner != url.Owner {
+		// owner is changed, link moves to another user index
+		u.removeUserLink(&stored)
+		exists = false
+	}
+	u.linksStorage[uniqID(url.Short)] = *url
+
+	if _, taken := u.originals[original{url.Owner, url.Orig}]; !taken {
+		u.originals[original{url.Owner, url.Orig}] = uniqID(url.Short)
+	}
+	if url.Owner != "" && !exists {
+		u.insertUserLink(url)
+	}
+}
+
+// restore puts a link read from a log or a dump
+func (u *URLMemoryStorage) restore(url *domain.URL) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.put(url)
+}
+
+// removeOriginal frees the original of the link
+func (u *URLMemoryStorage) removeOriginal(url *domain.URL) {
+	key := original{url.Owner, url.Orig}
+	if u.originals[key] == uniqID(url.Short) {
+		delete(u.originals, key)
+	}
+}
+
+// insertUserLink puts a key into its place in user index,
+// links mostly come in creation order so it is usually an append
+func (u *URLMemoryStorage) insertUserLink(url *domain.URL) {
+	bucket := u.userLinks[url.Owner]
+	pos := sort.Search(len(bucket), func(i int) bool {
+		return u.less(url, bucket[i])
+	})
+	bucket = append(bucket, "")
+	copy(bucket[pos+1:], bucket[pos:])
+	bucket[pos] = uniqID(url.Short)
+	u.userLinks[url.Owner] = bucket
+}
+
+// removeUserLink deletes a key from user index keeping it ordered
+func (u *URLMemoryStorage) removeUserLink(url *domain.URL) {
+	bucket := u.userLinks[url.Owner]
+	pos := sort.Search(len(bucket), func(i int) bool {
+		stored := u.linksStorage[bucket[i]]
+		cursor := usecase.Cursor{CreatedAt: stored.CreatedAt, Short: stored.Short}
+		return !cursor.After(url)
+	})
+	if pos == len(bucket) || bucket[pos] != uniqID(url.Short) {
+		return
+	}
+	bucket = append(bucket[:pos], bucket[pos+1:]...)
+	if len(bucket) == 0 {
+		delete(u.userLinks, url.Owner)
+		return
+	}
+	u.userLinks[url.Owner] = bucket
+}
+
+// less reports if url goes before the link stored by key
+func (u *URLMemoryStorage) less(url *domain.URL, key uniqID) bool {
+	cursor := usecase.Cursor{CreatedAt: url.CreatedAt, Short: url.Short}
+	stored := u.linksStorage[key]
+	return cursor.After(&stored)
+}
+
+func (u *URLMemoryStorage) FindByKey(_ context.Context, key string) (*domain.URL, error) {
 	u.mutex.RLock()
 	defer u.mutex.RUnlock()
 
-	orig, ok := u.linksStorage[uniqID(key)]
+	url, ok := u.linksStorage[uniqID(key)]
 	if !ok {
-		return nil, errors.New("key does not exist")
+		return nil, fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
 	}
+	return &url, nil
+}
 
-	url := domain.NewURL(orig, key)
-	return url, nil
+func (u *URLMemoryStorage) FindAll(_ context.Context, userKey string) []*domain.URL {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	userBucket := u.userLinks[userKey]
+	resultList := make([]*domain.URL, 0, len(userBucket))
+	for _, key := range userBucket {
+		url := u.linksStorage[key]
+		resultList = append(resultList, &url)
+	}
+
+	return resultList
 }
 
-func (u *URLMemoryStorage) FindAll(userKey string) []*domain.URL {
+func (u *URLMemoryStorage) FindPage(_ context.Context, userKey string, query usecase.PageQuery) (usecase.Page, error) {
 	u.mutex.RLock()
 	defer u.mutex.RUnlock()
 
-	userBucket, ok := u.userLinks[userKey]
+	bucket := u.userLinks[userKey]
+
+	// start right after the cursor, index is ordered so it is a binary search
+	start, step := 0, 1
+	if query.Desc {
+		start, step = len(bucket)-1, -1
+	}
+	if query.After != nil {
+		after := sort.Search(len(bucket), func(i int) bool {
+			url := u.linksStorage[bucket[i]]
+			return query.After.After(&url)
+		})
+		start = after
+		if query.Desc {
+			// last one before the cursor, cursor link itself is skipped
+			start = after - 1
+			if start >= 0 && bucket[start] == uniqID(query.After.Short) {
+				start--
+			}
+		}
+	}
+
+	page := usecase.Page{URLs: make([]*domain.URL, 0)}
+	for i := start; i >= 0 && i < len(bucket); i += step {
+		url := u.linksStorage[bucket[i]]
+		if !query.Match(&url) {
+			continue
+		}
+		if len(page.URLs) == query.Limit {
+			last := page.URLs[len(page.URLs)-1]
+			page.Next = &usecase.Cursor{CreatedAt: last.CreatedAt, Short: last.Short}
+			break
+		}
+		page.URLs = append(page.URLs, &url)
+	}
+	return page, nil
+}
+
+// ForEach does not hold the lock while fn is called, so slow consumer does not block writers.
+// Links stored after the call started are not visited
+func (u *URLMemoryStorage) ForEach(ctx context.Context, userKey string, fn func(*domain.URL) error) error {
+	u.mutex.RLock()
+	keys := make([]uniqID, len(u.userLinks[userKey]))
+	copy(keys, u.userLinks[userKey])
+	u.mutex.RUnlock()
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		u.mutex.RLock()
+		url, ok := u.linksStorage[key]
+		u.mutex.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := fn(&url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *URLMemoryStorage) Delete(_ context.Context, key string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	url, ok := u.linksStorage[uniqID(key)]
+	if !ok {
+		return fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	if url.Owner != "" {
+		u.removeUserLink(&url)
+	}
+	u.removeOriginal(&url)
+	delete(u.linksStorage, uniqID(key))
+	delete(u.history, uniqID(key))
+	return nil
+}
+
+// Update reports an original the owner has already shortened under another id with ErrAlreadyExists
+func (u *URLMemoryStorage) Update(ctx context.Context, key string, orig string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	url, ok := u.linksStorage[uniqID(key)]
 	if !ok {
+		return fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	if url.Orig == orig {
 		return nil
 	}
+	url.Orig = orig
+	if existing, ok := u.shortenedBefore(&url); ok {
+		return alreadyExists(existing, orig)
+	}
+	u.update(&url, at)
+	return nil
+}
 
-	resultList := make([]*domain.URL, 0, len(userBucket))
-	for _, key := range userBucket {
-		orig := u.linksStorage[key]
-		url := domain.NewURL(orig, string(key))
-		resultList = append(resultList, url)
+// update replaces original of the stored link, like put it does not check originals
+func (u *URLMemoryStorage) update(url *domain.URL, at time.Time) {
+	stored, ok := u.linksStorage[uniqID(url.Short)]
+	if !ok || stored.Orig == url.Orig {
+		u.put(url)
+		return
 	}
+	u.history[uniqID(url.Short)] = append(u.history[uniqID(url.Short)], domain.Version{Orig: stored.Orig, ReplacedAt: at})
+	u.put(url)
+}
 
-	return resultList
+// restoreUpdate applies an update read from a log
+func (u *URLMemoryStorage) restoreUpdate(url *domain.URL, at time.Time) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.update(url, at)
+}
+
+func (u *URLMemoryStorage) History(ctx context.Context, key string) ([]domain.Version, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	if _, ok := u.linksStorage[uniqID(key)]; !ok {
+		return nil, fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	history := make([]domain.Version, len(u.history[uniqID(key)]))
+	copy(history, u.history[uniqID(key)])
+	return history, nil
+}
+
+func (u *URLMemoryStorage) Click(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	_, err := u.click(key)
+	return err
+}
+
+// click counts a click down under the lock and returns the link as it is after the click
+func (u *URLMemoryStorage) click(key string) (domain.URL, error) {
+	url, ok := u.linksStorage[uniqID(key)]
+	if !ok {
+		return url, fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	if url.MaxClicks == 0 {
+		return url, nil
+	}
+	if url.ClicksLeft <= 0 {
+		return url, fmt.Errorf("link %v: %w", key, usecase.ErrExhausted)
+	}
+	url.ClicksLeft--
+	u.linksStorage[uniqID(key)] = url
+	return url, nil
+}
+
+func (u *URLMemoryStorage) Reassign(ctx context.Context, key string, owner string) error {
+	url, err := u.FindByKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	url.Owner = owner
+	return u.Store(ctx, url)
+}
+
+// CountUsers counts users who own links, memory does not know about others
+func (u *URLMemoryStorage) CountUsers(_ context.Context) (int, error) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return len(u.userLinks), nil
+}
+
+// Dump visits links of every user, like ForEach lock is not held while fn is called
+func (u *URLMemoryStorage) Dump(ctx context.Context, fn func(*domain.URL) error) error {
+	u.mutex.RLock()
+	keys := make([]uniqID, 0, len(u.linksStorage))
+	for key := range u.linksStorage {
+		keys = append(keys, key)
+	}
+	u.mutex.RUnlock()
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		u.mutex.RLock()
+		url, ok := u.linksStorage[key]
+		u.mutex.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := fn(&url); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoKey is returned for a sealed record whose key is not in the keyring
+var ErrNoKey = errors.New("record is sealed with unknown key")
+
+// Keyring seals log records with AES-GCM. Records are sealed with the current key
+// and opened with the key they name, so old keys are kept in keyring while the log
+// is rewritten under a new one. A nil keyring writes plain records
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// sealedRecord is a line of encrypted record. Key id is authenticated with
+// the record, so a record can't be passed for one sealed with another key
+type sealedRecord struct {
+	KeyID  string `json:"kid"`
+	Sealed []byte `json:"sealed"`
+}
+
+// sealedLine is a log line as it is read, plain or sealed
+type sealedLine struct {
+	record
+	sealedRecord
+}
+
+// ParseKeys makes keyring of keys written as id:base64 separated by commas or new lines,
+// keys are 16, 24 or 32 bytes for AES-128, AES-192 or AES-256 and the first one is current
+func ParseKeys(text string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	entries := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("key must be written as id:base64")
+		}
+		id := parts[0]
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("key %v is given twice", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %v is not base64: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %w", id, err)
+		}
+		k.keys[id] = aead
+		if k.current == "" {
+			k.current = id
+		}
+	}
+	if k.current == "" {
+		return nil, errors.New("no keys are given")
+	}
+	return k, nil
+}
+
+// LoadKeyring parses keys and keys of file, keys given directly go first,
+// nil keyring is returned if both are empty
+func LoadKeyring(keys string, keyFile string) (*Keyring, error) {
+	if keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read key file: %w", err)
+		}
+		keys += "\n" + string(content)
+	}
+	if strings.TrimSpace(keys) == "" {
+		return nil, nil
+	}
+	return ParseKeys(keys)
+}
+
+// Current is id of the key records are sealed with
+func (k *Keyring) Current() string {
+	if k == nil {
+		return ""
+	}
+	return k.current
+}
+
+// encode marshals record into a log line without line break
+func (k *Keyring) encode(rec record) ([]byte, error) {
+	plain, err := json.Marshal(rec)
+	if err != nil || k == nil {
+		return plain, err
+	}
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedRecord{
+		KeyID:  k.current,
+		Sealed: aead.Seal(nonce, nonce, plain, []byte(k.current)),
+	})
+}
+
+// decode reads plain or sealed log line, plain lines are read with any keyring
+func (k *Keyring) decode(line []byte) (record, error) {
+	var read sealedLine
+	if err := json.Unmarshal(line, &read); err != nil {
+		return record{}, err
+	}
+	if read.Sealed == nil {
+		return read.record, nil
+	}
+	if k == nil {
+		return record{}, fmt.Errorf("%w %v, encryption keys are not set", ErrNoKey, read.KeyID)
+	}
+	aead, ok := k.keys[read.KeyID]
+	if !ok {
+		return record{}, fmt.Errorf("%w %v", ErrNoKey, read.KeyID)
+	}
+	if len(read.Sealed) < aead.NonceSize() {
+		return record{}, errors.New("sealed record is too short")
+	}
+	nonce, sealed := read.Sealed[:aead.NonceSize()], read.Sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, []byte(read.KeyID))
+	if err != nil {
+		return record{}, fmt.Errorf("record of key %v can't be opened: %w", read.KeyID, err)
+	}
+	var rec record
+	err = json.Unmarshal(plain, &rec)
+	return rec, err
+}
+
+// Reencrypt rewrites log at path sealing every record with the current key of keyring,
+// records are read with any key of it. Log is replaced at once when it is written,
+// so storage must be closed meanwhile. Nil keyring rewrites log in plain text.
+// Record offsets change, so replication followers of the log start over from an empty log
+func Reencrypt(path string, keyring *Keyring) (int, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	// removing fails once temporary file is renamed
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	count := 0
+	writer := bufio.NewWriter(dst)
+	sc := bufio.NewScanner(src)
+	for sc.Scan() {
+		rec, err := keyring.decode(sc.Bytes())
+		if err != nil {
+			return count, fmt.Errorf("record %v: %w", count+1, err)
+		}
+		line, err := keyring.encode(rec)
+		if err != nil {
+			return count, fmt.Errorf("record %v: %w", count+1, err)
+		}
+		if _, err = writer.Write(append(line, LineBreak)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err = sc.Err(); err != nil {
+		return count, err
+	}
+
+	if err = writer.Flush(); err != nil {
+		return count, err
+	}
+	if err = dst.Chmod(0644); err != nil {
+		return count, err
+	}
+	if err = dst.Sync(); err != nil {
+		return count, err
+	}
+	if err = dst.Close(); err != nil {
+		return count, err
+	}
+	return count, os.Rename(dst.Name(), path)
+}
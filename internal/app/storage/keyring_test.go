@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/storagetest"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(id string, fill byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+}
+
+func testKeyring(t *testing.T, keys ...string) *Keyring {
+	t.Helper()
+	keyring, err := ParseKeys(strings.Join(keys, ","))
+	require.NoError(t, err)
+	return keyring
+}
+
+func TestParseKeys(t *testing.T) {
+	keyring := testKeyring(t, testKey("k2", 2), testKey("k1", 1))
+	assert.Equal(t, "k2", keyring.Current())
+
+	for name, keys := range map[string]string{
+		"empty":      " , ",
+		"no id":      "c2VjcmV0",
+		"not base64": "k1:***",
+		"short key":  "k1:" + base64.StdEncoding.EncodeToString([]byte("short")),
+		"duplicate":  testKey("k1", 1) + "," + testKey("k1", 2),
+		"empty id":   ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16)),
+	} {
+		_, err := ParseKeys(keys)
+		assert.Error(t, err, name)
+	}
+
+	none, err := LoadKeyring("", "")
+	require.NoError(t, err)
+	assert.Nil(t, none)
+}
+
+func TestLoadKeyring_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("# old keys\n"+testKey("k1", 1)+"\n"), 0600))
+
+	keyring, err := LoadKeyring(testKey("k2", 2), path)
+	require.NoError(t, err)
+	assert.Equal(t, "k2", keyring.Current())
+}
+
+func TestKeyring_Seal(t *testing.T) {
+	keyring := testKeyring(t, testKey("k1", 1))
+	rec := record{URL: domain.URL{Short: "a", Orig: "http://a.com/?token=secret", Owner: "u1"}}
+
+	line, err := keyring.encode(rec)
+	require.NoError(t, err)
+	assert.NotContains(t, string(line), "secret")
+	assert.Contains(t, string(line), `"kid":"k1"`)
+
+	opened, err := keyring.decode(line)
+	require.NoError(t, err)
+	assert.Equal(t, rec, opened)
+
+	// plain lines are read with keyring, sealed ones are not read without it
+	plain, err := (*Keyring)(nil).encode(rec)
+	require.NoError(t, err)
+	opened, err = keyring.decode(plain)
+	require.NoError(t, err)
+	assert.Equal(t, rec, opened)
+	_, err = (*Keyring)(nil).decode(line)
+	assert.ErrorIs(t, err, ErrNoKey)
+
+	// a record can't be passed for one of another key
+	other := testKeyring(t, testKey("k2", 1))
+	_, err = other.decode(line)
+	assert.ErrorIs(t, err, ErrNoKey)
+	renamed := testKeyring(t, testKey("k2", 1))
+	_, err = renamed.decode(bytes.Replace(line, []byte(`"kid":"k1"`), []byte(`"kid":"k2"`), 1))
+	assert.Error(t, err)
+}
+
+func TestPersistentStorage_Sealed(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) usecase.Repository {
+		file, err := NewPersistentStorage(filepath.Join(t.TempDir(), "links.log"), WithKeyring(testKeyring(t, testKey("k1", 1))))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = file.Close() })
+		return file
+	})
+}
+
+func TestReencrypt(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+
+	// a plain log, then a link sealed with the first key
+	file, err := NewPersistentStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, file.Store(ctx, &domain.URL{Short: "a", Orig: "http://a.com/?token=plain", Owner: "u1"}))
+	require.NoError(t, file.Close())
+
+	old := testKeyring(t, testKey("k1", 1))
+	file, err = NewPersistentStorage(path, WithKeyring(old))
+	require.NoError(t, err)
+	require.NoError(t, file.Store(ctx, &domain.URL{Short: "b", Orig: "http://b.com/?token=sealed", Owner: "u1"}))
+	require.NoError(t, file.Delete(ctx, "a"))
+	require.NoError(t, file.Close())
+
+	// new key goes first, the old one opens records until log is rewritten
+	rotated := testKeyring(t, testKey("k2", 2), testKey("k1", 1))
+	count, err := Reencrypt(path, rotated)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "token")
+	assert.NotContains(t, string(content), `"kid":"k1"`)
+
+	_, err = NewPersistentStorage(path, WithKeyring(old))
+	assert.ErrorIs(t, err, ErrNoKey)
+
+	file, err = NewPersistentStorage(path, WithKeyring(testKeyring(t, testKey("k2", 2))))
+	require.NoError(t, err)
+	defer file.Close()
+	found, err := file.FindByKey(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, "http://b.com/?token=sealed", found.Orig)
+	_, err = file.FindByKey(ctx, "a")
+	assert.ErrorIs(t, err, usecase.ErrNotFound)
+}
+
+func TestBoundedStorage_Sealed(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+	keyring := testKeyring(t, testKey("k1", 1))
+
+	bounded := openBounded(t, path, WithMaxLinks(1), WithLogKeyring(keyring))
+	storeLinks(t, bounded, 3)
+	// evicted link is opened when it is read back
+	found, err := bounded.FindByKey(ctx, "s0")
+	require.NoError(t, err)
+	assert.Equal(t, "http://0.com/", found.Orig)
+	require.NoError(t, bounded.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "http://")
+
+	file, err := NewPersistentStorage(path, WithKeyring(keyring))
+	require.NoError(t, err)
+	defer file.Close()
+	assert.Len(t, file.FindAll(ctx, "u1"), 3)
+}
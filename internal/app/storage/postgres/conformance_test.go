@@ -0,0 +1,34 @@
+//go:build postgres
+// +build postgres
+
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/storagetest"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDB_Conformance runs against a local instance with go test -tags postgres,
+// TEST_DATABASE_DSN points to a database whose links are deleted by every test
+func TestDB_Conformance(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	storagetest.Run(t, func(t *testing.T) usecase.Repository {
+		ctx := context.Background()
+		db, err := NewDB(ctx, dsn)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = db.Close() })
+
+		_, err = db.pool.Exec(ctx, `TRUNCATE public.url_versions, public.urls, public.users`)
+		require.NoError(t, err)
+		return db
+	})
+}
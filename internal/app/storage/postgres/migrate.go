@@ -0,0 +1,128 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/sqlstore"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// migrationLockID is a key of advisory lock held while schema is migrated,
+// so instances started at once do not apply the same migration twice
+const migrationLockID int64 = 7_345_001
+
+// ErrMigration means schema can't be brought to the expected version
+var ErrMigration = sqlstore.ErrMigration
+
+// LatestSchemaVersion is the version schema is migrated to on start
+func LatestSchemaVersion() (int, error) {
+	return sqlstore.LatestVersion(sqlstore.Postgres)
+}
+
+// Migrate applies every migration which is not applied yet
+func (d *DB) Migrate(ctx context.Context) error {
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMigration, err)
+	}
+	return d.MigrateTo(ctx, latest)
+}
+
+// MigrateTo applies up migrations or rolls back down ones until schema is of given version.
+// Every migration runs in its own transaction, so a failed one leaves schema at the previous version
+func (d *DB) MigrateTo(ctx context.Context, version int) error {
+	if err := d.migrateTo(ctx, version); err != nil {
+		return fmt.Errorf("%w: %v", ErrMigration, err)
+	}
+	return nil
+}
+
+func (d *DB) migrateTo(ctx context.Context, version int) error {
+	migrations, err := sqlstore.Migrations(sqlstore.Postgres)
+	if err != nil {
+		return err
+	}
+
+	// advisory lock belongs to a session, so everything goes through one connection
+	conn, err := d.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID); err != nil {
+			log.Printf("can't release migration lock: %v", err)
+		}
+	}()
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS public.schema_migrations (
+									version    BIGINT NOT NULL PRIMARY KEY,
+									name       TEXT NOT NULL,
+									applied_at TIMESTAMPTZ NOT NULL DEFAULT now())`)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	steps, err := sqlstore.Plan(migrations, current, version)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		log.Printf("running %v", step)
+		if err = inTx(ctx, conn, step); err != nil {
+			return fmt.Errorf("%v: %v", step, err)
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the last applied migration, 0 if there is none
+func (d *DB) SchemaVersion(ctx context.Context) (int, error) {
+	conn, err := d.pool.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	var exists bool
+	err = conn.QueryRow(ctx, `SELECT to_regclass('public.schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return schemaVersion(ctx, conn)
+}
+
+func schemaVersion(ctx context.Context, conn *pgxpool.Conn) (int, error) {
+	var version int
+	err := conn.QueryRow(ctx, `SELECT coalesce(max(version), 0) FROM public.schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// inTx runs script of step and records it in a single transaction
+func inTx(ctx context.Context, conn *pgxpool.Conn, step sqlstore.Step) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// a script without arguments is sent as is, so it may hold several statements
+	if _, err = tx.Exec(ctx, step.Script()); err != nil {
+		return err
+	}
+	record, args := step.Record(sqlstore.Postgres)
+	if _, err = tx.Exec(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
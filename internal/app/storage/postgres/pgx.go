@@ -2,175 +2,571 @@ package postgres
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"strconv"
+	"time"
 
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/sqlstore"
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
-	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+// queries are shared with other SQL storages
+var queries = sqlstore.NewQueries(sqlstore.Postgres)
+
 type DB struct {
-	conn *sql.DB
+	pool *pgxpool.Pool
+	// queryTimeout bounds every statement on top of the caller deadline, zero means no bound
+	queryTimeout time.Duration
+}
+
+// Option tunes connection pool and statements
+type Option func(*pgxpool.Config, *DB)
+
+// WithPoolSize bounds number of connections, zero keeps pgx default
+func WithPoolSize(min, max int32) Option {
+	return func(config *pgxpool.Config, _ *DB) {
+		if min > 0 {
+			config.MinConns = min
+		}
+		if max > 0 {
+			config.MaxConns = max
+		}
+	}
 }
 
-func NewDB(dsn string) (*DB, error) {
+// WithConnectTimeout bounds establishing of a connection
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(config *pgxpool.Config, _ *DB) {
+		if timeout > 0 {
+			config.ConnConfig.ConnectTimeout = timeout
+		}
+	}
+}
+
+// WithMaxConnIdleTime closes connections which are not used for so long
+func WithMaxConnIdleTime(idle time.Duration) Option {
+	return func(config *pgxpool.Config, _ *DB) {
+		if idle > 0 {
+			config.MaxConnIdleTime = idle
+		}
+	}
+}
+
+// WithQueryTimeout bounds every statement, streaming is bounded per fetched chunk
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(_ *pgxpool.Config, db *DB) {
+		db.queryTimeout = timeout
+	}
+}
+
+// NewDB connects to database and migrates its schema to the latest version,
+// errors of migration wrap ErrMigration
+func NewDB(ctx context.Context, dsn string, opts ...Option) (*DB, error) {
+	db, err := Connect(ctx, dsn, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Connect connects to database leaving its schema as is
+func Connect(ctx context.Context, dsn string, opts ...Option) (*DB, error) {
 	if dsn == "" {
 		return nil, errors.New("invalid connection string")
 	}
 
-	conn, err := sql.Open("pgx", dsn)
+	config, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
 		return nil, err
 	}
+	db := &DB{}
+	for _, opt := range opts {
+		opt(config, db)
+	}
 
-	db := DB{conn: conn}
-	db.createTablesIfNotExits()
+	db.pool, err = pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
 
-	return &db, nil
+// timeout applies query timeout to ctx
+func (d *DB) timeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d.queryTimeout)
 }
 
-func (d *DB) BatchWrite(uris []domain.URL) error {
+// BatchWrite registers users and inserts links in one transaction. Links whose owners
+// have already shortened the same originals are skipped and reported with ErrBatchConflicts
+func (d *DB) BatchWrite(ctx context.Context, uris []domain.URL) error {
+	if len(uris) == 0 {
+		return nil
+	}
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
 
-	tx, err := d.conn.Begin()
+	tx, err := d.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	query := `SELECT id FROM public.users WHERE  id = $1 `
-	row := d.conn.QueryRow(query, uris[0].Owner)
+	if err = registerUsers(ctx, tx, sqlstore.Owners(uris)); err != nil {
+		return fmt.Errorf("error while trying insert user: %w", err)
+	}
 
-	var s string
-	haveRows := row.Scan(&s)
-	if haveRows == sql.ErrNoRows {
-		insert := `INSERT INTO public.users (id) VALUES ($1);`
-		_, err := tx.Exec(insert, uris[0].Owner)
-		if err != nil {
-			return errors.New("error while trying insert user")
-		}
+	inserted := make(map[string]bool, len(uris))
+	err = sqlstore.Chunks(len(uris), sqlstore.BatchRows, func(start, end int) error {
+		return insertURLs(ctx, tx, uris[start:end], inserted)
+	})
+	if err != nil {
+		return err
 	}
 
-	defer tx.Rollback()
+	conflicts, err := findConflicts(ctx, tx, uris, inserted)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return usecase.ErrBatchConflicts{Conflicts: conflicts}
+	}
+	return nil
+}
 
-	stmt, err := tx.Prepare("INSERT INTO urls (id, orig_url, user_id) VALUES ($1,$2,$3)")
+// insertURLs inserts links with a multi-row statement and marks ids of inserted ones
+func insertURLs(ctx context.Context, tx pgx.Tx, uris []domain.URL, inserted map[string]bool) error {
+	query, args := queries.InsertURLs(uris)
+	rows, err := tx.Query(ctx, query, args...)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer rows.Close()
 
-	for _, u := range uris {
-		if _, err = stmt.Exec(u.Short, u.Orig, u.Owner); err != nil {
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
 			return err
 		}
+		inserted[id] = true
 	}
-	return tx.Commit()
+	return rows.Err()
 }
 
-func (d *DB) Store(url *domain.URL) error {
+// findConflicts finds links which hold originals of the skipped ones
+func findConflicts(ctx context.Context, tx pgx.Tx, uris []domain.URL, inserted map[string]bool) (map[int]usecase.ErrAlreadyExists, error) {
+	if len(inserted) == len(uris) {
+		return nil, nil
+	}
 
-	// todo wrap into TX
-	query := `SELECT id FROM public.users WHERE  id = $1`
-	row := d.conn.QueryRow(query, url.Owner)
-	var s string
-	haveRows := row.Scan(&s)
-	if haveRows == sql.ErrNoRows {
-		insert := `INSERT INTO public.users (id) VALUES ($1);`
-		_, err := d.conn.Exec(insert, url.Owner)
+	skipped := sqlstore.Skipped(uris, inserted)
+	existing := make(map[sqlstore.Original]string)
+	err := sqlstore.Chunks(len(skipped), sqlstore.BatchRows, func(start, end int) error {
+		query, args := queries.FindOriginals(skipped[start:end])
+		rows, err := tx.Query(ctx, query, args...)
 		if err != nil {
-			log.Println(err.Error())
-			return errors.New("error while trying insert user")
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var k sqlstore.Original
+			var id string
+			if err = rows.Scan(&k.Owner, &k.Orig, &id); err != nil {
+				return err
+			}
+			existing[k] = id
 		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
 	}
+	return sqlstore.Conflicts(uris, inserted, existing)
+}
+
+// registerUsers inserts users which are not known yet
+func registerUsers(ctx context.Context, tx pgx.Tx, users []string) error {
+	return sqlstore.Chunks(len(users), sqlstore.BatchRows, func(start, end int) error {
+		query, args := queries.RegisterUsers(users[start:end])
+		_, err := tx.Exec(ctx, query, args...)
+		return err
+	})
+}
+
+// RegisterUsers keeps users even if they have no links, so they survive migration
+func (d *DB) RegisterUsers(ctx context.Context, users []string) error {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
 
-	prep, err := d.conn.Prepare("INSERT INTO public.urls (id, orig_url, user_id)" +
-		" VALUES ($1, $2, $3) ON CONFLICT (user_id,orig_url) DO UPDATE SET orig_url=EXCLUDED.orig_url  RETURNING id")
+	tx, err := d.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	result := prep.QueryRowContext(context.Background(), url.Short, url.Orig, url.Owner)
+	if err = registerUsers(ctx, tx, users); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DumpUsers calls fn for every user, including those who have no links
+func (d *DB) DumpUsers(ctx context.Context, fn func(string) error) error {
+	rows, err := d.pool.Query(ctx, queries.ListUsers)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user string
+		if err = rows.Scan(&user); err != nil {
+			return err
+		}
+		if err = fn(user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Store registers user and inserts link in one transaction,
+// a link of original the owner has already shortened is reported with ErrAlreadyExists
+func (d *DB) Store(ctx context.Context, url *domain.URL) error {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
+
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err = registerUsers(ctx, tx, []string{url.Owner}); err != nil {
+		return fmt.Errorf("error while trying insert user: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, queries.InsertURL, sqlstore.URLValues(url)...)
+	if err != nil {
+		return err
+	}
 
 	var id string
-	result.Scan(&id)
+	err = tx.QueryRow(ctx, queries.FindShort, url.Owner, url.Orig).Scan(&id)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
 
 	if id != url.Short {
-		return usecase.ErrAlreadyExists{
-			Err:            errors.New("duplicate entry, given entity record already exists"),
-			ExistShortenID: id,
-			Orig:           url.Orig,
-		}
+		return sqlstore.AlreadyExists(id, url.Orig)
 	}
 	return nil
 }
 
-func (d *DB) FindByKey(key string) (*domain.URL, error) {
+func (d *DB) FindByKey(ctx context.Context, key string) (*domain.URL, error) {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
 
-	query := `SELECT id,orig_url,user_id FROM public.urls WHERE id = $1;`
-	row := d.conn.QueryRow(query, key)
-	url := domain.URL{}
-	err := row.Scan(&url.Short, &url.Orig, &url.Owner)
+	url, err := sqlstore.ScanURL(d.pool.QueryRow(ctx, queries.FindByKey, key))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("key %v not exists", key)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("key %v not exists: %w", key, usecase.ErrNotFound)
 		}
 		return nil, err
 	}
 	return &url, nil
 }
 
-func (d *DB) FindAll(key string) []*domain.URL {
+func (d *DB) FindAll(ctx context.Context, key string) []*domain.URL {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
 
 	result := make([]*domain.URL, 0)
-	query := "SELECT id,orig_url, user_id FROM public.urls WHERE user_id = $1;"
-
-	rows, err := d.conn.Query(query, key)
+	rows, err := d.pool.Query(ctx, queries.FindAll, key)
 	if err != nil {
 		return result
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		url := domain.URL{}
-		err = rows.Scan(&url.Short, &url.Orig, &url.Owner)
+		url, err := sqlstore.ScanURL(rows)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return result
-			}
 			return []*domain.URL{}
 		}
 		result = append(result, &url)
 	}
+	if rows.Err() != nil {
+		return []*domain.URL{}
+	}
+	return result
+}
+
+// FindPage uses keyset pagination over (created_at, id), so deep pages cost the same as the first one
+func (d *DB) FindPage(ctx context.Context, key string, query usecase.PageQuery) (usecase.Page, error) {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
 
-	err = rows.Err()
+	sql, args := queries.FindPage(key, query)
+	rows, err := d.pool.Query(ctx, sql, args...)
 	if err != nil {
-		log.Println(err)
+		return usecase.Page{}, err
 	}
-	return result
+	defer rows.Close()
+
+	page := usecase.Page{URLs: make([]*domain.URL, 0, query.Limit)}
+	for rows.Next() {
+		if len(page.URLs) == query.Limit {
+			last := page.URLs[len(page.URLs)-1]
+			page.Next = &usecase.Cursor{CreatedAt: last.CreatedAt, Short: last.Short}
+			break
+		}
+		url, err := sqlstore.ScanURL(rows)
+		if err != nil {
+			return usecase.Page{}, err
+		}
+		page.URLs = append(page.URLs, &url)
+	}
+	return page, rows.Err()
 }
 
-func (d *DB) Close() error {
-	return d.conn.Close()
+// exportFetchSize is a number of rows fetched from export cursor at once
+const exportFetchSize = 1000
+
+// ForEach reads user links through a server side cursor, so only exportFetchSize rows are held at once
+func (d *DB) ForEach(ctx context.Context, key string, fn func(*domain.URL) error) error {
+	return d.iterate(ctx, fn, queries.FindAll, key)
+}
+
+func (d *DB) Dump(ctx context.Context, fn func(*domain.URL) error) error {
+	return d.iterate(ctx, fn, queries.Dump)
+}
+
+// iterate runs query through a cursor, query must select id, orig_url, user_id and created_at.
+// Query timeout bounds every fetch, not the whole iteration which lasts as long as fn is slow
+func (d *DB) iterate(ctx context.Context, fn func(*domain.URL) error, query string, args ...interface{}) error {
+
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	fetchCtx, cancel := d.timeout(ctx)
+	_, err = tx.Exec(fetchCtx, `DECLARE export_cursor NO SCROLL CURSOR FOR `+query, args...)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	batch := make([]domain.URL, 0, exportFetchSize)
+	for {
+		batch, err = d.fetch(ctx, tx, batch[:0])
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			if err = fn(&batch[i]); err != nil {
+				return err
+			}
+		}
+		if len(batch) < exportFetchSize {
+			break
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// fetch reads the next chunk of export cursor, rows are read out before fn is called
+// since connection can't run other statements while rows are open
+func (d *DB) fetch(ctx context.Context, tx pgx.Tx, batch []domain.URL) ([]domain.URL, error) {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
+
+	rows, err := tx.Query(ctx, "FETCH "+strconv.Itoa(exportFetchSize)+" FROM export_cursor")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		url, err := sqlstore.ScanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, url)
+	}
+	return batch, rows.Err()
 }
 
-func (d *DB) Ping() error {
-	return d.conn.Ping()
+func (d *DB) Delete(ctx context.Context, key string) error {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
+
+	result, err := d.pool.Exec(ctx, queries.Delete, key)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("key %v not exists: %w", key, usecase.ErrNotFound)
+	}
+	return nil
 }
 
-func (d *DB) createTablesIfNotExits() {
-	_, err := d.conn.Exec(`CREATE TABLE IF NOT EXISTS public.users (
-    											id TEXT NOT NULL,
-												CONSTRAINT user_constraint PRIMARY KEY (id));
+func (d *DB) Reassign(ctx context.Context, key string, owner string) error {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
 
-						   CREATE TABLE IF NOT EXISTS public.urls (
-                                 id TEXT NOT NULL,
-                                 orig_url TEXT NOT NULL,
-                                 user_id TEXT NOT NULL,
-                                 CONSTRAINT url_constraint PRIMARY KEY (id),
-                                 CONSTRAINT orig_url_constraint UNIQUE (user_id, orig_url),
-                                 FOREIGN KEY (user_id) REFERENCES public.users (id));`)
+	tx, err := d.pool.Begin(ctx)
 	if err != nil {
-		log.Println(err.Error())
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, queries.RegisterUser, owner)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(ctx, queries.Reassign, key, owner)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("key %v not exists: %w", key, usecase.ErrNotFound)
+	}
+	return tx.Commit(ctx)
+}
+
+// Update locks the link, so concurrent updates of it number versions one after another
+func (d *DB) Update(ctx context.Context, key string, orig string, at time.Time) error {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
+
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var prev, owner string
+	err = tx.QueryRow(ctx, queries.LockURL, key).Scan(&prev, &owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("key %v not exists: %w", key, usecase.ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if prev == orig {
+		return nil
+	}
+
+	var existing string
+	err = tx.QueryRow(ctx, queries.FindShort, owner, orig).Scan(&existing)
+	if err == nil {
+		return sqlstore.AlreadyExists(existing, orig)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	if _, err = tx.Exec(ctx, queries.InsertVersion, key, prev, at.UTC()); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, queries.UpdateOrig, key, orig); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Click is a conditional update, so concurrent clicks are counted down one after another by the row lock
+func (d *DB) Click(ctx context.Context, key string) error {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
+
+	result, err := d.pool.Exec(ctx, queries.Click, key)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() > 0 {
+		return nil
+	}
+
+	var maxClicks int
+	err = d.pool.QueryRow(ctx, queries.ClickLimit, key).Scan(&maxClicks)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("key %v not exists: %w", key, usecase.ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	return sqlstore.NotClicked(key, maxClicks)
+}
+
+func (d *DB) History(ctx context.Context, key string) ([]domain.Version, error) {
+	if _, err := d.FindByKey(ctx, key); err != nil {
+		return nil, err
+	}
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
+
+	rows, err := d.pool.Query(ctx, queries.History, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]domain.Version, 0)
+	for rows.Next() {
+		var version domain.Version
+		if err = rows.Scan(&version.Orig, &version.ReplacedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, version)
+	}
+	return history, rows.Err()
+}
+
+func (d *DB) CountUsers(ctx context.Context) (int, error) {
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
+
+	var count int
+	err := d.pool.QueryRow(ctx, queries.CountUsers).Scan(&count)
+	return count, err
+}
+
+// Close waits for acquired connections to be released
+func (d *DB) Close() error {
+	d.pool.Close()
+	return nil
+}
+
+func (d *DB) Ping(ctx context.Context) error {
+	if d == nil {
+		return errors.New("database is not connected")
 	}
+	ctx, cancel := d.timeout(ctx)
+	defer cancel()
+	return d.pool.Ping(ctx)
 }
@@ -0,0 +1,12 @@
+//go:build !go1.20
+
+package replication
+
+import (
+	"net/http"
+	"time"
+)
+
+// extendWriteDeadline can't move deadline of older Go servers,
+// stream is cut by server write timeout then and follower reconnects
+func extendWriteDeadline(http.ResponseWriter, time.Duration) {}
@@ -0,0 +1,13 @@
+//go:build go1.20
+
+package replication
+
+import (
+	"net/http"
+	"time"
+)
+
+// extendWriteDeadline keeps server write timeout from cutting a stream which is still written
+func extendWriteDeadline(writer http.ResponseWriter, d time.Duration) {
+	_ = http.NewResponseController(writer).SetWriteDeadline(time.Now().Add(d))
+}
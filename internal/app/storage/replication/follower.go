@@ -0,0 +1,183 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reconnect backoff of follower
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// Replica is storage follower applies leader records to
+type Replica interface {
+	LogSize() int64
+	ApplyLog(line []byte) (string, error)
+}
+
+// Stats tell how far follower is behind leader
+type Stats struct {
+	Leader    string `json:"leader"`
+	Connected bool   `json:"connected"`
+	// AppliedOffset is the size of follower log, LeaderOffset is the size of leader log last heard of
+	AppliedOffset int64 `json:"applied_offset"`
+	LeaderOffset  int64 `json:"leader_offset"`
+	LagBytes      int64 `json:"lag_bytes"`
+	// LagSeconds is time since follower last had every record of leader, zero while it has
+	LagSeconds float64 `json:"lag_seconds"`
+	// Applied are records applied since start
+	Applied    int64  `json:"applied"`
+	Reconnects int64  `json:"reconnects"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// Follower tails leader log and applies its records to replica
+type Follower struct {
+	leader  string
+	replica Replica
+	options
+
+	mutex    sync.Mutex
+	stats    Stats
+	caughtUp time.Time
+}
+
+// NewFollower follows leader at its base URL
+func NewFollower(leader string, replica Replica, opts ...Option) *Follower {
+	return &Follower{
+		leader:   strings.TrimSuffix(leader, "/"),
+		replica:  replica,
+		options:  newOptions(opts),
+		stats:    Stats{Leader: leader},
+		caughtUp: time.Now(),
+	}
+}
+
+// Run follows leader until ctx is done, it reconnects with backoff when stream breaks
+func (f *Follower) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		progressed, err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.stats.Connected = false
+		f.stats.Reconnects++
+		if err != nil {
+			f.stats.LastError = err.Error()
+		}
+		f.mutex.Unlock()
+		log.Printf("replication from %v is broken, reconnecting in %v: %v", f.leader, backoff, err)
+
+		if progressed {
+			backoff = minBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if !progressed && backoff < maxBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// follow reads one stream, progressed tells if leader was heard of
+func (f *Follower) follow(ctx context.Context) (progressed bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// leader which is not heard of for three heartbeats is gone
+	silence := 3 * f.heartbeat
+	watchdog := time.AfterFunc(silence, cancel)
+	defer watchdog.Stop()
+
+	from := f.replica.LogSize()
+	url := f.leader + Path + "?from=" + strconv.FormatInt(from, 10)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if f.token != "" {
+		request.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	response, err := f.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		detail := problemDetail(response.Header.Get("Content-Type"), message)
+		return false, fmt.Errorf("leader answered %v: %v", response.Status, strings.TrimSpace(detail))
+	}
+
+	f.mutex.Lock()
+	f.stats.Connected = true
+	f.mutex.Unlock()
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var next frame
+		if err = decoder.Decode(&next); err != nil {
+			return progressed, err
+		}
+		watchdog.Reset(silence)
+		progressed = true
+
+		applied := f.replica.LogSize()
+		if next.Offset != applied {
+			return progressed, fmt.Errorf("leader sent record at %v, but follower log is %v bytes", next.Offset, applied)
+		}
+		if len(next.Record) > 0 {
+			short, err := f.replica.ApplyLog(next.Record)
+			if err != nil {
+				return progressed, err
+			}
+			if f.applied != nil {
+				f.applied(short)
+			}
+			applied = f.replica.LogSize()
+		}
+		f.heard(applied, next.Size, len(next.Record) > 0)
+	}
+}
+
+func (f *Follower) heard(applied, leader int64, record bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.stats.AppliedOffset = applied
+	f.stats.LeaderOffset = leader
+	if record {
+		f.stats.Applied++
+	}
+	if applied >= leader {
+		f.caughtUp = time.Now()
+	}
+}
+
+// Stats returns current lag
+func (f *Follower) Stats() Stats {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	stats := f.stats
+	if stats.LeaderOffset > stats.AppliedOffset {
+		stats.LagBytes = stats.LeaderOffset - stats.AppliedOffset
+	}
+	if !stats.Connected || stats.LagBytes > 0 {
+		stats.LagSeconds = time.Since(f.caughtUp).Seconds()
+	}
+	return stats
+}
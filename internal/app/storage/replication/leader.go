@@ -0,0 +1,202 @@
+// Package replication copies append log of file storage from a leader instance to followers
+package replication
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+// Path is where leader serves its log
+const Path = "/replication/log"
+
+// DefaultHeartbeat is how often leader tells an idle follower the size of its log
+const DefaultHeartbeat = 5 * time.Second
+
+// frame is a line of replication stream, it holds a record of leader log written at offset
+// or, as a heartbeat, no record and offset the follower is expected to be at. Record is
+// sent as bytes, so follower log stays a byte to byte copy and offsets of both logs match
+type frame struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Record []byte `json:"record,omitempty"`
+}
+
+// Log is append log leader streams
+type Log interface {
+	LogSize() int64
+	LogChanged() <-chan struct{}
+	ReadLog(ctx context.Context, from int64, fn func(offset int64, line []byte) error) (int64, error)
+}
+
+type options struct {
+	token     string
+	heartbeat time.Duration
+	client    *http.Client
+	applied   func(short string)
+}
+
+// Option configures leader or follower
+type Option func(*options)
+
+// WithToken makes leader serve its log to followers sending the token only,
+// leader without a token serves nobody as the log holds owners and originals of every link
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// WithHeartbeat sets how often leader sends heartbeats, follower reconnects after three missed ones
+func WithHeartbeat(heartbeat time.Duration) Option {
+	return func(o *options) {
+		if heartbeat > 0 {
+			o.heartbeat = heartbeat
+		}
+	}
+}
+
+// WithClient sets HTTP client follower connects with, it must not time out streams
+func WithClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithApplied is called with id of every link follower changes, caches in front of it are invalidated so
+func WithApplied(fn func(short string)) Option {
+	return func(o *options) {
+		o.applied = fn
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{heartbeat: DefaultHeartbeat, client: http.DefaultClient}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Leader streams its log to followers from offset they ask for,
+// the stream goes on with records written later until follower disconnects
+type Leader struct {
+	log Log
+	options
+}
+
+func NewLeader(log Log, opts ...Option) *Leader {
+	return &Leader{log: log, options: newOptions(opts)}
+}
+
+func (l *Leader) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	given := request.Header.Get("Authorization")
+	valid := subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+l.token)) == 1
+	if !valid || l.token == "" {
+		writeProblem(writer, request, http.StatusUnauthorized, usecase.KindUnauthorized, "replication token is wrong")
+		return
+	}
+	var from int64
+	if param := request.URL.Query().Get("from"); param != "" {
+		var err error
+		if from, err = strconv.ParseInt(param, 10, 64); err != nil {
+			writeProblem(writer, request, http.StatusBadRequest, usecase.KindInvalidInput, "from must be a log offset")
+			return
+		}
+	}
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writeProblem(writer, request, http.StatusInternalServerError, usecase.KindInternal, "streaming is not supported")
+		return
+	}
+
+	ctx := request.Context()
+	ticker := time.NewTicker(l.heartbeat)
+	defer ticker.Stop()
+
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(writer)
+	started := false
+	for {
+		extendWriteDeadline(writer, 3*l.heartbeat)
+		// taken before reading, so records written meanwhile wake the loop up
+		changed := l.log.LogChanged()
+		next, err := l.log.ReadLog(ctx, from, func(offset int64, line []byte) error {
+			started = true
+			extendWriteDeadline(writer, 3*l.heartbeat)
+			return encoder.Encode(frame{Offset: offset, Size: l.log.LogSize(), Record: line})
+		})
+		switch {
+		case err != nil && !started && errors.Is(err, storage.ErrLogDiverged):
+			writeProblem(writer, request, http.StatusConflict, usecase.KindConflict, err.Error())
+			return
+		case err != nil && !started && !isContextErr(err):
+			log.Printf("replication stream from %v failed: %v", from, err)
+			writeProblem(writer, request, http.StatusInternalServerError, usecase.KindInternal, "log can not be read")
+			return
+		case err != nil:
+			if !isContextErr(err) {
+				log.Printf("replication stream from %v stopped: %v", from, err)
+			}
+			return
+		}
+		from = next
+
+		started = true
+		if err = encoder.Encode(frame{Offset: from, Size: l.log.LogSize()}); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// ErrReadOnly is returned for writes to follower storage, followers forward writes to leader
+var ErrReadOnly = fmt.Errorf("follower storage is read only, writes go to leader: %w", usecase.ErrReadOnly)
+
+// readOnly is follower storage, links change by replication only
+type readOnly struct {
+	usecase.Repository
+}
+
+// ReadOnly rejects writes to repo with ErrReadOnly
+func ReadOnly(repo usecase.Repository) usecase.Repository {
+	return readOnly{repo}
+}
+
+func (r readOnly) Store(context.Context, *domain.URL) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) BatchWrite(context.Context, []domain.URL) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) Update(context.Context, string, string, time.Time) error {
+	return ErrReadOnly
+}
+
+// Click is a write too, so links with limited clicks are followed on leader
+func (r readOnly) Click(context.Context, string) error {
+	return ErrReadOnly
+}
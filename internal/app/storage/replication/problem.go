@@ -0,0 +1,45 @@
+package replication
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+const problemContentType = "application/problem+json"
+
+// problem is a RFC 7807 error response body, the same the rest of API answers with
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// writeProblem answers with problem+json body of given status, kind names its type
+func writeProblem(writer http.ResponseWriter, request *http.Request, status int, kind usecase.ErrorKind, detail string) {
+	marshaled, _ := json.Marshal(problem{
+		Type:     "/problems/" + kind.String(),
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: request.URL.RequestURI(),
+	})
+	writer.Header().Set("Content-Type", problemContentType)
+	writer.WriteHeader(status)
+	if _, err := writer.Write(marshaled); err != nil {
+		log.Printf("error while writing answer: %v", err)
+	}
+}
+
+// problemDetail takes detail out of problem+json body, other bodies are taken as they are
+func problemDetail(contentType string, body []byte) string {
+	var p problem
+	if contentType == problemContentType && json.Unmarshal(body, &p) == nil && p.Detail != "" {
+		return p.Detail
+	}
+	return string(body)
+}
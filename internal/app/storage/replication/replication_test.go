@@ -0,0 +1,269 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/handler"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openLog(t *testing.T, name string) *storage.PersistentStorage {
+	t.Helper()
+	file, err := storage.NewPersistentStorage(filepath.Join(t.TempDir(), name))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = file.Close() })
+	return file
+}
+
+// testToken is what leaders of tests serve their logs with, unless options say otherwise
+const testToken = "secret"
+
+func serveLeader(t *testing.T, leader *storage.PersistentStorage, opts ...Option) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle(Path, NewLeader(leader, append([]Option{WithToken(testToken)}, opts...)...))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func follow(t *testing.T, follower *Follower) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		follower.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func store(t *testing.T, repo usecase.Repository, i int) {
+	t.Helper()
+	url := &domain.URL{Short: fmt.Sprintf("s%v", i), Orig: fmt.Sprintf("http://%v.com/", i), Owner: "u1"}
+	require.NoError(t, repo.Store(context.Background(), url))
+}
+
+func TestFollower_Replicates(t *testing.T) {
+	ctx := context.Background()
+	leader := openLog(t, "leader.log")
+	// records written before follower connects are caught up with
+	store(t, leader, 0)
+	store(t, leader, 1)
+	server := serveLeader(t, leader, WithHeartbeat(50*time.Millisecond))
+
+	replica := openLog(t, "follower.log")
+	var mutex sync.Mutex
+	var applied []string
+	follower := NewFollower(server.URL, replica, WithToken(testToken), WithHeartbeat(50*time.Millisecond), WithApplied(func(short string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		applied = append(applied, short)
+	}))
+	follow(t, follower)
+
+	require.Eventually(t, func() bool {
+		return replica.LogSize() == leader.LogSize()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// records written later are streamed
+	store(t, leader, 2)
+	require.NoError(t, leader.Reassign(ctx, "s1", "u2"))
+	require.NoError(t, leader.Delete(ctx, "s0"))
+	require.NoError(t, leader.Update(ctx, "s2", "http://changed.com/", time.Now()))
+	require.Eventually(t, func() bool {
+		stats := follower.Stats()
+		return stats.Connected && stats.AppliedOffset == leader.LogSize() && stats.LagBytes == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err := replica.FindByKey(ctx, "s0")
+	assert.ErrorIs(t, err, usecase.ErrNotFound)
+	found, err := replica.FindByKey(ctx, "s1")
+	require.NoError(t, err)
+	assert.Equal(t, "u2", found.Owner)
+	assert.Len(t, replica.FindAll(ctx, "u1"), 1)
+	found, err = replica.FindByKey(ctx, "s2")
+	require.NoError(t, err)
+	assert.Equal(t, "http://changed.com/", found.Orig)
+	history, err := replica.History(ctx, "s2")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "http://2.com/", history[0].Orig)
+
+	stats := follower.Stats()
+	assert.Equal(t, int64(6), stats.Applied)
+	assert.Zero(t, stats.LagSeconds)
+	mutex.Lock()
+	assert.Equal(t, []string{"s0", "s1", "s2", "s1", "s0", "s2"}, applied)
+	mutex.Unlock()
+}
+
+func TestFollower_ResumesAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	leader := openLog(t, "leader.log")
+	server := serveLeader(t, leader, WithHeartbeat(50*time.Millisecond))
+	path := filepath.Join(t.TempDir(), "follower.log")
+
+	replica, err := storage.NewPersistentStorage(path)
+	require.NoError(t, err)
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		NewFollower(server.URL, replica, WithToken(testToken), WithHeartbeat(50*time.Millisecond)).Run(runCtx)
+		close(done)
+	}()
+	store(t, leader, 0)
+	require.Eventually(t, func() bool {
+		return replica.LogSize() == leader.LogSize()
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+	require.NoError(t, replica.Close())
+
+	// follower goes on from the end of its own log
+	store(t, leader, 1)
+	replica, err = storage.NewPersistentStorage(path)
+	require.NoError(t, err)
+	defer replica.Close()
+	follower := NewFollower(server.URL, replica, WithToken(testToken), WithHeartbeat(50*time.Millisecond))
+	follow(t, follower)
+	require.Eventually(t, func() bool {
+		return replica.LogSize() == leader.LogSize()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, replica.FindAll(ctx, "u1"), 2)
+	assert.Equal(t, int64(1), follower.Stats().Applied)
+}
+
+func TestFollower_Rejected(t *testing.T) {
+	leader := openLog(t, "leader.log")
+	store(t, leader, 0)
+	server := serveLeader(t, leader)
+
+	// wrong token
+	follower := NewFollower(server.URL, openLog(t, "follower.log"), WithToken("wrong"))
+	_, err := follower.follow(context.Background())
+	assert.ErrorContains(t, err, "401")
+	assert.ErrorContains(t, err, "replication token is wrong", "detail of problem is reported")
+
+	// no token
+	follower = NewFollower(server.URL, openLog(t, "follower.log"))
+	_, err = follower.follow(context.Background())
+	assert.ErrorContains(t, err, "401")
+
+	// leader without a token serves nobody, not even followers without one
+	open := serveLeader(t, leader, WithToken(""))
+	follower = NewFollower(open.URL, openLog(t, "follower.log"))
+	_, err = follower.follow(context.Background())
+	assert.ErrorContains(t, err, "401")
+
+	// follower log which is not a copy of leader one
+	diverged := openLog(t, "diverged.log")
+	store(t, diverged, 1)
+	store(t, diverged, 2)
+	follower = NewFollower(server.URL, diverged, WithToken(testToken))
+	_, err = follower.follow(context.Background())
+	assert.ErrorContains(t, err, "409")
+}
+
+func TestLeader_Problems(t *testing.T) {
+	server := serveLeader(t, openLog(t, "leader.log"))
+
+	tests := []struct {
+		name   string
+		query  string
+		token  string
+		status int
+		typ    string
+	}{
+		{name: "wrong token", token: "wrong", status: http.StatusUnauthorized, typ: "/problems/unauthorized"},
+		{name: "wrong offset", query: "?from=x", token: testToken, status: http.StatusBadRequest, typ: "/problems/invalid-input"},
+		{name: "offset past log", query: "?from=100", token: testToken, status: http.StatusConflict, typ: "/problems/conflict"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, server.URL+Path+tt.query, nil)
+			require.NoError(t, err)
+			request.Header.Set("Authorization", "Bearer "+tt.token)
+			response, err := http.DefaultClient.Do(request)
+			require.NoError(t, err)
+			defer response.Body.Close()
+
+			assert.Equal(t, tt.status, response.StatusCode)
+			assert.Equal(t, problemContentType, response.Header.Get("Content-Type"))
+			var p problem
+			require.NoError(t, json.NewDecoder(response.Body).Decode(&p))
+			assert.Equal(t, tt.typ, p.Type)
+			assert.Equal(t, tt.status, p.Status)
+			assert.NotEmpty(t, p.Detail)
+		})
+	}
+}
+
+func TestFollower_ForwardsClicks(t *testing.T) {
+	ctx := context.Background()
+	leaderLog := openLog(t, "leader.log")
+	require.NoError(t, leaderLog.Store(ctx, &domain.URL{Short: "s0", Orig: "http://0.com/", Owner: "u1", MaxClicks: 2, ClicksLeft: 2}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/", handler.NewAppRouter("http://leader/", usecase.NewShorten(domain.NewShortener(nil), leaderLog), usecase.NewLiveliness(nil),
+		handler.WithReplicationLog(Path, NewLeader(leaderLog, WithToken(testToken), WithHeartbeat(50*time.Millisecond)))))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	leaderURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	replica := openLog(t, "follower.log")
+	follow(t, NewFollower(server.URL, replica, WithToken(testToken), WithHeartbeat(50*time.Millisecond)))
+	require.Eventually(t, func() bool {
+		return replica.LogSize() == leaderLog.LogSize()
+	}, 5*time.Second, 10*time.Millisecond)
+	router := handler.NewAppRouter("http://follower/", usecase.NewShorten(domain.NewShortener(nil), ReadOnly(replica)), usecase.NewLiveliness(nil),
+		handler.WithWriteForwarding(leaderURL))
+
+	// clicks are counted down by leader and replicated back
+	for _, want := range []int{http.StatusTemporaryRedirect, http.StatusTemporaryRedirect, http.StatusGone} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/s0", nil))
+		assert.Equal(t, want, w.Code)
+	}
+	found, err := leaderLog.FindByKey(ctx, "s0")
+	require.NoError(t, err)
+	assert.Zero(t, found.ClicksLeft)
+	require.Eventually(t, func() bool {
+		found, err := replica.FindByKey(ctx, "s0")
+		return err == nil && found.ClicksLeft == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFollower_Lag(t *testing.T) {
+	follower := NewFollower("http://leader", openLog(t, "follower.log"))
+	follower.heard(10, 30, true)
+	stats := follower.Stats()
+	assert.Equal(t, int64(20), stats.LagBytes)
+	assert.Positive(t, stats.LagSeconds)
+	assert.Equal(t, int64(1), stats.Applied)
+}
+
+func TestReadOnly(t *testing.T) {
+	repo := ReadOnly(openLog(t, "follower.log"))
+	assert.ErrorIs(t, repo.Store(context.Background(), &domain.URL{Short: "a"}), ErrReadOnly)
+	assert.ErrorIs(t, repo.BatchWrite(context.Background(), []domain.URL{{Short: "a"}}), ErrReadOnly)
+	assert.ErrorIs(t, repo.Update(context.Background(), "a", "http://a.com/", time.Now()), ErrReadOnly)
+	assert.ErrorIs(t, repo.Click(context.Background(), "a"), usecase.ErrReadOnly)
+}
@@ -0,0 +1,477 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+// ShardedMemoryStorage spreads links over independently locked shards by short id
+// and user indexes over other shards by owner, so writers of different links
+// and readers of different users do not wait for each other.
+// Stored links are never changed in place, an update replaces the link, so FindAll,
+// FindPage and ForEach give out stored links without copying them. Callers must not change them
+type ShardedMemoryStorage struct {
+	links []linkShard
+	users []userShard
+	mask  uint32
+}
+
+type linkShard struct {
+	mutex sync.RWMutex
+	links map[string]*domain.URL
+	// history holds previous originals of changed links from the oldest one
+	history map[string][]domain.Version
+}
+
+type userShard struct {
+	mutex sync.RWMutex
+	// links of every user ordered by creation time and short id
+	links     map[string][]*domain.URL
+	originals map[original]string
+}
+
+// NewShardedMemoryStorage makes a storage of shards rounded up to a power of two
+func NewShardedMemoryStorage(shards int) *ShardedMemoryStorage {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	s := &ShardedMemoryStorage{
+		links: make([]linkShard, n),
+		users: make([]userShard, n),
+		mask:  uint32(n - 1),
+	}
+	for i := range s.links {
+		s.links[i].links = make(map[string]*domain.URL)
+		s.links[i].history = make(map[string][]domain.Version)
+		s.users[i].links = make(map[string][]*domain.URL)
+		s.users[i].originals = make(map[original]string)
+	}
+	return s
+}
+
+// shardOf is FNV-1a of key, it does not allocate unlike hash/fnv
+func (s *ShardedMemoryStorage) shardOf(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h & s.mask
+}
+
+func (s *ShardedMemoryStorage) linkShard(short string) *linkShard {
+	return &s.links[s.shardOf(short)]
+}
+
+// lockUsers locks user shards of owners in shard order, so writers locking
+// two shards at once do not deadlock, unlock releases them
+func (s *ShardedMemoryStorage) lockUsers(owners ...string) (unlock func()) {
+	indexes := make([]int, 0, len(owners))
+	for _, owner := range owners {
+		i := int(s.shardOf(owner))
+		if !containsInt(indexes, i) {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		s.users[i].mutex.Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			s.users[i].mutex.Unlock()
+		}
+	}
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Store reports a link of original the owner has already shortened with ErrAlreadyExists
+func (s *ShardedMemoryStorage) Store(ctx context.Context, url *domain.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stored := *url
+	return s.put(&stored)
+}
+
+// put replaces link by its id and moves it between user indexes. User shards are locked
+// before link shard, the link is looked up first to know its owner and checked again under locks
+func (s *ShardedMemoryStorage) put(url *domain.URL) error {
+	links := s.linkShard(url.Short)
+	for {
+		links.mutex.RLock()
+		prev := links.links[url.Short]
+		links.mutex.RUnlock()
+
+		owners := []string{url.Owner}
+		if prev != nil {
+			owners = append(owners, prev.Owner)
+		}
+		unlock := s.lockUsers(owners...)
+		links.mutex.Lock()
+		if links.links[url.Short] != prev {
+			// changed while shards were locked
+			links.mutex.Unlock()
+			unlock()
+			continue
+		}
+
+		user := &s.users[s.shardOf(url.Owner)]
+		existing, ok := user.originals[original{url.Owner, url.Orig}]
+		if ok && existing != url.Short {
+			links.mutex.Unlock()
+			unlock()
+			return alreadyExists(uniqID(existing), url.Orig)
+		}
+
+		if prev != nil {
+			s.users[s.shardOf(prev.Owner)].remove(prev)
+		}
+		links.links[url.Short] = url
+		user.insert(url)
+
+		links.mutex.Unlock()
+		unlock()
+		return nil
+	}
+}
+
+// insert puts link into its place in user index, links mostly come in creation order
+func (u *userShard) insert(url *domain.URL) {
+	key := original{url.Owner, url.Orig}
+	if _, taken := u.originals[key]; !taken {
+		u.originals[key] = url.Short
+	}
+	if url.Owner == "" {
+		// anonymous links are not listed by user
+		return
+	}
+
+	links := u.links[url.Owner]
+	cursor := usecase.Cursor{CreatedAt: url.CreatedAt, Short: url.Short}
+	pos := sort.Search(len(links), func(i int) bool {
+		return cursor.After(links[i])
+	})
+	links = append(links, nil)
+	copy(links[pos+1:], links[pos:])
+	links[pos] = url
+	u.links[url.Owner] = links
+}
+
+// remove deletes link from user index keeping it ordered and frees its original
+func (u *userShard) remove(url *domain.URL) {
+	key := original{url.Owner, url.Orig}
+	if u.originals[key] == url.Short {
+		delete(u.originals, key)
+	}
+	if url.Owner == "" {
+		return
+	}
+
+	links := u.links[url.Owner]
+	pos := sort.Search(len(links), func(i int) bool {
+		cursor := usecase.Cursor{CreatedAt: links[i].CreatedAt, Short: links[i].Short}
+		return !cursor.After(url)
+	})
+	if pos == len(links) || links[pos].Short != url.Short {
+		return
+	}
+	links = append(links[:pos], links[pos+1:]...)
+	if len(links) == 0 {
+		delete(u.links, url.Owner)
+		return
+	}
+	u.links[url.Owner] = links
+}
+
+// BatchWrite writes links one by one, links whose owners have already
+// shortened the same originals are skipped and reported with ErrBatchConflicts
+func (s *ShardedMemoryStorage) BatchWrite(ctx context.Context, urls []domain.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conflicts := make(map[int]usecase.ErrAlreadyExists)
+	for i := range urls {
+		stored := urls[i]
+		err := s.put(&stored)
+		if exists, ok := err.(usecase.ErrAlreadyExists); ok {
+			conflicts[i] = exists
+		}
+	}
+	if len(conflicts) > 0 {
+		return usecase.ErrBatchConflicts{Conflicts: conflicts}
+	}
+	return nil
+}
+
+func (s *ShardedMemoryStorage) FindByKey(_ context.Context, key string) (*domain.URL, error) {
+	links := s.linkShard(key)
+	links.mutex.RLock()
+	url, ok := links.links[key]
+	links.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	// a single link is given as a copy like other storages do
+	found := *url
+	return &found, nil
+}
+
+// userLinks returns user index, the slice is copied but links are not
+func (s *ShardedMemoryStorage) userLinks(owner string) []*domain.URL {
+	user := &s.users[s.shardOf(owner)]
+	user.mutex.RLock()
+	defer user.mutex.RUnlock()
+
+	links := user.links[owner]
+	result := make([]*domain.URL, len(links))
+	copy(result, links)
+	return result
+}
+
+func (s *ShardedMemoryStorage) FindAll(_ context.Context, userKey string) []*domain.URL {
+	return s.userLinks(userKey)
+}
+
+func (s *ShardedMemoryStorage) FindPage(_ context.Context, userKey string, query usecase.PageQuery) (usecase.Page, error) {
+	user := &s.users[s.shardOf(userKey)]
+	user.mutex.RLock()
+	defer user.mutex.RUnlock()
+
+	links := user.links[userKey]
+
+	// start right after the cursor, index is ordered so it is a binary search
+	start, step := 0, 1
+	if query.Desc {
+		start, step = len(links)-1, -1
+	}
+	if query.After != nil {
+		after := sort.Search(len(links), func(i int) bool {
+			return query.After.After(links[i])
+		})
+		start = after
+		if query.Desc {
+			// last one before the cursor, cursor link itself is skipped
+			start = after - 1
+			if start >= 0 && links[start].Short == query.After.Short {
+				start--
+			}
+		}
+	}
+
+	page := usecase.Page{URLs: make([]*domain.URL, 0)}
+	for i := start; i >= 0 && i < len(links); i += step {
+		if !query.Match(links[i]) {
+			continue
+		}
+		if len(page.URLs) == query.Limit {
+			last := page.URLs[len(page.URLs)-1]
+			page.Next = &usecase.Cursor{CreatedAt: last.CreatedAt, Short: last.Short}
+			break
+		}
+		page.URLs = append(page.URLs, links[i])
+	}
+	return page, nil
+}
+
+// ForEach does not hold any lock while fn is called, links stored after the call started are not visited
+func (s *ShardedMemoryStorage) ForEach(ctx context.Context, userKey string, fn func(*domain.URL) error) error {
+	for _, url := range s.userLinks(userKey) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedMemoryStorage) Delete(_ context.Context, key string) error {
+	links := s.linkShard(key)
+	for {
+		links.mutex.RLock()
+		prev, ok := links.links[key]
+		links.mutex.RUnlock()
+		if !ok {
+			return fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+		}
+
+		unlock := s.lockUsers(prev.Owner)
+		links.mutex.Lock()
+		if links.links[key] != prev {
+			links.mutex.Unlock()
+			unlock()
+			continue
+		}
+		delete(links.links, key)
+		delete(links.history, key)
+		s.users[s.shardOf(prev.Owner)].remove(prev)
+		links.mutex.Unlock()
+		unlock()
+		return nil
+	}
+}
+
+func (s *ShardedMemoryStorage) Reassign(ctx context.Context, key string, owner string) error {
+	url, err := s.FindByKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	url.Owner = owner
+	return s.put(url)
+}
+
+// Update replaces the link with a changed copy, locks are taken like put does
+func (s *ShardedMemoryStorage) Update(ctx context.Context, key string, orig string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	links := s.linkShard(key)
+	for {
+		links.mutex.RLock()
+		prev, ok := links.links[key]
+		links.mutex.RUnlock()
+		if !ok {
+			return fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+		}
+		if prev.Orig == orig {
+			return nil
+		}
+
+		unlock := s.lockUsers(prev.Owner)
+		links.mutex.Lock()
+		if links.links[key] != prev {
+			links.mutex.Unlock()
+			unlock()
+			continue
+		}
+
+		user := &s.users[s.shardOf(prev.Owner)]
+		existing, ok := user.originals[original{prev.Owner, orig}]
+		if ok && existing != key {
+			links.mutex.Unlock()
+			unlock()
+			return alreadyExists(uniqID(existing), orig)
+		}
+
+		url := *prev
+		url.Orig = orig
+		user.remove(prev)
+		links.links[key] = &url
+		user.insert(&url)
+		links.history[key] = append(links.history[key], domain.Version{Orig: prev.Orig, ReplacedAt: at})
+
+		links.mutex.Unlock()
+		unlock()
+		return nil
+	}
+}
+
+// Click replaces the link with a copy which has one click less, locks are taken like put does
+func (s *ShardedMemoryStorage) Click(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	links := s.linkShard(key)
+	for {
+		links.mutex.RLock()
+		prev, ok := links.links[key]
+		links.mutex.RUnlock()
+		if !ok {
+			return fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+		}
+		if prev.MaxClicks == 0 {
+			return nil
+		}
+
+		unlock := s.lockUsers(prev.Owner)
+		links.mutex.Lock()
+		if links.links[key] != prev {
+			links.mutex.Unlock()
+			unlock()
+			continue
+		}
+		if prev.ClicksLeft <= 0 {
+			links.mutex.Unlock()
+			unlock()
+			return fmt.Errorf("link %v: %w", key, usecase.ErrExhausted)
+		}
+
+		url := *prev
+		url.ClicksLeft--
+		user := &s.users[s.shardOf(prev.Owner)]
+		user.remove(prev)
+		links.links[key] = &url
+		user.insert(&url)
+
+		links.mutex.Unlock()
+		unlock()
+		return nil
+	}
+}
+
+func (s *ShardedMemoryStorage) History(ctx context.Context, key string) ([]domain.Version, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	links := s.linkShard(key)
+	links.mutex.RLock()
+	defer links.mutex.RUnlock()
+
+	if _, ok := links.links[key]; !ok {
+		return nil, fmt.Errorf("key %v does not exist: %w", key, usecase.ErrNotFound)
+	}
+	history := make([]domain.Version, len(links.history[key]))
+	copy(history, links.history[key])
+	return history, nil
+}
+
+// CountUsers counts users who own links, memory does not know about others
+func (s *ShardedMemoryStorage) CountUsers(_ context.Context) (int, error) {
+	count := 0
+	for i := range s.users {
+		s.users[i].mutex.RLock()
+		count += len(s.users[i].links)
+		s.users[i].mutex.RUnlock()
+	}
+	return count, nil
+}
+
+// Dump visits links shard by shard, no lock is held while fn is called
+func (s *ShardedMemoryStorage) Dump(ctx context.Context, fn func(*domain.URL) error) error {
+	for i := range s.links {
+		shard := &s.links[i]
+		shard.mutex.RLock()
+		links := make([]*domain.URL, 0, len(shard.links))
+		for _, url := range shard.links {
+			links = append(links, url)
+		}
+		shard.mutex.RUnlock()
+
+		for _, url := range links {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(url); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/storagetest"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedMemoryStorage(t *testing.T) {
+	for _, shards := range []int{1, 16} {
+		t.Run(fmt.Sprintf("%v shards", shards), func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) usecase.Repository {
+				return NewShardedMemoryStorage(shards)
+			})
+		})
+	}
+}
+
+func TestShardedMemoryStorage_ReassignAcrossShards(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedMemoryStorage(8)
+	require.NoError(t, s.Store(ctx, &domain.URL{Short: "a", Orig: "http://a.com/", Owner: "u1"}))
+
+	// owners land in different shards, links move between them
+	owners := []string{"u2", "u3", "u4", "u5", "u1"}
+	for _, owner := range owners {
+		require.NoError(t, s.Reassign(ctx, "a", owner))
+	}
+	for _, owner := range owners[:len(owners)-1] {
+		assert.Empty(t, s.FindAll(ctx, owner))
+	}
+	assert.Len(t, s.FindAll(ctx, "u1"), 1)
+	users, err := s.CountUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, users)
+}
+
+// benchmarkMixed runs parallel lookups with a share of writes, links belong to 100 users
+func benchmarkMixed(b *testing.B, repo usecase.Repository, writePercent int) {
+	ctx := context.Background()
+	const preloaded = 10000
+	created := time.Now().UTC()
+	for i := 0; i < preloaded; i++ {
+		url := &domain.URL{
+			Short:     fmt.Sprintf("p%v", i),
+			Orig:      fmt.Sprintf("http://example.com/%v", i),
+			Owner:     fmt.Sprintf("u%v", i%100),
+			CreatedAt: created,
+		}
+		require.NoError(b, repo.Store(ctx, url))
+	}
+
+	var written int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(atomic.AddInt64(&written, 1)))
+		for pb.Next() {
+			if rnd.Intn(100) < writePercent {
+				n := atomic.AddInt64(&written, 1)
+				_ = repo.Store(ctx, &domain.URL{
+					Short:     fmt.Sprintf("w%v", n),
+					Orig:      fmt.Sprintf("http://example.com/w/%v", n),
+					Owner:     fmt.Sprintf("u%v", n%100),
+					CreatedAt: time.Now().UTC(),
+				})
+				continue
+			}
+			_, _ = repo.FindByKey(ctx, fmt.Sprintf("p%v", rnd.Intn(preloaded)))
+		}
+	})
+}
+
+func BenchmarkStorage_Mixed(b *testing.B) {
+	stores := []struct {
+		name string
+		make func() usecase.Repository
+	}{
+		{"memory", func() usecase.Repository { return newURLMemoryStorage() }},
+		{"sharded-64", func() usecase.Repository { return NewShardedMemoryStorage(64) }},
+	}
+	for _, writes := range []int{10, 50} {
+		for _, store := range stores {
+			b.Run(fmt.Sprintf("%v/%v%%-writes", store.name, writes), func(b *testing.B) {
+				benchmarkMixed(b, store.make(), writes)
+			})
+		}
+	}
+}
+
+func BenchmarkStorage_FindAll(b *testing.B) {
+	ctx := context.Background()
+	stores := []struct {
+		name string
+		repo usecase.Repository
+	}{
+		{"memory", newURLMemoryStorage()},
+		{"sharded-64", NewShardedMemoryStorage(64)},
+	}
+	for _, store := range stores {
+		urls := make([]domain.URL, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			urls = append(urls, domain.URL{Short: fmt.Sprintf("s%v", i), Orig: fmt.Sprintf("http://example.com/%v", i), Owner: "u1"})
+		}
+		require.NoError(b, store.repo.BatchWrite(ctx, urls))
+
+		b.Run(store.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					store.repo.FindAll(ctx, "u1")
+				}
+			})
+		})
+	}
+}
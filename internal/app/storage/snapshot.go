@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+)
+
+// Snapshot is a memory storage loaded from a dump file, like the one shortenctl dump writes,
+// changes are written back to the file on Close only
+type Snapshot struct {
+	*URLMemoryStorage
+	path string
+	// dirty is set by concurrent writers, so it is accessed atomically
+	dirty int32
+}
+
+// NewSnapshot loads links from path, a missing file is an empty snapshot
+func NewSnapshot(path string) (*Snapshot, error) {
+	memory := newURLMemoryStorage()
+
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+		if err = replay(file, memory, nil); err != nil {
+			return nil, err
+		}
+	}
+	return &Snapshot{URLMemoryStorage: memory, path: path}, nil
+}
+
+func (s *Snapshot) Store(ctx context.Context, url *domain.URL) error {
+	atomic.StoreInt32(&s.dirty, 1)
+	return s.URLMemoryStorage.Store(ctx, url)
+}
+
+func (s *Snapshot) BatchWrite(ctx context.Context, urls []domain.URL) error {
+	atomic.StoreInt32(&s.dirty, 1)
+	return s.URLMemoryStorage.BatchWrite(ctx, urls)
+}
+
+func (s *Snapshot) Delete(ctx context.Context, key string) error {
+	atomic.StoreInt32(&s.dirty, 1)
+	return s.URLMemoryStorage.Delete(ctx, key)
+}
+
+func (s *Snapshot) Reassign(ctx context.Context, key string, owner string) error {
+	atomic.StoreInt32(&s.dirty, 1)
+	return s.URLMemoryStorage.Reassign(ctx, key, owner)
+}
+
+func (s *Snapshot) Update(ctx context.Context, key string, orig string, at time.Time) error {
+	atomic.StoreInt32(&s.dirty, 1)
+	return s.URLMemoryStorage.Update(ctx, key, orig, at)
+}
+
+func (s *Snapshot) Click(ctx context.Context, key string) error {
+	atomic.StoreInt32(&s.dirty, 1)
+	return s.URLMemoryStorage.Click(ctx, key)
+}
+
+// Close writes changed snapshot to a temporary file and replaces the old one with it,
+// so a failed write never leaves a half written snapshot
+func (s *Snapshot) Close() error {
+	if atomic.LoadInt32(&s.dirty) == 0 {
+		return nil
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	buffered := bufio.NewWriter(file)
+	encoder := json.NewEncoder(buffered)
+	err = s.Dump(context.Background(), func(url *domain.URL) error {
+		return s.encode(encoder, url)
+	})
+	if err != nil {
+		return err
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(file.Name(), s.path); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&s.dirty, 0)
+	return nil
+}
+
+// encode writes a link, a changed one is written with its first original and updates
+// which replaced it, so history is restored by replay. Unchanged links are plain URLs like a dump has
+func (s *Snapshot) encode(encoder *json.Encoder, url *domain.URL) error {
+	history, err := s.History(context.Background(), url.Short)
+	if err != nil || len(history) == 0 {
+		// deleted meanwhile or never changed
+		return encoder.Encode(url)
+	}
+	first := *url
+	first.Orig = history[0].Orig
+	if err = encoder.Encode(first); err != nil {
+		return err
+	}
+	for i, version := range history {
+		next := *url
+		if i+1 < len(history) {
+			next.Orig = history[i+1].Orig
+		}
+		at := version.ReplacedAt
+		if err = encoder.Encode(record{URL: next, Op: opUpdate, At: &at}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/sqlstore"
+)
+
+// LatestSchemaVersion is the version schema is migrated to on open
+func LatestSchemaVersion() (int, error) {
+	return sqlstore.LatestVersion(sqlstore.SQLite)
+}
+
+// Migrate applies every migration which is not applied yet
+func (d *DB) Migrate(ctx context.Context) error {
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		return fmt.Errorf("%w: %v", sqlstore.ErrMigration, err)
+	}
+	return d.MigrateTo(ctx, latest)
+}
+
+// MigrateTo applies up migrations or rolls back down ones until schema is of given version.
+// SQLite changes schema transactionally, so all steps run in one immediate transaction,
+// which also keeps processes opening the file at once from applying the same migration twice
+func (d *DB) MigrateTo(ctx context.Context, version int) error {
+	migrations, err := sqlstore.Migrations(sqlstore.SQLite)
+	if err == nil {
+		err = d.write(ctx, func(tx *sql.Tx) error {
+			return migrateTo(ctx, tx, migrations, version)
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", sqlstore.ErrMigration, err)
+	}
+	return nil
+}
+
+func migrateTo(ctx context.Context, tx *sql.Tx, migrations []sqlstore.Migration, version int) error {
+	_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+									version    INTEGER NOT NULL PRIMARY KEY,
+									name       TEXT NOT NULL,
+									applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	steps, err := sqlstore.Plan(migrations, current, version)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		log.Printf("running %v", step)
+		// a script without arguments may hold several statements
+		if _, err = tx.ExecContext(ctx, step.Script()); err != nil {
+			return fmt.Errorf("%v: %v", step, err)
+		}
+		record, args := step.Record(sqlstore.SQLite)
+		if _, err = tx.ExecContext(ctx, record, args...); err != nil {
+			return fmt.Errorf("%v: %v", step, err)
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the last applied migration, 0 if there is none
+func (d *DB) SchemaVersion(ctx context.Context) (int, error) {
+	var exists bool
+	err := d.db.QueryRowContext(ctx, `SELECT count(*) > 0 FROM sqlite_master
+										WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return schemaVersion(ctx, d.db)
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func schemaVersion(ctx context.Context, q queryer) (int, error) {
+	var version int
+	err := q.QueryRowContext(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
@@ -0,0 +1,653 @@
+// Package sqlite keeps links in a single SQLite database file, queries
+// and migrations are shared with postgres through sqlstore
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/sqlstore"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/mattn/go-sqlite3"
+)
+
+// queries are shared with other SQL storages
+var queries = sqlstore.NewQueries(sqlstore.SQLite)
+
+const (
+	// DefaultBusyTimeout is how long a connection waits for the write lock held by another one
+	DefaultBusyTimeout = 5 * time.Second
+	// busyRetries bounds attempts of a transaction which is still busy after the timeout
+	busyRetries = 3
+	// exportFetchSize is a number of links read at once by ForEach and Dump
+	exportFetchSize = 1000
+)
+
+type DB struct {
+	db          *sql.DB
+	busyTimeout time.Duration
+
+	stmtMutex sync.Mutex
+	stmts     map[string]*sql.Stmt
+}
+
+// Option tunes database connections
+type Option func(*DB)
+
+// WithBusyTimeout sets how long a writer waits for the lock, zero keeps DefaultBusyTimeout
+func WithBusyTimeout(timeout time.Duration) Option {
+	return func(db *DB) {
+		if timeout > 0 {
+			db.busyTimeout = timeout
+		}
+	}
+}
+
+// Open opens database file creating it if needed and migrates its schema to the latest version,
+// errors of migration wrap sqlstore.ErrMigration
+func Open(ctx context.Context, path string, opts ...Option) (*DB, error) {
+	db, err := Connect(ctx, path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Connect opens database file leaving its schema as is
+func Connect(ctx context.Context, path string, opts ...Option) (*DB, error) {
+	if path == "" {
+		return nil, errors.New("sqlite database path is empty")
+	}
+	db := &DB{
+		busyTimeout: DefaultBusyTimeout,
+		stmts:       make(map[string]*sql.Stmt),
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	// WAL lets readers go on while a writer commits, immediate transactions take
+	// the write lock at once, so concurrent writers wait for busy timeout instead of
+	// failing to upgrade a read lock. Every pooled connection gets the same pragmas
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_synchronous", "NORMAL")
+	params.Set("_busy_timeout", strconv.FormatInt(db.busyTimeout.Milliseconds(), 10))
+	params.Set("_foreign_keys", "on")
+	params.Set("_txlock", "immediate")
+
+	var err error
+	db.db, err = sql.Open("sqlite3", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(ctx); err != nil {
+		db.db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// stmt returns a prepared statement of query, statements are prepared once and reused by every call.
+// Statements depending on number of rows are not prepared, so the cache is bounded by variants of queries
+func (d *DB) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	d.stmtMutex.Lock()
+	defer d.stmtMutex.Unlock()
+
+	if stmt, ok := d.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := d.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	d.stmts[query] = stmt
+	return stmt, nil
+}
+
+// txStmt returns a prepared statement of query bound to tx
+func (d *DB) txStmt(ctx context.Context, tx *sql.Tx, query string) (*sql.Stmt, error) {
+	stmt, err := d.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return tx.StmtContext(ctx, stmt), nil
+}
+
+// write runs fn in a transaction. A transaction which is still busy after
+// the busy timeout is retried from scratch a few times while ctx allows,
+// so fn must not keep state of a failed attempt
+func (d *DB) write(ctx context.Context, fn func(*sql.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := d.writeOnce(ctx, fn)
+		if !isBusy(err) || attempt == busyRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		}
+	}
+}
+
+func (d *DB) writeOnce(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isBusy reports if the database is locked by another connection
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// BatchWrite registers users and inserts links in one transaction. Links whose owners
+// have already shortened the same originals are skipped and reported with ErrBatchConflicts
+func (d *DB) BatchWrite(ctx context.Context, urls []domain.URL) error {
+	if len(urls) == 0 {
+		return nil
+	}
+
+	var conflicts map[int]usecase.ErrAlreadyExists
+	err := d.write(ctx, func(tx *sql.Tx) error {
+		if err := registerUsers(ctx, tx, sqlstore.Owners(urls)); err != nil {
+			return fmt.Errorf("error while trying insert user: %w", err)
+		}
+
+		inserted := make(map[string]bool, len(urls))
+		err := sqlstore.Chunks(len(urls), sqlstore.BatchRows, func(start, end int) error {
+			return insertURLs(ctx, tx, urls[start:end], inserted)
+		})
+		if err != nil {
+			return err
+		}
+
+		conflicts, err = findConflicts(ctx, tx, urls, inserted)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return usecase.ErrBatchConflicts{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// insertURLs inserts links with a multi-row statement and marks ids of inserted ones
+func insertURLs(ctx context.Context, tx *sql.Tx, urls []domain.URL, inserted map[string]bool) error {
+	query, args := queries.InsertURLs(urls)
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return err
+		}
+		inserted[id] = true
+	}
+	return rows.Err()
+}
+
+// findConflicts finds links which hold originals of the skipped ones
+func findConflicts(ctx context.Context, tx *sql.Tx, urls []domain.URL, inserted map[string]bool) (map[int]usecase.ErrAlreadyExists, error) {
+	if len(inserted) == len(urls) {
+		return nil, nil
+	}
+
+	skipped := sqlstore.Skipped(urls, inserted)
+	existing := make(map[sqlstore.Original]string)
+	err := sqlstore.Chunks(len(skipped), sqlstore.BatchRows, func(start, end int) error {
+		query, args := queries.FindOriginals(skipped[start:end])
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var k sqlstore.Original
+			var id string
+			if err = rows.Scan(&k.Owner, &k.Orig, &id); err != nil {
+				return err
+			}
+			existing[k] = id
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sqlstore.Conflicts(urls, inserted, existing)
+}
+
+// registerUsers inserts users which are not known yet
+func registerUsers(ctx context.Context, tx *sql.Tx, users []string) error {
+	return sqlstore.Chunks(len(users), sqlstore.BatchRows, func(start, end int) error {
+		query, args := queries.RegisterUsers(users[start:end])
+		_, err := tx.ExecContext(ctx, query, args...)
+		return err
+	})
+}
+
+// RegisterUsers keeps users even if they have no links, so they survive migration
+func (d *DB) RegisterUsers(ctx context.Context, users []string) error {
+	return d.write(ctx, func(tx *sql.Tx) error {
+		return registerUsers(ctx, tx, users)
+	})
+}
+
+// DumpUsers calls fn for every user, including those who have no links
+func (d *DB) DumpUsers(ctx context.Context, fn func(string) error) error {
+	stmt, err := d.stmt(ctx, queries.ListUsers)
+	if err != nil {
+		return err
+	}
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	// users are read out before fn is called, so a slow fn does not hold a connection
+	var users []string
+	for rows.Next() {
+		var user string
+		if err = rows.Scan(&user); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err = fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Store registers user and inserts link in one transaction,
+// a link of original the owner has already shortened is reported with ErrAlreadyExists
+func (d *DB) Store(ctx context.Context, url *domain.URL) error {
+	var id string
+	err := d.write(ctx, func(tx *sql.Tx) error {
+		register, err := d.txStmt(ctx, tx, queries.RegisterUser)
+		if err != nil {
+			return err
+		}
+		if _, err = register.ExecContext(ctx, url.Owner); err != nil {
+			return fmt.Errorf("error while trying insert user: %w", err)
+		}
+
+		insert, err := d.txStmt(ctx, tx, queries.InsertURL)
+		if err != nil {
+			return err
+		}
+		if _, err = insert.ExecContext(ctx, sqlstore.URLValues(url)...); err != nil {
+			return err
+		}
+
+		find, err := d.txStmt(ctx, tx, queries.FindShort)
+		if err != nil {
+			return err
+		}
+		return find.QueryRowContext(ctx, url.Owner, url.Orig).Scan(&id)
+	})
+	if err != nil {
+		return err
+	}
+
+	if id != url.Short {
+		return sqlstore.AlreadyExists(id, url.Orig)
+	}
+	return nil
+}
+
+func (d *DB) FindByKey(ctx context.Context, key string) (*domain.URL, error) {
+	stmt, err := d.stmt(ctx, queries.FindByKey)
+	if err != nil {
+		return nil, err
+	}
+	url, err := sqlstore.ScanURL(stmt.QueryRowContext(ctx, key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("key %v not exists: %w", key, usecase.ErrNotFound)
+		}
+		return nil, err
+	}
+	return &url, nil
+}
+
+func (d *DB) FindAll(ctx context.Context, key string) []*domain.URL {
+	result := make([]*domain.URL, 0)
+	stmt, err := d.stmt(ctx, queries.FindAll)
+	if err != nil {
+		return result
+	}
+	rows, err := stmt.QueryContext(ctx, key)
+	if err != nil {
+		return result
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		url, err := sqlstore.ScanURL(rows)
+		if err != nil {
+			return []*domain.URL{}
+		}
+		result = append(result, &url)
+	}
+	if rows.Err() != nil {
+		return []*domain.URL{}
+	}
+	return result
+}
+
+// FindPage uses keyset pagination over (created_at, id) like postgres does
+func (d *DB) FindPage(ctx context.Context, key string, query usecase.PageQuery) (usecase.Page, error) {
+	sql, args := queries.FindPage(key, query)
+	stmt, err := d.stmt(ctx, sql)
+	if err != nil {
+		return usecase.Page{}, err
+	}
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return usecase.Page{}, err
+	}
+	defer rows.Close()
+
+	page := usecase.Page{URLs: make([]*domain.URL, 0, query.Limit)}
+	for rows.Next() {
+		if len(page.URLs) == query.Limit {
+			last := page.URLs[len(page.URLs)-1]
+			page.Next = &usecase.Cursor{CreatedAt: last.CreatedAt, Short: last.Short}
+			break
+		}
+		url, err := sqlstore.ScanURL(rows)
+		if err != nil {
+			return usecase.Page{}, err
+		}
+		page.URLs = append(page.URLs, &url)
+	}
+	return page, rows.Err()
+}
+
+// ForEach reads user links page by page, so only exportFetchSize links are held at once
+// and no read transaction is open while fn is called
+func (d *DB) ForEach(ctx context.Context, key string, fn func(*domain.URL) error) error {
+	query := usecase.PageQuery{Limit: exportFetchSize}
+	for {
+		page, err := d.FindPage(ctx, key, query)
+		if err != nil {
+			return err
+		}
+		for _, url := range page.URLs {
+			if err = fn(url); err != nil {
+				return err
+			}
+		}
+		if page.Next == nil {
+			return nil
+		}
+		query.After = page.Next
+	}
+}
+
+// Dump reads links of every user by chunks ordered by id
+func (d *DB) Dump(ctx context.Context, fn func(*domain.URL) error) error {
+	stmt, err := d.stmt(ctx, queries.DumpAfter)
+	if err != nil {
+		return err
+	}
+
+	batch := make([]domain.URL, 0, exportFetchSize)
+	after := ""
+	for {
+		batch, err = fetch(ctx, stmt, batch[:0], after)
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			if err = fn(&batch[i]); err != nil {
+				return err
+			}
+		}
+		if len(batch) < exportFetchSize {
+			return nil
+		}
+		after = batch[len(batch)-1].Short
+	}
+}
+
+// fetch reads the chunk of links following the id
+func fetch(ctx context.Context, stmt *sql.Stmt, batch []domain.URL, after string) ([]domain.URL, error) {
+	rows, err := stmt.QueryContext(ctx, after, exportFetchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		url, err := sqlstore.ScanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, url)
+	}
+	return batch, rows.Err()
+}
+
+func (d *DB) Delete(ctx context.Context, key string) error {
+	stmt, err := d.stmt(ctx, queries.Delete)
+	if err != nil {
+		return err
+	}
+	result, err := stmt.ExecContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("key %v not exists: %w", key, usecase.ErrNotFound)
+	}
+	return nil
+}
+
+func (d *DB) Reassign(ctx context.Context, key string, owner string) error {
+	return d.write(ctx, func(tx *sql.Tx) error {
+		register, err := d.txStmt(ctx, tx, queries.RegisterUser)
+		if err != nil {
+			return err
+		}
+		if _, err = register.ExecContext(ctx, owner); err != nil {
+			return err
+		}
+
+		reassign, err := d.txStmt(ctx, tx, queries.Reassign)
+		if err != nil {
+			return err
+		}
+		result, err := reassign.ExecContext(ctx, key, owner)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return fmt.Errorf("key %v not exists: %w", key, usecase.ErrNotFound)
+		}
+		return nil
+	})
+}
+
+// Update runs in a write transaction, so concurrent updates of the link number versions one after another
+func (d *DB) Update(ctx context.Context, key string, orig string, at time.Time) error {
+	return d.write(ctx, func(tx *sql.Tx) error {
+		lock, err := d.txStmt(ctx, tx, queries.LockURL)
+		if err != nil {
+			return err
+		}
+		var prev, owner string
+		err = lock.QueryRowContext(ctx, key).Scan(&prev, &owner)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("key %v not exists: %w", key, usecase.ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if prev == orig {
+			return nil
+		}
+
+		find, err := d.txStmt(ctx, tx, queries.FindShort)
+		if err != nil {
+			return err
+		}
+		var existing string
+		err = find.QueryRowContext(ctx, owner, orig).Scan(&existing)
+		if err == nil {
+			return sqlstore.AlreadyExists(existing, orig)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		insert, err := d.txStmt(ctx, tx, queries.InsertVersion)
+		if err != nil {
+			return err
+		}
+		if _, err = insert.ExecContext(ctx, key, prev, at.UTC()); err != nil {
+			return err
+		}
+		update, err := d.txStmt(ctx, tx, queries.UpdateOrig)
+		if err != nil {
+			return err
+		}
+		_, err = update.ExecContext(ctx, key, orig)
+		return err
+	})
+}
+
+// Click is a conditional update in a write transaction, so concurrent clicks are counted down one after another
+func (d *DB) Click(ctx context.Context, key string) error {
+	return d.write(ctx, func(tx *sql.Tx) error {
+		click, err := d.txStmt(ctx, tx, queries.Click)
+		if err != nil {
+			return err
+		}
+		result, err := click.ExecContext(ctx, key)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected > 0 {
+			return nil
+		}
+
+		limit, err := d.txStmt(ctx, tx, queries.ClickLimit)
+		if err != nil {
+			return err
+		}
+		var maxClicks int
+		err = limit.QueryRowContext(ctx, key).Scan(&maxClicks)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("key %v not exists: %w", key, usecase.ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		return sqlstore.NotClicked(key, maxClicks)
+	})
+}
+
+func (d *DB) History(ctx context.Context, key string) ([]domain.Version, error) {
+	if _, err := d.FindByKey(ctx, key); err != nil {
+		return nil, err
+	}
+	stmt, err := d.stmt(ctx, queries.History)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]domain.Version, 0)
+	for rows.Next() {
+		var version domain.Version
+		if err = rows.Scan(&version.Orig, &version.ReplacedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, version)
+	}
+	return history, rows.Err()
+}
+
+func (d *DB) CountUsers(ctx context.Context) (int, error) {
+	stmt, err := d.stmt(ctx, queries.CountUsers)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = stmt.QueryRowContext(ctx).Scan(&count)
+	return count, err
+}
+
+func (d *DB) Ping(ctx context.Context) error {
+	if d == nil {
+		return errors.New("database is not open")
+	}
+	return d.db.PingContext(ctx)
+}
+
+// Close closes prepared statements and connections, WAL is checkpointed by the last one
+func (d *DB) Close() error {
+	d.stmtMutex.Lock()
+	for query, stmt := range d.stmts {
+		stmt.Close()
+		delete(d.stmts, query)
+	}
+	d.stmtMutex.Unlock()
+	return d.db.Close()
+}
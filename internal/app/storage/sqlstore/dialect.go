@@ -0,0 +1,60 @@
+// Package sqlstore holds SQL shared by relational storages,
+// syntax which differs between databases is isolated in Dialect
+package sqlstore
+
+import "strconv"
+
+// Dialect isolates syntax which differs between SQL databases
+type Dialect interface {
+	// Name is a directory of dialect migrations
+	Name() string
+	// Placeholder returns n-th statement parameter, counting from 1
+	Placeholder(n int) string
+	// Contains returns a condition of column holding substring given by param
+	Contains(column string, param string) string
+	// ForUpdate is a clause locking selected rows till the end of transaction
+	ForUpdate() string
+}
+
+var (
+	Postgres Dialect = postgresDialect{}
+	SQLite   Dialect = sqliteDialect{}
+)
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (postgresDialect) Contains(column string, param string) string {
+	return "strpos(" + column + ", " + param + ") > 0"
+}
+
+func (postgresDialect) ForUpdate() string {
+	return " FOR UPDATE"
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+// Placeholder is numbered, so a parameter may be referred to twice like in postgres
+func (sqliteDialect) Placeholder(n int) string {
+	return "?" + strconv.Itoa(n)
+}
+
+func (sqliteDialect) Contains(column string, param string) string {
+	return "instr(" + column + ", " + param + ") > 0"
+}
+
+// ForUpdate is empty, a write transaction of sqlite locks the whole database
+func (sqliteDialect) ForUpdate() string {
+	return ""
+}
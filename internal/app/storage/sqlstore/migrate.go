@@ -0,0 +1,167 @@
+package sqlstore
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles holds a directory of scripts per dialect, versions and names
+// of migrations are the same in every dialect so schemas evolve together
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// ErrMigration means schema can't be brought to the expected version
+var ErrMigration = errors.New("schema migration failed")
+
+// Migration is a pair of scripts from migrations directory,
+// named <version>_<name>.up.sql and <version>_<name>.down.sql
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// LoadMigrations reads migrations ordered by version, every version must have both scripts
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, name := range names {
+		base := strings.TrimSuffix(name, ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 || version <= 0 {
+			return nil, fmt.Errorf("migration %v is not named as <version>_<name>.up|down.sql", name)
+		}
+
+		script, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[1] {
+			return nil, fmt.Errorf("migration %v has names %v and %v", version, m.Name, parts[1])
+		}
+
+		switch direction {
+		case ".up":
+			m.Up = string(script)
+		case ".down":
+			m.Down = string(script)
+		default:
+			return nil, fmt.Errorf("migration %v is neither up nor down", name)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %v must have both up and down scripts", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrations returns embedded migrations of dialect
+func Migrations(d Dialect) ([]Migration, error) {
+	fsys, err := fs.Sub(migrationFiles, "migrations/"+d.Name())
+	if err != nil {
+		return nil, err
+	}
+	return LoadMigrations(fsys)
+}
+
+// LatestVersion is the version schema of dialect is migrated to on start
+func LatestVersion(d Dialect) (int, error) {
+	migrations, err := Migrations(d)
+	if err != nil {
+		return 0, err
+	}
+	return latest(migrations), nil
+}
+
+func latest(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Step applies a migration or rolls it back
+type Step struct {
+	Migration
+	Rollback bool
+}
+
+// Script returns the script of step direction
+func (s Step) Script() string {
+	if s.Rollback {
+		return s.Down
+	}
+	return s.Up
+}
+
+// Record returns a statement which records the step in schema_migrations table
+func (s Step) Record(d Dialect) (string, []interface{}) {
+	if s.Rollback {
+		return "DELETE FROM schema_migrations WHERE version = " + d.Placeholder(1), []interface{}{s.Version}
+	}
+	return "INSERT INTO schema_migrations (version, name) VALUES (" + d.Placeholder(1) + ", " + d.Placeholder(2) + ")",
+		[]interface{}{s.Version, s.Name}
+}
+
+func (s Step) String() string {
+	if s.Rollback {
+		return fmt.Sprintf("rollback of migration %v %v", s.Version, s.Name)
+	}
+	return fmt.Sprintf("migration %v %v", s.Version, s.Name)
+}
+
+// Plan returns steps which bring schema from current version to the target one,
+// a schema newer than migrations know about is not touched
+func Plan(migrations []Migration, current int, target int) ([]Step, error) {
+	known := latest(migrations)
+	if current > known {
+		return nil, fmt.Errorf("schema version %v is newer than %v known to this build", current, known)
+	}
+	if target > known || target < 0 {
+		return nil, fmt.Errorf("there is no schema version %v", target)
+	}
+
+	var steps []Step
+	for _, m := range migrations {
+		if m.Version > current && m.Version <= target {
+			steps = append(steps, Step{Migration: m})
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= current && m.Version > target {
+			steps = append(steps, Step{Migration: m, Rollback: true})
+		}
+	}
+	return steps, nil
+}
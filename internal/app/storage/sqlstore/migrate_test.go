@@ -0,0 +1,96 @@
+package sqlstore
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	var names []string
+	for _, d := range []Dialect{Postgres, SQLite} {
+		migrations, err := Migrations(d)
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+
+		dialectNames := make([]string, 0, len(migrations))
+		for i, m := range migrations {
+			assert.Equal(t, i+1, m.Version, "versions go one by one")
+			dialectNames = append(dialectNames, m.Name)
+		}
+		if names != nil {
+			assert.Equal(t, names, dialectNames, "dialects have the same migrations")
+		}
+		names = dialectNames
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_second.up.sql":   {Data: []byte("up 2")},
+		"0002_second.down.sql": {Data: []byte("down 2")},
+		"0001_first.up.sql":    {Data: []byte("up 1")},
+		"0001_first.down.sql":  {Data: []byte("down 1")},
+	}
+	migrations, err := LoadMigrations(fsys)
+	require.NoError(t, err)
+	assert.Equal(t, []Migration{
+		{Version: 1, Name: "first", Up: "up 1", Down: "down 1"},
+		{Version: 2, Name: "second", Up: "up 2", Down: "down 2"},
+	}, migrations)
+}
+
+func TestLoadMigrations_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{"no down", fstest.MapFS{"0001_a.up.sql": {Data: []byte("x")}}},
+		{"no version", fstest.MapFS{"a.up.sql": {Data: []byte("x")}}},
+		{"no direction", fstest.MapFS{"0001_a.sql": {Data: []byte("x")}}},
+		{"names differ", fstest.MapFS{
+			"0001_a.up.sql":   {Data: []byte("x")},
+			"0001_b.down.sql": {Data: []byte("x")},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadMigrations(tt.files)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	migrations := []Migration{{Version: 1, Name: "a"}, {Version: 2, Name: "b"}, {Version: 3, Name: "c"}}
+	versions := func(steps []Step) []int {
+		var v []int
+		for _, s := range steps {
+			if s.Rollback {
+				v = append(v, -s.Version)
+			} else {
+				v = append(v, s.Version)
+			}
+		}
+		return v
+	}
+
+	steps, err := Plan(migrations, 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, versions(steps))
+
+	steps, err = Plan(migrations, 3, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{-3, -2}, versions(steps), "rolled back from the latest")
+
+	steps, err = Plan(migrations, 2, 2)
+	require.NoError(t, err)
+	assert.Empty(t, steps)
+
+	_, err = Plan(migrations, 4, 3)
+	assert.Error(t, err, "schema is newer than the build")
+	_, err = Plan(migrations, 1, 4)
+	assert.Error(t, err, "unknown target")
+}
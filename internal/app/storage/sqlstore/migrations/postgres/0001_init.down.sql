@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.urls;
+DROP TABLE IF EXISTS public.users;
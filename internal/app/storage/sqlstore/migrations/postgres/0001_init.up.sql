@@ -0,0 +1,14 @@
+-- tables may already exist in databases created before migrations were introduced
+CREATE TABLE IF NOT EXISTS public.users (
+    id TEXT NOT NULL,
+    CONSTRAINT user_constraint PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS public.urls (
+    id       TEXT NOT NULL,
+    orig_url TEXT NOT NULL,
+    user_id  TEXT NOT NULL,
+    CONSTRAINT url_constraint PRIMARY KEY (id),
+    CONSTRAINT orig_url_constraint UNIQUE (user_id, orig_url),
+    FOREIGN KEY (user_id) REFERENCES public.users (id)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS public.urls_user_created_idx;
+ALTER TABLE public.urls DROP COLUMN IF EXISTS created_at;
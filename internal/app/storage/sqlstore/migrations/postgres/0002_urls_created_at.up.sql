@@ -0,0 +1,2 @@
+ALTER TABLE public.urls ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS urls_user_created_idx ON public.urls (user_id, created_at, id);
@@ -0,0 +1,2 @@
+-- zero redirect is the server default status
+ALTER TABLE public.urls ADD COLUMN IF NOT EXISTS redirect INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE public.urls DROP COLUMN IF EXISTS password_hash;
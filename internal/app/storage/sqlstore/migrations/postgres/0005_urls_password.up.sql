@@ -0,0 +1,2 @@
+-- links without password have an empty hash
+ALTER TABLE public.urls ADD COLUMN IF NOT EXISTS password_hash TEXT NOT NULL DEFAULT '';
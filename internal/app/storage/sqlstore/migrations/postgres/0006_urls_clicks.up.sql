@@ -0,0 +1,3 @@
+-- zero max clicks is no limit, clicks left are counted down from max clicks
+ALTER TABLE public.urls ADD COLUMN IF NOT EXISTS max_clicks INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE public.urls ADD COLUMN IF NOT EXISTS clicks_left INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+ALTER TABLE public.urls DROP COLUMN IF EXISTS fallback;
+ALTER TABLE public.urls DROP COLUMN IF EXISTS placeholder;
+ALTER TABLE public.urls DROP COLUMN IF EXISTS not_after;
+ALTER TABLE public.urls DROP COLUMN IF EXISTS not_before;
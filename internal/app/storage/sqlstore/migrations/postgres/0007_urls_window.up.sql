@@ -0,0 +1,5 @@
+-- links work between not_before and not_after, NULL ones are open ends
+ALTER TABLE public.urls ADD COLUMN IF NOT EXISTS not_before TIMESTAMPTZ;
+ALTER TABLE public.urls ADD COLUMN IF NOT EXISTS not_after TIMESTAMPTZ;
+ALTER TABLE public.urls ADD COLUMN IF NOT EXISTS placeholder TEXT NOT NULL DEFAULT '';
+ALTER TABLE public.urls ADD COLUMN IF NOT EXISTS fallback TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS urls_user_created_idx;
+ALTER TABLE urls DROP COLUMN created_at;
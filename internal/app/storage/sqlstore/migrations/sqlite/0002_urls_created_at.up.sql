@@ -0,0 +1,3 @@
+-- sqlite can't add a column with a non-constant default, times are stored as UTC text
+ALTER TABLE urls ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00';
+CREATE INDEX IF NOT EXISTS urls_user_created_idx ON urls (user_id, created_at, id);
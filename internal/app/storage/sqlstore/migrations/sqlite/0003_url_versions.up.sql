@@ -0,0 +1,9 @@
+-- previous originals of changed links, version 1 is the original the link was created with
+CREATE TABLE IF NOT EXISTS url_versions (
+    id          TEXT NOT NULL,
+    version     INTEGER NOT NULL,
+    orig_url    TEXT NOT NULL,
+    replaced_at TIMESTAMP NOT NULL,
+    CONSTRAINT url_version_constraint PRIMARY KEY (id, version),
+    FOREIGN KEY (id) REFERENCES urls (id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+-- zero redirect is the server default status
+ALTER TABLE urls ADD COLUMN redirect INTEGER NOT NULL DEFAULT 0;
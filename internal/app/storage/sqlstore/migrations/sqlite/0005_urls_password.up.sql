@@ -0,0 +1,2 @@
+-- links without password have an empty hash
+ALTER TABLE urls ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';
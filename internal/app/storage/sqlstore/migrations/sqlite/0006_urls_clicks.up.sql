@@ -0,0 +1,3 @@
+-- zero max clicks is no limit, clicks left are counted down from max clicks
+ALTER TABLE urls ADD COLUMN max_clicks INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE urls ADD COLUMN clicks_left INTEGER NOT NULL DEFAULT 0;
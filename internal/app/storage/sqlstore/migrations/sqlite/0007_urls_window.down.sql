@@ -0,0 +1,4 @@
+ALTER TABLE urls DROP COLUMN fallback;
+ALTER TABLE urls DROP COLUMN placeholder;
+ALTER TABLE urls DROP COLUMN not_after;
+ALTER TABLE urls DROP COLUMN not_before;
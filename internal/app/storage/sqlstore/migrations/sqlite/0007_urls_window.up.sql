@@ -0,0 +1,5 @@
+-- links work between not_before and not_after, NULL ones are open ends
+ALTER TABLE urls ADD COLUMN not_before TIMESTAMP;
+ALTER TABLE urls ADD COLUMN not_after TIMESTAMP;
+ALTER TABLE urls ADD COLUMN placeholder TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN fallback TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,295 @@
+package sqlstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+// BatchRows bounds rows of a single multi-row statement, parameters
+// of the rows must fit into limits of every dialect
+const BatchRows = 1000
+
+// urlColumns are selected by every link query in the order ScanURL reads them
+// and inserted in the order URLValues returns them
+const urlColumns = "id, orig_url, user_id, created_at, redirect, password_hash, max_clicks, clicks_left," +
+	" not_before, not_after, placeholder, fallback"
+
+// URLValues returns values of link columns in the order of urlColumns,
+// times are stored in UTC, so they compare the same in every dialect
+func URLValues(u *domain.URL) []interface{} {
+	return []interface{}{
+		u.Short, u.Orig, u.Owner, u.CreatedAt.UTC(), u.Redirect, u.PasswordHash, u.MaxClicks, u.ClicksLeft,
+		utcOrNil(u.NotBefore), utcOrNil(u.NotAfter), u.Placeholder, u.Fallback,
+	}
+}
+
+// utcOrNil stores a missing time as NULL
+func utcOrNil(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+// Queries are statements written in a dialect, statements
+// depending on number of rows or filters are built by methods
+type Queries struct {
+	d Dialect
+
+	FindByKey string
+	// FindAll selects user links in creation order
+	FindAll string
+	// Dump selects links of every user
+	Dump string
+	// DumpAfter selects a chunk of links following the id, for storages without server side cursors
+	DumpAfter string
+	// InsertURL skips a link whose owner has already shortened the same original
+	InsertURL string
+	// FindShort selects id of the link by owner and original
+	FindShort    string
+	Delete       string
+	RegisterUser string
+	Reassign     string
+	CountUsers   string
+	ListUsers    string
+	// LockURL selects original and owner of the link, the row is locked till the end of transaction
+	LockURL string
+	// InsertVersion keeps the original of the link as its next previous version
+	InsertVersion string
+	UpdateOrig    string
+	// History selects previous originals of the link from the oldest one
+	History string
+	// Click counts down a link with clicks left in a single statement, so concurrent clicks
+	// never take more than there are. ClickLimit tells why no link was counted down
+	Click      string
+	ClickLimit string
+}
+
+func NewQueries(d Dialect) *Queries {
+	p := d.Placeholder
+	return &Queries{
+		d:         d,
+		FindByKey: "SELECT " + urlColumns + " FROM urls WHERE id = " + p(1),
+		FindAll:   "SELECT " + urlColumns + " FROM urls WHERE user_id = " + p(1) + " ORDER BY created_at, id",
+		Dump:      "SELECT " + urlColumns + " FROM urls ORDER BY id",
+		DumpAfter: "SELECT " + urlColumns + " FROM urls WHERE id > " + p(1) + " ORDER BY id LIMIT " + p(2),
+		InsertURL: "INSERT INTO urls (" + urlColumns + ") VALUES (" + placeholders(p, 12) + ")" +
+			" ON CONFLICT (user_id, orig_url) DO NOTHING",
+		FindShort:    "SELECT id FROM urls WHERE user_id = " + p(1) + " AND orig_url = " + p(2),
+		Delete:       "DELETE FROM urls WHERE id = " + p(1),
+		RegisterUser: "INSERT INTO users (id) VALUES (" + p(1) + ") ON CONFLICT DO NOTHING",
+		Reassign:     "UPDATE urls SET user_id = " + p(2) + " WHERE id = " + p(1),
+		CountUsers:   "SELECT count(*) FROM users",
+		ListUsers:    "SELECT id FROM users ORDER BY id",
+		LockURL:      "SELECT orig_url, user_id FROM urls WHERE id = " + p(1) + d.ForUpdate(),
+		InsertVersion: "INSERT INTO url_versions (id, version, orig_url, replaced_at)" +
+			" SELECT " + p(1) + ", count(*) + 1, " + p(2) + ", " + p(3) + " FROM url_versions WHERE id = " + p(1),
+		UpdateOrig: "UPDATE urls SET orig_url = " + p(2) + " WHERE id = " + p(1),
+		History:    "SELECT orig_url, replaced_at FROM url_versions WHERE id = " + p(1) + " ORDER BY version",
+		Click:      "UPDATE urls SET clicks_left = clicks_left - 1 WHERE id = " + p(1) + " AND max_clicks > 0 AND clicks_left > 0",
+		ClickLimit: "SELECT max_clicks FROM urls WHERE id = " + p(1),
+	}
+}
+
+// placeholders lists n parameters of a row
+func placeholders(p func(int) string, n int) string {
+	list := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		list = append(list, p(i))
+	}
+	return strings.Join(list, ", ")
+}
+
+// statement builds a query numbering parameters in order of their values
+type statement struct {
+	d    Dialect
+	sb   strings.Builder
+	args []interface{}
+}
+
+func (s *statement) arg(v interface{}) string {
+	s.args = append(s.args, v)
+	return s.d.Placeholder(len(s.args))
+}
+
+// FindPage selects a page of user links with keyset pagination over (created_at, id),
+// so deep pages cost the same as the first one. One more row than the limit
+// is selected to tell if there is a next page
+func (q *Queries) FindPage(user string, query usecase.PageQuery) (string, []interface{}) {
+	s := &statement{d: q.d}
+	s.sb.WriteString("SELECT " + urlColumns + " FROM urls WHERE user_id = " + s.arg(user))
+	if query.After != nil {
+		op := ">"
+		if query.Desc {
+			op = "<"
+		}
+		s.sb.WriteString(" AND (created_at, id) " + op + " (" + s.arg(query.After.CreatedAt.UTC()) + ", " + s.arg(query.After.Short) + ")")
+	}
+	if query.Contains != "" {
+		s.sb.WriteString(" AND " + q.d.Contains("orig_url", s.arg(query.Contains)))
+	}
+	if !query.CreatedAfter.IsZero() {
+		s.sb.WriteString(" AND created_at > " + s.arg(query.CreatedAfter.UTC()))
+	}
+	if query.Desc {
+		s.sb.WriteString(" ORDER BY created_at DESC, id DESC")
+	} else {
+		s.sb.WriteString(" ORDER BY created_at, id")
+	}
+	s.sb.WriteString(" LIMIT " + s.arg(query.Limit+1))
+	return s.sb.String(), s.args
+}
+
+// InsertURLs inserts links with a multi-row statement returning ids of inserted ones,
+// links colliding with stored ones or with each other are skipped
+func (q *Queries) InsertURLs(urls []domain.URL) (string, []interface{}) {
+	s := &statement{d: q.d, args: make([]interface{}, 0, len(urls)*12)}
+	s.sb.WriteString("INSERT INTO urls (" + urlColumns + ") VALUES ")
+	for i := range urls {
+		if i > 0 {
+			s.sb.WriteString(",")
+		}
+		s.sb.WriteString("(")
+		for j, value := range URLValues(&urls[i]) {
+			if j > 0 {
+				s.sb.WriteString(",")
+			}
+			s.sb.WriteString(s.arg(value))
+		}
+		s.sb.WriteString(")")
+	}
+	s.sb.WriteString(" ON CONFLICT DO NOTHING RETURNING id")
+	return s.sb.String(), s.args
+}
+
+// RegisterUsers inserts users which are not known yet
+func (q *Queries) RegisterUsers(users []string) (string, []interface{}) {
+	s := &statement{d: q.d, args: make([]interface{}, 0, len(users))}
+	s.sb.WriteString("INSERT INTO users (id) VALUES ")
+	for i, user := range users {
+		if i > 0 {
+			s.sb.WriteString(",")
+		}
+		s.sb.WriteString("(" + s.arg(user) + ")")
+	}
+	s.sb.WriteString(" ON CONFLICT DO NOTHING")
+	return s.sb.String(), s.args
+}
+
+// FindOriginals selects owner, original and id of stored links holding originals of urls
+func (q *Queries) FindOriginals(urls []domain.URL) (string, []interface{}) {
+	s := &statement{d: q.d, args: make([]interface{}, 0, len(urls)*2)}
+	s.sb.WriteString("SELECT user_id, orig_url, id FROM urls WHERE (user_id, orig_url) IN (VALUES ")
+	for i, u := range urls {
+		if i > 0 {
+			s.sb.WriteString(",")
+		}
+		s.sb.WriteString("(" + s.arg(u.Owner) + "," + s.arg(u.Orig) + ")")
+	}
+	s.sb.WriteString(")")
+	return s.sb.String(), s.args
+}
+
+// Scanner is a row of any driver
+type Scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// ScanURL reads a link selected as urlColumns
+func ScanURL(row Scanner) (domain.URL, error) {
+	url := domain.URL{}
+	err := row.Scan(
+		&url.Short, &url.Orig, &url.Owner, &url.CreatedAt, &url.Redirect, &url.PasswordHash, &url.MaxClicks, &url.ClicksLeft,
+		&url.NotBefore, &url.NotAfter, &url.Placeholder, &url.Fallback,
+	)
+	return url, err
+}
+
+// Chunks calls fn for consecutive ranges of n items, size items at most each
+func Chunks(n int, size int, fn func(start, end int) error) error {
+	for start := 0; start < n; start += size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+		if err := fn(start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Owners returns distinct owners of urls in order of appearance,
+// a batch may hold links of many users when it is restored or migrated
+func Owners(urls []domain.URL) []string {
+	owners := make([]string, 0, 1)
+	seen := make(map[string]bool)
+	for _, u := range urls {
+		if !seen[u.Owner] {
+			seen[u.Owner] = true
+			owners = append(owners, u.Owner)
+		}
+	}
+	return owners
+}
+
+// Original identifies a link by its owner and original url
+type Original struct {
+	Owner string
+	Orig  string
+}
+
+// Skipped returns urls which are not inserted
+func Skipped(urls []domain.URL, inserted map[string]bool) []domain.URL {
+	skipped := make([]domain.URL, 0, len(urls)-len(inserted))
+	for _, u := range urls {
+		if !inserted[u.Short] {
+			skipped = append(skipped, u)
+		}
+	}
+	return skipped
+}
+
+// Conflicts reports skipped urls by their index in the batch, existing maps originals
+// of skipped urls to stored ids. A link skipped for id collision with someone else's link fails the batch
+func Conflicts(urls []domain.URL, inserted map[string]bool, existing map[Original]string) (map[int]usecase.ErrAlreadyExists, error) {
+	conflicts := make(map[int]usecase.ErrAlreadyExists)
+	for i, u := range urls {
+		if inserted[u.Short] {
+			continue
+		}
+		id, ok := existing[Original{u.Owner, u.Orig}]
+		if !ok {
+			return nil, fmt.Errorf("short id %v is already taken", u.Short)
+		}
+		if id == u.Short {
+			// the link itself is stored before, writing it again changes nothing
+			continue
+		}
+		conflicts[i] = AlreadyExists(id, u.Orig)
+	}
+	return conflicts, nil
+}
+
+// AlreadyExists reports a link of original which its owner has already shortened
+func AlreadyExists(id string, orig string) usecase.ErrAlreadyExists {
+	return usecase.ErrAlreadyExists{
+		Err:            errors.New("duplicate entry, given entity record already exists"),
+		ExistShortenID: id,
+		Orig:           orig,
+	}
+}
+
+// NotClicked tells why Click counted no link down by max clicks of the link,
+// links without a limit are not counted and used up ones are ErrExhausted
+func NotClicked(key string, maxClicks int) error {
+	if maxClicks == 0 {
+		return nil
+	}
+	return fmt.Errorf("link %v: %w", key, usecase.ErrExhausted)
+}
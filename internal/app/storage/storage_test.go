@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/storagetest"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) usecase.Repository {
+		return newURLMemoryStorage()
+	})
+}
+
+func TestPersistentStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) usecase.Repository {
+		file, err := NewPersistentStorage(filepath.Join(t.TempDir(), "links.log"))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = file.Close() })
+		return file
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) usecase.Repository {
+		snapshot, err := NewSnapshot(filepath.Join(t.TempDir(), "links.json"))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = snapshot.Close() })
+		return snapshot
+	})
+}
+
+func TestPersistentStorage_Reopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+
+	file, err := NewPersistentStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, file.Store(ctx, &domain.URL{Short: "a", Orig: "http://a.com/", Owner: "u1"}))
+	require.NoError(t, file.Store(ctx, &domain.URL{Short: "b", Orig: "http://b.com/", Owner: "u1"}))
+	// rejected duplicate is not logged
+	assert.Error(t, file.Store(ctx, &domain.URL{Short: "c", Orig: "http://a.com/", Owner: "u1"}))
+	require.NoError(t, file.Reassign(ctx, "b", "u2"))
+	require.NoError(t, file.Delete(ctx, "a"))
+	require.NoError(t, file.Close())
+
+	file, err = NewPersistentStorage(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = file.FindByKey(ctx, "a")
+	assert.ErrorIs(t, err, usecase.ErrNotFound)
+	_, err = file.FindByKey(ctx, "c")
+	assert.ErrorIs(t, err, usecase.ErrNotFound)
+	found, err := file.FindByKey(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, "u2", found.Owner)
+}
+
+// reopeners open storages which keep links in a file, so they can be reopened from it
+var reopeners = map[string]func(path string) (usecase.AdminRepository, func() error, error){
+	"file": func(path string) (usecase.AdminRepository, func() error, error) {
+		file, err := NewPersistentStorage(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, file.Close, nil
+	},
+	"snapshot": func(path string) (usecase.AdminRepository, func() error, error) {
+		snapshot, err := NewSnapshot(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return snapshot, snapshot.Close, nil
+	},
+	"bounded": func(path string) (usecase.AdminRepository, func() error, error) {
+		bounded, err := NewBoundedStorage(path, WithMaxLinks(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return bounded, bounded.Close, nil
+	},
+}
+
+func TestVersions_Reopen(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	for name, reopen := range reopeners {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "links.log")
+			repo, closeRepo, err := reopen(path)
+			require.NoError(t, err)
+			require.NoError(t, repo.Store(ctx, &domain.URL{Short: "a", Orig: "http://a.com/", Owner: "u1"}))
+			require.NoError(t, repo.Store(ctx, &domain.URL{Short: "b", Orig: "http://b.com/", Owner: "u1"}))
+			require.NoError(t, repo.Update(ctx, "a", "http://a2.com/", at))
+			require.NoError(t, repo.Update(ctx, "a", "http://a3.com/", at.Add(time.Second)))
+			require.NoError(t, closeRepo())
+
+			repo, closeRepo, err = reopen(path)
+			require.NoError(t, err)
+			defer closeRepo()
+
+			found, err := repo.FindByKey(ctx, "a")
+			require.NoError(t, err)
+			assert.Equal(t, "http://a3.com/", found.Orig)
+			history, err := repo.History(ctx, "a")
+			require.NoError(t, err)
+			assert.Equal(t, []domain.Version{
+				{Orig: "http://a.com/", ReplacedAt: at},
+				{Orig: "http://a2.com/", ReplacedAt: at.Add(time.Second)},
+			}, history)
+			history, err = repo.History(ctx, "b")
+			require.NoError(t, err)
+			assert.Empty(t, history)
+		})
+	}
+}
+
+func TestClicks_Reopen(t *testing.T) {
+	ctx := context.Background()
+	for name, reopen := range reopeners {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "links.log")
+			repo, closeRepo, err := reopen(path)
+			require.NoError(t, err)
+			require.NoError(t, repo.Store(ctx, &domain.URL{Short: "a", Orig: "http://a.com/", Owner: "u1", MaxClicks: 2, ClicksLeft: 2}))
+			require.NoError(t, repo.Store(ctx, &domain.URL{Short: "b", Orig: "http://b.com/", Owner: "u1"}))
+			require.NoError(t, repo.Click(ctx, "a"))
+			require.NoError(t, closeRepo())
+
+			repo, closeRepo, err = reopen(path)
+			require.NoError(t, err)
+			defer closeRepo()
+
+			require.NoError(t, repo.Click(ctx, "a"))
+			assert.ErrorIs(t, repo.Click(ctx, "a"), usecase.ErrExhausted)
+		})
+	}
+}
+
+func TestReplay_KeepsDuplicates(t *testing.T) {
+	// logs written before originals were checked may hold an original twice,
+	// both links go on working
+	memory := newURLMemoryStorage()
+	log := `{"Orig":"http://a.com/","Short":"a","Owner":"u1"}
+{"Orig":"http://a.com/","Short":"b","Owner":"u1"}
+`
+	require.NoError(t, replay(strings.NewReader(log), memory, nil))
+	assert.Len(t, memory.FindAll(context.Background(), "u1"), 2)
+}
@@ -0,0 +1,27 @@
+// Package storageconf tunes storages by application configuration, so server and shortenctl open them alike
+package storageconf
+
+import (
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/postgres"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/sqlite"
+	"github.com/aidlatyp/ya-pr-shortener/internal/config"
+)
+
+// Postgres tunes connection pool, timeouts are configured in seconds
+func Postgres(appConf *config.AppConfig) []postgres.Option {
+	return []postgres.Option{
+		postgres.WithPoolSize(appConf.DBMinConns, appConf.DBMaxConns),
+		postgres.WithConnectTimeout(time.Duration(appConf.DBConnectTimeout) * time.Second),
+		postgres.WithQueryTimeout(time.Duration(appConf.DBQueryTimeout) * time.Second),
+		postgres.WithMaxConnIdleTime(time.Duration(appConf.DBMaxConnIdleTime) * time.Second),
+	}
+}
+
+// SQLite tunes sqlite storage, busy timeout is configured in milliseconds
+func SQLite(appConf *config.AppConfig) []sqlite.Option {
+	return []sqlite.Option{
+		sqlite.WithBusyTimeout(time.Duration(appConf.SQLiteBusyTimeout) * time.Millisecond),
+	}
+}
@@ -0,0 +1,566 @@
+// Package storagetest checks that a storage keeps the usecase.Repository contract,
+// every storage runs the same suite from its own tests
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns an empty storage, it is called by every test.
+// Storage is closed by the factory with t.Cleanup if it needs closing
+type Factory func(t *testing.T) usecase.Repository
+
+// Run checks the contract of storages made by factory, admin operations
+// are checked when storage is a usecase.AdminRepository
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo usecase.Repository)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"Ownership", testOwnership},
+		{"Duplicates", testDuplicates},
+		{"Batches", testBatches},
+		{"Pages", testPages},
+		{"ForEach", testForEach},
+		{"Versions", testVersions},
+		{"Clicks", testClicks},
+		{"Concurrency", testConcurrency},
+		{"Cancellation", testCancellation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, factory(t))
+		})
+	}
+
+	adminTests := []struct {
+		name string
+		test func(t *testing.T, repo usecase.AdminRepository)
+	}{
+		{"Delete", testDelete},
+		{"Reassign", testReassign},
+		{"DeleteVersions", testDeleteVersions},
+		{"CountUsers", testCountUsers},
+		{"Dump", testDump},
+	}
+	for _, tt := range adminTests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin, ok := factory(t).(usecase.AdminRepository)
+			if !ok {
+				t.Skip("storage is not an AdminRepository")
+			}
+			tt.test(t, admin)
+		})
+	}
+}
+
+// epoch is a creation time of test links, times are stored with microseconds by every storage
+var epoch = time.Date(2022, 3, 4, 5, 6, 7, 123456000, time.UTC)
+
+// link makes i-th link of owner created i seconds after epoch
+func link(owner string, i int) domain.URL {
+	return domain.URL{
+		Short:     fmt.Sprintf("%v-%05d", owner, i),
+		Orig:      fmt.Sprintf("http://example.com/%v/%v", owner, i),
+		Owner:     owner,
+		CreatedAt: epoch.Add(time.Duration(i) * time.Second),
+	}
+}
+
+func links(owner string, n int) []domain.URL {
+	urls := make([]domain.URL, 0, n)
+	for i := 0; i < n; i++ {
+		urls = append(urls, link(owner, i))
+	}
+	return urls
+}
+
+func shorts(urls []*domain.URL) []string {
+	result := make([]string, 0, len(urls))
+	for _, url := range urls {
+		result = append(result, url.Short)
+	}
+	return result
+}
+
+func assertSame(t *testing.T, expected domain.URL, actual *domain.URL) {
+	t.Helper()
+	require.NotNil(t, actual)
+	assert.Equal(t, expected.Short, actual.Short)
+	assert.Equal(t, expected.Orig, actual.Orig)
+	assert.Equal(t, expected.Owner, actual.Owner)
+	assert.Equal(t, expected.Redirect, actual.Redirect)
+	assert.Equal(t, expected.PasswordHash, actual.PasswordHash)
+	assert.Equal(t, expected.MaxClicks, actual.MaxClicks)
+	assert.Equal(t, expected.ClicksLeft, actual.ClicksLeft)
+	assertSameTime(t, expected.NotBefore, actual.NotBefore)
+	assertSameTime(t, expected.NotAfter, actual.NotAfter)
+	assert.Equal(t, expected.Placeholder, actual.Placeholder)
+	assert.Equal(t, expected.Fallback, actual.Fallback)
+	assert.True(t, expected.CreatedAt.Equal(actual.CreatedAt), "created at %v, found %v", expected.CreatedAt, actual.CreatedAt)
+}
+
+// assertSameTime compares optional times by instant, storages may return them in another location
+func assertSameTime(t *testing.T, expected *time.Time, actual *time.Time) {
+	t.Helper()
+	if expected == nil || actual == nil {
+		assert.Equal(t, expected, actual)
+		return
+	}
+	assert.True(t, expected.Equal(*actual), "expected %v, found %v", *expected, *actual)
+}
+
+func testRoundTrip(t *testing.T, repo usecase.Repository) {
+	ctx := context.Background()
+
+	owned := link("u1", 1)
+	owned.Redirect = 308
+	owned.PasswordHash = "$2a$10$hash"
+	owned.MaxClicks, owned.ClicksLeft = 5, 3
+	notBefore, notAfter := epoch.Add(time.Hour), epoch.Add(48*time.Hour)
+	owned.NotBefore, owned.NotAfter = &notBefore, &notAfter
+	owned.Placeholder, owned.Fallback = "http://example.com/soon", "http://example.com/over"
+	require.NoError(t, repo.Store(ctx, &owned))
+	anonymous := link("", 2)
+	require.NoError(t, repo.Store(ctx, &anonymous))
+
+	found, err := repo.FindByKey(ctx, owned.Short)
+	require.NoError(t, err)
+	assertSame(t, owned, found)
+
+	found, err = repo.FindByKey(ctx, anonymous.Short)
+	require.NoError(t, err)
+	assertSame(t, anonymous, found)
+
+	_, err = repo.FindByKey(ctx, "missing")
+	assert.True(t, errors.Is(err, usecase.ErrNotFound), "missing link is ErrNotFound, got %v", err)
+}
+
+func testOwnership(t *testing.T, repo usecase.Repository) {
+	ctx := context.Background()
+
+	// stored out of creation order, storages keep it anyway
+	for _, url := range []domain.URL{link("u1", 2), link("u2", 1), link("u1", 0), link("u1", 1)} {
+		url := url
+		require.NoError(t, repo.Store(ctx, &url))
+	}
+
+	assert.Equal(t, []string{"u1-00000", "u1-00001", "u1-00002"}, shorts(repo.FindAll(ctx, "u1")))
+	assert.Equal(t, []string{"u2-00001"}, shorts(repo.FindAll(ctx, "u2")))
+
+	none := repo.FindAll(ctx, "u3")
+	assert.NotNil(t, none, "user without links gets an empty slice")
+	assert.Empty(t, none)
+
+	page, err := repo.FindPage(ctx, "u3", usecase.PageQuery{Limit: 10})
+	require.NoError(t, err)
+	assert.NotNil(t, page.URLs)
+	assert.Empty(t, page.URLs)
+	assert.Nil(t, page.Next)
+}
+
+func testDuplicates(t *testing.T, repo usecase.Repository) {
+	ctx := context.Background()
+
+	for _, owner := range []string{"u1", ""} {
+		first := link(owner, 1)
+		require.NoError(t, repo.Store(ctx, &first))
+		// the same link again changes nothing
+		require.NoError(t, repo.Store(ctx, &first))
+
+		second := first
+		second.Short = first.Short + "-again"
+		err := repo.Store(ctx, &second)
+		var exists usecase.ErrAlreadyExists
+		require.True(t, errors.As(err, &exists), "owner %q shortens original twice, got %v", owner, err)
+		assert.Equal(t, first.Short, exists.ExistShortenID)
+		assert.Equal(t, first.Orig, exists.Orig)
+
+		_, err = repo.FindByKey(ctx, second.Short)
+		assert.True(t, errors.Is(err, usecase.ErrNotFound), "duplicate is not stored")
+	}
+
+	// another owner may shorten the same original
+	other := link("u1", 1)
+	other.Owner, other.Short = "u2", "u2-00001"
+	require.NoError(t, repo.Store(ctx, &other))
+}
+
+func testBatches(t *testing.T, repo usecase.Repository) {
+	ctx := context.Background()
+
+	assert.NoError(t, repo.BatchWrite(ctx, nil))
+	assert.NoError(t, repo.BatchWrite(ctx, []domain.URL{}))
+
+	stored := link("u1", 0)
+	require.NoError(t, repo.Store(ctx, &stored))
+
+	batch := links("u1", 4)
+	// index 0 holds the stored link itself, which is not a conflict
+	duplicate := link("u1", 1)
+	duplicate.Short = "u1-dup-of-stored"
+	duplicate.Orig = stored.Orig
+	batch = append(batch, duplicate)
+	inBatch := link("u1", 2)
+	inBatch.Short = "u1-dup-in-batch"
+	batch = append(batch, inBatch)
+	batch = append(batch, link("u2", 0))
+
+	err := repo.BatchWrite(ctx, batch)
+	var conflicts usecase.ErrBatchConflicts
+	require.True(t, errors.As(err, &conflicts), "got %v", err)
+	require.Len(t, conflicts.Conflicts, 2)
+	assert.Equal(t, stored.Short, conflicts.Conflicts[4].ExistShortenID)
+	assert.Equal(t, stored.Orig, conflicts.Conflicts[4].Orig)
+	assert.Equal(t, "u1-00002", conflicts.Conflicts[5].ExistShortenID)
+
+	assert.Equal(t, []string{"u1-00000", "u1-00001", "u1-00002", "u1-00003"}, shorts(repo.FindAll(ctx, "u1")))
+	assert.Equal(t, []string{"u2-00000"}, shorts(repo.FindAll(ctx, "u2")))
+	for _, short := range []string{"u1-dup-of-stored", "u1-dup-in-batch"} {
+		_, err = repo.FindByKey(ctx, short)
+		assert.True(t, errors.Is(err, usecase.ErrNotFound), "conflicting %v is not written", short)
+	}
+
+	// a batch written again is not a conflict
+	assert.NoError(t, repo.BatchWrite(ctx, links("u1", 4)))
+}
+
+func testPages(t *testing.T, repo usecase.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.BatchWrite(ctx, links("u1", 5)))
+	require.NoError(t, repo.BatchWrite(ctx, links("u2", 2)))
+
+	page, err := repo.FindPage(ctx, "u1", usecase.PageQuery{Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"u1-00000", "u1-00001"}, shorts(page.URLs))
+	require.NotNil(t, page.Next)
+
+	page, err = repo.FindPage(ctx, "u1", usecase.PageQuery{Limit: 2, After: page.Next})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"u1-00002", "u1-00003"}, shorts(page.URLs))
+	require.NotNil(t, page.Next)
+
+	page, err = repo.FindPage(ctx, "u1", usecase.PageQuery{Limit: 2, After: page.Next})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"u1-00004"}, shorts(page.URLs))
+	assert.Nil(t, page.Next)
+
+	page, err = repo.FindPage(ctx, "u1", usecase.PageQuery{Limit: 10, Desc: true, After: &usecase.Cursor{
+		CreatedAt: link("u1", 3).CreatedAt,
+		Short:     "u1-00003",
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"u1-00002", "u1-00001", "u1-00000"}, shorts(page.URLs))
+
+	page, err = repo.FindPage(ctx, "u1", usecase.PageQuery{Limit: 10, Contains: "u1/4"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"u1-00004"}, shorts(page.URLs))
+
+	page, err = repo.FindPage(ctx, "u1", usecase.PageQuery{Limit: 10, CreatedAfter: link("u1", 2).CreatedAt})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"u1-00003", "u1-00004"}, shorts(page.URLs))
+}
+
+func testForEach(t *testing.T, repo usecase.Repository) {
+	ctx := context.Background()
+	urls := links("u1", 3)
+	require.NoError(t, repo.BatchWrite(ctx, urls))
+
+	var visited []*domain.URL
+	require.NoError(t, repo.ForEach(ctx, "u1", func(url *domain.URL) error {
+		visited = append(visited, url)
+		return nil
+	}))
+	require.Len(t, visited, len(urls))
+	for i := range urls {
+		assertSame(t, urls[i], visited[i])
+	}
+
+	// iteration stops on the first error of fn, which is returned as is
+	stop := errors.New("stop")
+	calls := 0
+	err := repo.ForEach(ctx, "u1", func(*domain.URL) error {
+		calls++
+		return stop
+	})
+	assert.True(t, errors.Is(err, stop))
+	assert.Equal(t, 1, calls)
+
+	assert.NoError(t, repo.ForEach(ctx, "u3", func(*domain.URL) error {
+		t.Error("user without links is not visited")
+		return nil
+	}))
+}
+
+func testVersions(t *testing.T, repo usecase.Repository) {
+	ctx := context.Background()
+	first := link("u1", 0)
+	taken := link("u1", 1)
+	require.NoError(t, repo.BatchWrite(ctx, []domain.URL{first, taken}))
+
+	history, err := repo.History(ctx, first.Short)
+	require.NoError(t, err)
+	assert.Empty(t, history, "link is not changed yet")
+
+	replaced := epoch.Add(time.Hour)
+	require.NoError(t, repo.Update(ctx, first.Short, "http://example.com/second", replaced))
+	require.NoError(t, repo.Update(ctx, first.Short, "http://example.com/third", replaced.Add(time.Second)))
+	// the same original changes nothing
+	require.NoError(t, repo.Update(ctx, first.Short, "http://example.com/third", replaced.Add(2*time.Second)))
+
+	found, err := repo.FindByKey(ctx, first.Short)
+	require.NoError(t, err)
+	updated := first
+	updated.Orig = "http://example.com/third"
+	assertSame(t, updated, found)
+	assert.Equal(t, []string{first.Short, taken.Short}, shorts(repo.FindAll(ctx, "u1")), "link keeps its place")
+
+	history, err = repo.History(ctx, first.Short)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, first.Orig, history[0].Orig)
+	assert.True(t, replaced.Equal(history[0].ReplacedAt), "replaced at %v, found %v", replaced, history[0].ReplacedAt)
+	assert.Equal(t, "http://example.com/second", history[1].Orig)
+
+	// original of another link of the owner
+	err = repo.Update(ctx, first.Short, taken.Orig, replaced.Add(3*time.Second))
+	var exists usecase.ErrAlreadyExists
+	require.True(t, errors.As(err, &exists), "got %v", err)
+	assert.Equal(t, taken.Short, exists.ExistShortenID)
+
+	// previous original is free, the new one is taken
+	again := first
+	again.Short = "u1-again"
+	assert.NoError(t, repo.Store(ctx, &again))
+	again.Short, again.Orig = "u1-third", updated.Orig
+	err = repo.Store(ctx, &again)
+	require.True(t, errors.As(err, &exists), "got %v", err)
+	assert.Equal(t, first.Short, exists.ExistShortenID)
+
+	err = repo.Update(ctx, "missing", "http://example.com/", replaced)
+	assert.True(t, errors.Is(err, usecase.ErrNotFound), "missing link is ErrNotFound, got %v", err)
+	_, err = repo.History(ctx, "missing")
+	assert.True(t, errors.Is(err, usecase.ErrNotFound), "missing link is ErrNotFound, got %v", err)
+}
+
+func testClicks(t *testing.T, repo usecase.Repository) {
+	ctx := context.Background()
+	once := link("u1", 0)
+	once.MaxClicks, once.ClicksLeft = 1, 1
+	open := link("u1", 1)
+	require.NoError(t, repo.BatchWrite(ctx, []domain.URL{once, open}))
+
+	require.NoError(t, repo.Click(ctx, once.Short))
+	err := repo.Click(ctx, once.Short)
+	assert.True(t, errors.Is(err, usecase.ErrExhausted), "used up link is ErrExhausted, got %v", err)
+	found, err := repo.FindByKey(ctx, once.Short)
+	require.NoError(t, err)
+	used := once
+	used.ClicksLeft = 0
+	assertSame(t, used, found)
+	assert.Equal(t, []string{once.Short, open.Short}, shorts(repo.FindAll(ctx, "u1")), "link keeps its place")
+
+	require.NoError(t, repo.Click(ctx, open.Short))
+	found, err = repo.FindByKey(ctx, open.Short)
+	require.NoError(t, err)
+	assertSame(t, open, found)
+
+	err = repo.Click(ctx, "missing")
+	assert.True(t, errors.Is(err, usecase.ErrNotFound), "missing link is ErrNotFound, got %v", err)
+
+	// concurrent clicks never take more than there are
+	const clickers, clicks = 8, 5
+	limited := link("u2", 0)
+	limited.MaxClicks, limited.ClicksLeft = clicks, clicks
+	require.NoError(t, repo.Store(ctx, &limited))
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	taken, exhausted := 0, 0
+	for c := 0; c < clickers; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := repo.Click(ctx, limited.Short)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case err == nil:
+				taken++
+			case errors.Is(err, usecase.ErrExhausted):
+				exhausted++
+			default:
+				t.Errorf("click: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, clicks, taken)
+	assert.Equal(t, clickers-clicks, exhausted)
+}
+
+func testConcurrency(t *testing.T, repo usecase.Repository) {
+	ctx := context.Background()
+	const writers, perWriter = 4, 25
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			for i, url := range links(owner, perWriter) {
+				url := url
+				assert.NoError(t, repo.Store(ctx, &url))
+				// readers go along with writers
+				_, err := repo.FindByKey(ctx, url.Short)
+				assert.NoError(t, err)
+				if i%5 == 0 {
+					repo.FindAll(ctx, owner)
+				}
+			}
+		}(fmt.Sprintf("w%v", w))
+	}
+	wg.Wait()
+	for w := 0; w < writers; w++ {
+		assert.Len(t, repo.FindAll(ctx, fmt.Sprintf("w%v", w)), perWriter)
+	}
+
+	// the same original shortened at once by one owner is stored once
+	const racers = 8
+	var mutex sync.Mutex
+	stored := make([]string, 0, 1)
+	existing := make(map[string]int)
+	for r := 0; r < racers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			url := link("racer", 0)
+			url.Short = fmt.Sprintf("racer-%v", r)
+			err := repo.Store(ctx, &url)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			var exists usecase.ErrAlreadyExists
+			switch {
+			case err == nil:
+				stored = append(stored, url.Short)
+			case errors.As(err, &exists):
+				existing[exists.ExistShortenID]++
+			default:
+				t.Errorf("racer %v: %v", r, err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	require.Len(t, stored, 1)
+	assert.Equal(t, map[string]int{stored[0]: racers - 1}, existing)
+}
+
+func testCancellation(t *testing.T, repo usecase.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.BatchWrite(ctx, links("u1", 3)))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	err := repo.ForEach(canceled, "u1", func(*domain.URL) error {
+		return nil
+	})
+	assert.Error(t, err, "iteration stops when ctx is done")
+
+	url := link("u1", 5)
+	assert.Error(t, repo.BatchWrite(canceled, []domain.URL{url}), "write does not start when ctx is done")
+}
+
+func testDelete(t *testing.T, repo usecase.AdminRepository) {
+	ctx := context.Background()
+	require.NoError(t, repo.BatchWrite(ctx, links("u1", 2)))
+
+	require.NoError(t, repo.Delete(ctx, "u1-00000"))
+	_, err := repo.FindByKey(ctx, "u1-00000")
+	assert.True(t, errors.Is(err, usecase.ErrNotFound))
+	assert.Equal(t, []string{"u1-00001"}, shorts(repo.FindAll(ctx, "u1")))
+
+	assert.True(t, errors.Is(repo.Delete(ctx, "u1-00000"), usecase.ErrNotFound))
+
+	// original is free after delete
+	again := link("u1", 0)
+	again.Short = "u1-again"
+	assert.NoError(t, repo.Store(ctx, &again))
+}
+
+func testReassign(t *testing.T, repo usecase.AdminRepository) {
+	ctx := context.Background()
+	require.NoError(t, repo.BatchWrite(ctx, links("u1", 2)))
+
+	require.NoError(t, repo.Reassign(ctx, "u1-00000", "u2"))
+	assert.Equal(t, []string{"u1-00001"}, shorts(repo.FindAll(ctx, "u1")))
+	assert.Equal(t, []string{"u1-00000"}, shorts(repo.FindAll(ctx, "u2")))
+
+	found, err := repo.FindByKey(ctx, "u1-00000")
+	require.NoError(t, err)
+	assert.Equal(t, "u2", found.Owner)
+
+	assert.True(t, errors.Is(repo.Reassign(ctx, "missing", "u2"), usecase.ErrNotFound))
+}
+
+func testDeleteVersions(t *testing.T, repo usecase.AdminRepository) {
+	ctx := context.Background()
+	url := link("u1", 0)
+	require.NoError(t, repo.Store(ctx, &url))
+	require.NoError(t, repo.Update(ctx, url.Short, "http://example.com/second", epoch.Add(time.Hour)))
+	require.NoError(t, repo.Delete(ctx, url.Short))
+
+	// history goes with the link
+	require.NoError(t, repo.Store(ctx, &url))
+	history, err := repo.History(ctx, url.Short)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func testCountUsers(t *testing.T, repo usecase.AdminRepository) {
+	ctx := context.Background()
+
+	count, err := repo.CountUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	require.NoError(t, repo.BatchWrite(ctx, links("u1", 2)))
+	require.NoError(t, repo.BatchWrite(ctx, links("u2", 1)))
+	count, err = repo.CountUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func testDump(t *testing.T, repo usecase.AdminRepository) {
+	ctx := context.Background()
+	urls := append(links("u1", 3), links("u2", 2)...)
+	urls = append(urls, link("", 0))
+	urls[1].Redirect = 301
+	urls[2].PasswordHash = "$2a$10$hash"
+	launch := epoch.Add(time.Hour)
+	urls[3].NotBefore, urls[3].Placeholder = &launch, "http://example.com/soon"
+	require.NoError(t, repo.BatchWrite(ctx, urls))
+
+	dumped := make(map[string]*domain.URL)
+	require.NoError(t, repo.Dump(ctx, func(url *domain.URL) error {
+		dumped[url.Short] = url
+		return nil
+	}))
+	require.Len(t, dumped, len(urls))
+	for _, url := range urls {
+		assertSame(t, url, dumped[url.Short])
+	}
+}
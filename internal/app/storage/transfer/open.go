@@ -0,0 +1,82 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/boltdb"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/postgres"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/storage/sqlite"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+// Specs understood by Open
+const (
+	fileScheme     = "file:"
+	snapshotScheme = "snapshot:"
+	boltScheme     = "bolt:"
+	sqliteScheme   = "sqlite:"
+	postgresScheme = "postgres:"
+)
+
+// Open opens storage described by spec, which is one of
+//
+//	file:<path>                   file storage append log
+//	snapshot:<path>               memory storage loaded from dump file and saved on Close
+//	bolt:<path>                   bolt storage file
+//	sqlite:<path>                 sqlite database file
+//	postgres://... postgresql://  Postgres connection string
+//	postgres:<dsn>                Postgres connection string of key=value form
+//
+// pgOpts tune Postgres connection pool
+func Open(ctx context.Context, spec string, pgOpts ...postgres.Option) (usecase.AdminRepository, io.Closer, error) {
+	if strings.HasPrefix(spec, postgresScheme) && !strings.HasPrefix(spec, "postgres://") {
+		spec = strings.TrimPrefix(spec, postgresScheme)
+		if spec == "" {
+			return nil, nil, fmt.Errorf("postgres connection string is empty")
+		}
+		return openPostgres(ctx, spec, pgOpts)
+	}
+
+	switch {
+	case strings.HasPrefix(spec, fileScheme):
+		file, err := storage.NewPersistentStorage(strings.TrimPrefix(spec, fileScheme))
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't open file storage: %w", err)
+		}
+		return file, file, nil
+	case strings.HasPrefix(spec, snapshotScheme):
+		snapshot, err := storage.NewSnapshot(strings.TrimPrefix(spec, snapshotScheme))
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't load snapshot: %w", err)
+		}
+		return snapshot, snapshot, nil
+	case strings.HasPrefix(spec, boltScheme):
+		db, err := boltdb.Open(strings.TrimPrefix(spec, boltScheme))
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't open bolt storage: %w", err)
+		}
+		return db, db, nil
+	case strings.HasPrefix(spec, sqliteScheme):
+		db, err := sqlite.Open(ctx, strings.TrimPrefix(spec, sqliteScheme))
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't open sqlite storage: %w", err)
+		}
+		return db, db, nil
+	case strings.HasPrefix(spec, "postgres://"), strings.HasPrefix(spec, "postgresql://"):
+		return openPostgres(ctx, spec, pgOpts)
+	default:
+		return nil, nil, fmt.Errorf("unknown storage %q, use file:<path>, snapshot:<path>, bolt:<path>, sqlite:<path> or postgres:<dsn>", spec)
+	}
+}
+
+func openPostgres(ctx context.Context, dsn string, opts []postgres.Option) (usecase.AdminRepository, io.Closer, error) {
+	pg, err := postgres.NewDB(ctx, dsn, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't open database: %w", err)
+	}
+	return pg, pg, nil
+}
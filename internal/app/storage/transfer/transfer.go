@@ -0,0 +1,250 @@
+// Package transfer copies links and users from one storage into another
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/usecase"
+)
+
+// DefaultChunkSize bounds number of links written to target at once
+const DefaultChunkSize = 1000
+
+var (
+	// ErrConflict means target already has a link with the same id but other content
+	ErrConflict = errors.New("link differs in target")
+	// ErrMismatch means target does not hold every source link after copying
+	ErrMismatch = errors.New("target does not match source")
+)
+
+// Source gives every link it has
+type Source interface {
+	Dump(ctx context.Context, fn func(*domain.URL) error) error
+}
+
+// Target is written in chunks, links already present are looked up to skip them
+type Target interface {
+	FindByKey(ctx context.Context, key string) (*domain.URL, error)
+	BatchWrite(ctx context.Context, urls []domain.URL) error
+}
+
+// UserSource is a storage which knows users apart from their links
+type UserSource interface {
+	DumpUsers(ctx context.Context, fn func(string) error) error
+}
+
+// UserTarget is a storage which keeps users apart from their links
+type UserTarget interface {
+	RegisterUsers(ctx context.Context, users []string) error
+}
+
+// Checksum does not depend on order of links, so storages returning them
+// in different order have equal checksums
+type Checksum [sha256.Size]byte
+
+// Add mixes every persisted field of a link into checksum
+func (c *Checksum) Add(url *domain.URL) {
+	hash := sha256.New()
+	for _, field := range []string{url.Short, url.Orig, url.Owner, url.PasswordHash, url.Placeholder, url.Fallback} {
+		_ = binary.Write(hash, binary.BigEndian, uint32(len(field)))
+		hash.Write([]byte(field))
+	}
+	for _, field := range []int{url.Redirect, url.MaxClicks, url.ClicksLeft} {
+		_ = binary.Write(hash, binary.BigEndian, int64(field))
+	}
+	// storages keep time with microseconds and in various locations
+	_ = binary.Write(hash, binary.BigEndian, url.CreatedAt.UnixMicro())
+	for _, field := range []*time.Time{url.NotBefore, url.NotAfter} {
+		if field == nil {
+			hash.Write([]byte{0})
+			continue
+		}
+		hash.Write([]byte{1})
+		_ = binary.Write(hash, binary.BigEndian, field.UnixMicro())
+	}
+
+	var sum Checksum
+	hash.Sum(sum[:0])
+	for i := range c {
+		c[i] ^= sum[i]
+	}
+}
+
+func (c Checksum) String() string {
+	return hex.EncodeToString(c[:])
+}
+
+// Progress is reported after every chunk
+type Progress struct {
+	Read    int
+	Copied  int
+	Skipped int
+}
+
+// Report tells what is copied and how target is verified
+type Report struct {
+	Progress
+	Users    int
+	Checksum Checksum
+}
+
+// Option configures copying
+type Option func(*copier)
+
+// WithChunkSize sets number of links written to target at once
+func WithChunkSize(size int) Option {
+	return func(c *copier) {
+		if size > 0 {
+			c.chunkSize = size
+		}
+	}
+}
+
+// WithProgress sets a function called after every written chunk
+func WithProgress(fn func(Progress)) Option {
+	return func(c *copier) {
+		c.progress = fn
+	}
+}
+
+type copier struct {
+	chunkSize int
+	progress  func(Progress)
+}
+
+// Copy writes every source link with its id, owner, creation time and settings into target.
+// Links target already has with the same settings are skipped, so copying again after a failure or
+// into a partially filled target is safe, a link which differs in any of them is ErrConflict.
+// Target is verified against source at the end.
+// History of changed originals is not copied, target links start without previous versions.
+func Copy(ctx context.Context, src Source, dst Target, opts ...Option) (Report, error) {
+	c := copier{chunkSize: DefaultChunkSize, progress: func(Progress) {}}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	var report Report
+	users, err := copyUsers(ctx, src, dst)
+	if err != nil {
+		return report, fmt.Errorf("users are not copied: %w", err)
+	}
+	report.Users = users
+
+	chunk := make([]domain.URL, 0, c.chunkSize)
+	write := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := dst.BatchWrite(ctx, chunk); err != nil {
+			return err
+		}
+		report.Copied += len(chunk)
+		chunk = chunk[:0]
+		c.progress(report.Progress)
+		return nil
+	}
+
+	err = src.Dump(ctx, func(url *domain.URL) error {
+		report.Read++
+		copied, err := dst.FindByKey(ctx, url.Short)
+		switch {
+		case err == nil:
+			if !same(url, copied) {
+				return fmt.Errorf("%w: %v", ErrConflict, url.Short)
+			}
+			report.Skipped++
+			if report.Skipped%c.chunkSize == 0 {
+				c.progress(report.Progress)
+			}
+			return nil
+		case errors.Is(err, usecase.ErrNotFound):
+			chunk = append(chunk, *url)
+			if len(chunk) == c.chunkSize {
+				return write()
+			}
+			return nil
+		default:
+			return err
+		}
+	})
+	if err == nil && len(chunk) == 0 {
+		// nothing is left to write, progress is not reported yet for the tail of skipped links
+		c.progress(report.Progress)
+	}
+	if err == nil {
+		err = write()
+	}
+	if err != nil {
+		return report, fmt.Errorf("copying stopped after %v links: %w", report.Read, err)
+	}
+
+	report.Checksum, err = Verify(ctx, src, dst, report.Read)
+	return report, err
+}
+
+// copyUsers registers source users in target when both keep users apart from links
+func copyUsers(ctx context.Context, src Source, dst Target) (int, error) {
+	userSource, ok := src.(UserSource)
+	if !ok {
+		return 0, nil
+	}
+	userTarget, ok := dst.(UserTarget)
+	if !ok {
+		return 0, nil
+	}
+
+	var users []string
+	err := userSource.DumpUsers(ctx, func(user string) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(users) == 0 {
+		return 0, nil
+	}
+	return len(users), userTarget.RegisterUsers(ctx, users)
+}
+
+// Verify reads source once more and compares number of links and checksum
+// with the same links read from target, count is the number of links expected
+func Verify(ctx context.Context, src Source, dst Target, count int) (Checksum, error) {
+	var srcSum, dstSum Checksum
+	read := 0
+	err := src.Dump(ctx, func(url *domain.URL) error {
+		read++
+		srcSum.Add(url)
+		copied, err := dst.FindByKey(ctx, url.Short)
+		if err != nil {
+			return fmt.Errorf("%v: %w", url.Short, err)
+		}
+		dstSum.Add(copied)
+		return nil
+	})
+	if err != nil {
+		return srcSum, fmt.Errorf("verification failed: %w", err)
+	}
+	if read != count {
+		return srcSum, fmt.Errorf("%w: source has %v links, %v are copied", ErrMismatch, read, count)
+	}
+	if srcSum != dstSum {
+		return srcSum, fmt.Errorf("%w: checksum %v, target has %v", ErrMismatch, srcSum, dstSum)
+	}
+	return srcSum, nil
+}
+
+// same compares links by every field checksum covers
+func same(a, b *domain.URL) bool {
+	var sumA, sumB Checksum
+	sumA.Add(a)
+	sumB.Add(b)
+	return sumA == sumB
+}
@@ -0,0 +1,150 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	src, srcCloser, err := Open(ctx, "file:"+filepath.Join(dir, "links.log"))
+	require.NoError(t, err)
+	defer srcCloser.Close()
+
+	created := time.Date(2022, 5, 1, 10, 0, 0, 123456000, time.UTC)
+	notAfter := created.Add(time.Hour)
+	links := []domain.URL{
+		{Short: "a", Orig: "http://a.com/", Owner: "u1", CreatedAt: created},
+		{Short: "b", Orig: "http://b.com/", Owner: "u1", CreatedAt: created.Add(time.Second)},
+		{Short: "c", Orig: "http://c.com/", Owner: "u2", CreatedAt: created},
+		{Short: "d", Orig: "http://d.com/"},
+		{Short: "e", Orig: "http://e.com/", Owner: "u2", CreatedAt: created, Redirect: 301, PasswordHash: "hash",
+			MaxClicks: 5, ClicksLeft: 3, NotBefore: &created, NotAfter: &notAfter,
+			Placeholder: "http://soon.com/", Fallback: "http://gone.com/"},
+	}
+	require.NoError(t, src.BatchWrite(ctx, links))
+
+	snapshot := "snapshot:" + filepath.Join(dir, "links.json")
+	dst, dstCloser, err := Open(ctx, snapshot)
+	require.NoError(t, err)
+
+	var progress []Progress
+	report, err := Copy(ctx, src, dst, WithChunkSize(3), WithProgress(func(p Progress) {
+		progress = append(progress, p)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, Progress{Read: 5, Copied: 5}, report.Progress)
+	assert.Equal(t, []Progress{{Read: 3, Copied: 3}, {Read: 5, Copied: 5}}, progress)
+	require.NoError(t, dstCloser.Close())
+
+	// snapshot is saved and copying into it again changes nothing
+	dst, dstCloser, err = Open(ctx, snapshot)
+	require.NoError(t, err)
+	defer dstCloser.Close()
+
+	again, err := Copy(ctx, src, dst)
+	require.NoError(t, err)
+	assert.Equal(t, Progress{Read: 5, Skipped: 5}, again.Progress)
+	assert.Equal(t, report.Checksum, again.Checksum)
+
+	for _, link := range links {
+		copied, err := dst.FindByKey(ctx, link.Short)
+		require.NoError(t, err)
+		assert.Equal(t, link.Orig, copied.Orig)
+		assert.Equal(t, link.Owner, copied.Owner)
+		assert.True(t, link.CreatedAt.Equal(copied.CreatedAt))
+		assert.Equal(t, link.Redirect, copied.Redirect)
+		assert.Equal(t, link.PasswordHash, copied.PasswordHash)
+		assert.Equal(t, link.ClicksLeft, copied.ClicksLeft)
+		assert.Equal(t, link.Fallback, copied.Fallback)
+	}
+	count, err := dst.CountUsers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestCopy_Conflict(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	src, _, err := Open(ctx, "snapshot:"+filepath.Join(dir, "src.json"))
+	require.NoError(t, err)
+	dst, _, err := Open(ctx, "snapshot:"+filepath.Join(dir, "dst.json"))
+	require.NoError(t, err)
+
+	require.NoError(t, src.Store(ctx, &domain.URL{Short: "a", Orig: "http://a.com/", Owner: "u1"}))
+	require.NoError(t, dst.Store(ctx, &domain.URL{Short: "a", Orig: "http://other.com/", Owner: "u1"}))
+
+	_, err = Copy(ctx, src, dst)
+	assert.True(t, errors.Is(err, ErrConflict), err)
+}
+
+func TestCopy_SettingsConflict(t *testing.T) {
+	ctx := context.Background()
+	notAfter := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	link := domain.URL{Short: "a", Orig: "http://a.com/", Owner: "u1", MaxClicks: 5, ClicksLeft: 5, NotAfter: &notAfter}
+
+	changes := map[string]func(*domain.URL){
+		"redirect":     func(u *domain.URL) { u.Redirect = 308 },
+		"password":     func(u *domain.URL) { u.PasswordHash = "hash" },
+		"max clicks":   func(u *domain.URL) { u.MaxClicks = 10 },
+		"clicks left":  func(u *domain.URL) { u.ClicksLeft = 4 },
+		"not before":   func(u *domain.URL) { u.NotBefore = &notAfter },
+		"not after":    func(u *domain.URL) { later := notAfter.Add(time.Hour); u.NotAfter = &later },
+		"no not after": func(u *domain.URL) { u.NotAfter = nil },
+		"placeholder":  func(u *domain.URL) { u.Placeholder = "http://soon.com/" },
+		"fallback":     func(u *domain.URL) { u.Fallback = "http://gone.com/" },
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, _, err := Open(ctx, "snapshot:"+filepath.Join(dir, "src.json"))
+			require.NoError(t, err)
+			dst, _, err := Open(ctx, "snapshot:"+filepath.Join(dir, "dst.json"))
+			require.NoError(t, err)
+
+			changed := link
+			change(&changed)
+			require.NoError(t, src.BatchWrite(ctx, []domain.URL{link}))
+			require.NoError(t, dst.BatchWrite(ctx, []domain.URL{changed}))
+
+			_, err = Copy(ctx, src, dst)
+			assert.True(t, errors.Is(err, ErrConflict), err)
+		})
+	}
+}
+
+func TestChecksum_OrderIndependent(t *testing.T) {
+	a := &domain.URL{Short: "a", Orig: "http://a.com/", Owner: "u1"}
+	b := &domain.URL{Short: "b", Orig: "http://b.com/", Owner: "u1"}
+
+	var forward, backward Checksum
+	forward.Add(a)
+	forward.Add(b)
+	backward.Add(b)
+	backward.Add(a)
+	assert.Equal(t, forward, backward)
+
+	// fields do not run into each other
+	var split1, split2 Checksum
+	split1.Add(&domain.URL{Short: "ab", Orig: "c"})
+	split2.Add(&domain.URL{Short: "a", Orig: "bc"})
+	assert.NotEqual(t, split1, split2)
+}
+
+func TestOpen_Unknown(t *testing.T) {
+	ctx := context.Background()
+	_, _, err := Open(ctx, "mysql://localhost")
+	assert.Error(t, err)
+	_, _, err = Open(ctx, "postgres:")
+	assert.Error(t, err)
+}
@@ -1,65 +1,273 @@
 package usecase
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
 )
 
+// Repository methods stop when ctx is done, so a client which has gone does not hold storage.
+// Every storage keeps the same contract, it is checked by storagetest package
 type Repository interface {
-	Store(*domain.URL) error
-	FindByKey(string) (*domain.URL, error)
-	FindAll(string) []*domain.URL
-	BatchWrite([]domain.URL) error
+	// Store reports a link of original its owner has already shortened with ErrAlreadyExists,
+	// storing the same link again is not an error
+	Store(context.Context, *domain.URL) error
+	// FindByKey reports a missing link with ErrNotFound
+	FindByKey(context.Context, string) (*domain.URL, error)
+	// FindAll returns user links in creation order, a user without links gets an empty slice
+	FindAll(context.Context, string) []*domain.URL
+	FindPage(context.Context, string, PageQuery) (Page, error)
+	// ForEach streams every user link in creation order, iteration stops on the first fn error
+	ForEach(context.Context, string, func(*domain.URL) error) error
+	// BatchWrite writes links which do not conflict and reports the rest with ErrBatchConflicts,
+	// an empty batch is not an error
+	BatchWrite(context.Context, []domain.URL) error
+	// Update changes original of the link and keeps the previous one in its history as replaced at given time.
+	// Changing to the same original is not an error, an original the owner has shortened
+	// under another id is reported with ErrAlreadyExists, a missing link with ErrNotFound
+	Update(ctx context.Context, key string, orig string, at time.Time) error
+	// History returns previous originals of the link from the oldest one, a missing link is ErrNotFound
+	History(context.Context, string) ([]domain.Version, error)
+	// Click takes one of clicks left of a link with limited clicks atomically, so concurrent clicks never
+	// take more than there are. A used up link is reported with ErrExhausted, a missing one with ErrNotFound,
+	// clicks of links without a limit are not counted
+	Click(context.Context, string) error
+}
+
+// AdminRepository is a Repository which can be maintained offline
+type AdminRepository interface {
+	Repository
+	Delete(context.Context, string) error
+	// Reassign gives link to another owner
+	Reassign(context.Context, string, string) error
+	CountUsers(context.Context) (int, error)
+	// Dump streams links of every user, iteration stops on the first fn error
+	Dump(context.Context, func(*domain.URL) error) error
 }
 
 type InputPort interface {
-	Shorten(string, string) (string, error)
-	RestoreOrigin(string) (string, error)
-	ShowAll(string) ([]*domain.URL, error)
-	ShortenBatch(input []Correlation, user string) ([]OutputBatchItem, error)
+	Shorten(ctx context.Context, url string, user string, settings LinkSettings) (string, error)
+	// RestoreOrigin follows a link, password is checked for protected links only
+	RestoreOrigin(ctx context.Context, id string, password string) (Redirect, error)
+	ShowPage(ctx context.Context, user string, query PageQuery) (Page, error)
+	Export(ctx context.Context, user string, fn func(ExportItem) error) error
+	ShortenBatch(ctx context.Context, input []Correlation, user string) ([]OutputBatchItem, error)
+	ChangeOrigin(ctx context.Context, id string, url string, user string) (LinkVersions, error)
+}
+
+// DestinationPolicy decides whether an original url may be shortened and followed
+type DestinationPolicy interface {
+	Check(destination string) error
 }
 
 type Shorten struct {
 	shortener *domain.Shortener
 	repo      Repository
+	sortQuery bool
+	policy    DestinationPolicy
+	redirect  int
+	attempts  *attemptLimiter
+	clock     func() time.Time
+}
+
+// Option configures optional Shorten behaviour
+type Option func(*Shorten)
+
+// WithQuerySorting makes URLs which differ in query parameters order only be the same URL
+func WithQuerySorting(sort bool) Option {
+	return func(s *Shorten) {
+		s.sortQuery = sort
+	}
+}
+
+// WithPolicy makes every destination be checked before storing and before redirecting
+func WithPolicy(policy DestinationPolicy) Option {
+	return func(s *Shorten) {
+		s.policy = policy
+	}
+}
+
+// WithDefaultRedirect sets HTTP status of links created without one, it must be valid by ValidateRedirect
+func WithDefaultRedirect(status int) Option {
+	return func(s *Shorten) {
+		s.redirect = status
+	}
+}
+
+// WithClock replaces system clock, so behaviour depending on time can be tested with a fake one
+func WithClock(clock func() time.Time) Option {
+	return func(s *Shorten) {
+		s.clock = clock
+	}
 }
 
-func NewShorten(shortener *domain.Shortener, repo Repository) *Shorten {
-	return &Shorten{
+// DefaultRedirect is a status of links when neither link nor server say otherwise
+const DefaultRedirect = 307
+
+// windowRedirect is a status of placeholder and fallback redirects, they are temporary by nature
+const windowRedirect = 307
+
+// ValidateRedirect accepts redirect statuses a link may answer with, 301 and 308 are permanent
+func ValidateRedirect(status int) error {
+	switch status {
+	case 301, 302, 307, 308:
+		return nil
+	default:
+		return NewError(KindInvalidInput, fmt.Errorf("redirect %v is not supported", status),
+			"Sorry, redirect must be one of 301, 302, 307 and 308")
+	}
+}
+
+// applySettings checks settings given by link creator and keeps them with the link
+func (s *Shorten) applySettings(url *domain.URL, settings LinkSettings) error {
+	if settings.Redirect != 0 {
+		if err := ValidateRedirect(settings.Redirect); err != nil {
+			return err
+		}
+	}
+	if settings.MaxClicks < 0 {
+		return NewError(KindInvalidInput, fmt.Errorf("max clicks %v is negative", settings.MaxClicks),
+			"Sorry, max clicks must be positive")
+	}
+	if err := s.applyWindow(url, settings); err != nil {
+		return err
+	}
+	hash, err := hashPassword(settings.Password)
+	if err != nil {
+		return err
+	}
+	url.Redirect = settings.Redirect
+	url.PasswordHash = hash
+	url.MaxClicks = settings.MaxClicks
+	url.ClicksLeft = settings.MaxClicks
+	return nil
+}
+
+// applyWindow checks the window link works in, placeholder needs a start of the window and fallback its end
+func (s *Shorten) applyWindow(url *domain.URL, settings LinkSettings) error {
+	if settings.NotBefore != nil && settings.NotAfter != nil && !settings.NotAfter.After(*settings.NotBefore) {
+		return NewError(KindInvalidInput, fmt.Errorf("window from %v to %v is empty", settings.NotBefore, settings.NotAfter),
+			"Sorry, not_after must be later than not_before")
+	}
+	if settings.PlaceholderURL != "" && settings.NotBefore == nil {
+		return NewError(KindInvalidInput, errors.New("placeholder of a link without start"),
+			"Sorry, placeholder_url needs not_before")
+	}
+	if settings.FallbackURL != "" && settings.NotAfter == nil {
+		return NewError(KindInvalidInput, errors.New("fallback of a link without end"),
+			"Sorry, fallback_url needs not_after")
+	}
+
+	var err error
+	if settings.PlaceholderURL != "" {
+		if url.Placeholder, err = s.validate(settings.PlaceholderURL); err != nil {
+			return err
+		}
+	}
+	if settings.FallbackURL != "" {
+		if url.Fallback, err = s.validate(settings.FallbackURL); err != nil {
+			return err
+		}
+	}
+	url.NotBefore = storedTime(settings.NotBefore)
+	url.NotAfter = storedTime(settings.NotAfter)
+	return nil
+}
+
+// storedTime truncates optional time like creation time is
+func storedTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	stored := t.UTC().Truncate(time.Microsecond)
+	return &stored
+}
+
+func NewShorten(shortener *domain.Shortener, repo Repository, opts ...Option) *Shorten {
+	s := &Shorten{
 		shortener: shortener,
 		repo:      repo,
+		redirect:  DefaultRedirect,
+		attempts:  newAttemptLimiter(DefaultPasswordAttempts, DefaultPasswordWindow),
+		clock:     time.Now,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
-func (s *Shorten) ShortenBatch(input []Correlation, user string) ([]OutputBatchItem, error) {
+// ShortenBatch validates every item on its own, invalid items are reported
+// by correlation id and do not prevent others from being shortened
+func (s *Shorten) ShortenBatch(ctx context.Context, input []Correlation, user string) ([]OutputBatchItem, error) {
 
-	output := make([]OutputBatchItem, 0)
-	urls := make([]domain.URL, 0)
+	output := make([]OutputBatchItem, 0, len(input))
+	urls := make([]domain.URL, 0, len(input))
+	// positions maps index of url to index of its output item
+	positions := make([]int, 0, len(input))
 	for _, inputPair := range input {
 
-		url := s.shortener.MakeShort(inputPair.OriginalURL)
-		url.Owner = user
-
 		out := OutputBatchItem{
 			CorrelationID: inputPair.CorrelationID,
-			ShortURL:      url.Short,
 		}
+
+		normalized, err := s.validate(inputPair.OriginalURL)
+		var url *domain.URL
+		if err == nil {
+			url = s.shortener.MakeShort(normalized)
+			err = s.applySettings(url, inputPair.LinkSettings)
+		}
+		if err != nil {
+			out.Error = PrettyOf(err)
+			output = append(output, out)
+			continue
+		}
+
+		url.Owner = user
+		url.CreatedAt = s.now()
+
+		out.ShortURL = url.Short
 		urls = append(urls, *url)
+		positions = append(positions, len(output))
 		output = append(output, out)
 	}
 
-	err := s.repo.BatchWrite(urls)
+	if len(urls) == 0 {
+		return output, nil
+	}
+
+	err := s.repo.BatchWrite(ctx, urls)
+	var conflicts ErrBatchConflicts
+	if errors.As(err, &conflicts) {
+		// urls shortened before are answered with existing short urls
+		for i, existing := range conflicts.Conflicts {
+			out := &output[positions[i]]
+			out.ShortURL = existing.ExistShortenID
+			out.Conflict = true
+		}
+		err = nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, NewError(KindUnavailable, err, "")
 	}
 
 	return output, nil
 }
 
-func (s *Shorten) Shorten(url string, userID string) (string, error) {
-	short := s.shortener.MakeShort(url)
+func (s *Shorten) Shorten(ctx context.Context, url string, userID string, settings LinkSettings) (string, error) {
+	normalized, err := s.validate(url)
+	if err != nil {
+		return "", err
+	}
+
+	short := s.shortener.MakeShort(normalized)
+	if err = s.applySettings(short, settings); err != nil {
+		return "", err
+	}
+	short.CreatedAt = s.now()
 	var user *domain.User = nil
 	if userID != "" {
 		user = &domain.User{
@@ -68,27 +276,239 @@ func (s *Shorten) Shorten(url string, userID string) (string, error) {
 		short.Owner = user.ID
 	}
 
-	err := s.repo.Store(short)
+	err = s.repo.Store(ctx, short)
 	if err != nil {
 		if errors.As(err, &ErrAlreadyExists{}) {
 			return "", err
 		}
+		return "", NewError(KindUnavailable, err, "")
 	}
 	return short.Short, nil
 }
 
-func (s *Shorten) RestoreOrigin(id string) (string, error) {
-	url, err := s.repo.FindByKey(id)
+// RestoreOrigin returns original url of the short one with status to redirect with, blocked
+// destinations are returned along with an error to be shown to user
+func (s *Shorten) RestoreOrigin(ctx context.Context, id string, password string) (Redirect, error) {
+	url, err := s.repo.FindByKey(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return Redirect{}, NewError(KindNotFound, err, fmt.Sprintf("Sorry, short link %v does not exist", id))
+		}
+		return Redirect{}, NewError(KindUnavailable, err, "")
+	}
+
+	// placeholder and fallback are not protected, they are there for everyone
+	if redirect, outside, err := s.outsideWindow(url); outside {
+		return redirect, err
+	}
+	// destination is not disclosed until the password is right
+	if err = s.checkPassword(id, url.PasswordHash, password); err != nil {
+		return Redirect{}, err
+	}
+
+	redirect := Redirect{
+		Location:  url.Orig,
+		Status:    url.Redirect,
+		Protected: url.PasswordHash != "",
+		Limited:   url.MaxClicks > 0,
+		Scheduled: url.NotBefore != nil || url.NotAfter != nil,
+	}
+	if redirect.Status == 0 {
+		redirect.Status = s.redirect
+	}
+	// rules may have changed since the link was created
+	if err = s.checkPolicy(url.Orig); err != nil {
+		return redirect, err
+	}
+	// blocked and wrong password attempts do not use clicks up
+	if redirect.Limited {
+		if err = s.click(ctx, id); err != nil {
+			return Redirect{}, err
+		}
+	}
+	return redirect, nil
+}
+
+// outsideWindow answers a link followed before its window with placeholder and after it with fallback,
+// without them the link does not exist yet and is gone after. It reports false within the window
+func (s *Shorten) outsideWindow(url *domain.URL) (Redirect, bool, error) {
+	now := s.now()
+	var location string
+	switch {
+	case url.NotBefore != nil && now.Before(*url.NotBefore):
+		if url.Placeholder == "" {
+			return Redirect{}, true, NewError(KindNotFound, fmt.Errorf("link %v works from %v", url.Short, url.NotBefore),
+				fmt.Sprintf("Sorry, short link %v does not exist", url.Short))
+		}
+		location = url.Placeholder
+	case url.NotAfter != nil && !now.Before(*url.NotAfter):
+		if url.Fallback == "" {
+			return Redirect{}, true, NewError(KindGone, fmt.Errorf("link %v worked till %v", url.Short, url.NotAfter),
+				fmt.Sprintf("Sorry, short link %v has expired", url.Short))
+		}
+		location = url.Fallback
+	default:
+		return Redirect{}, false, nil
+	}
+
+	redirect := Redirect{Location: location, Status: windowRedirect, Scheduled: true}
+	if err := s.checkPolicy(location); err != nil {
+		return redirect, true, err
+	}
+	return redirect, true, nil
+}
+
+// click takes a click of a limited link, the link read before may have been used up since
+func (s *Shorten) click(ctx context.Context, id string) error {
+	err := s.repo.Click(ctx, id)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrExhausted):
+		return NewError(KindGone, err, fmt.Sprintf("Sorry, short link %v has been used up", id))
+	case errors.Is(err, ErrNotFound):
+		return NewError(KindNotFound, err, fmt.Sprintf("Sorry, short link %v does not exist", id))
+	default:
+		return NewError(KindUnavailable, err, "")
+	}
+}
+
+// ShowPage returns a page of user links, page size is bounded by MaxPageLimit
+func (s *Shorten) ShowPage(ctx context.Context, user string, query PageQuery) (Page, error) {
+	if query.Limit <= 0 {
+		query.Limit = DefaultPageLimit
+	}
+	if query.Limit > MaxPageLimit {
+		query.Limit = MaxPageLimit
+	}
+
+	page, err := s.repo.FindPage(ctx, user, query)
+	if err != nil {
+		return Page{}, NewError(KindUnavailable, err, "")
+	}
+	return page, nil
+}
+
+// Export streams every user link with its metadata to fn, links are not loaded into memory at once.
+// Errors of fn are returned as is, so caller can tell them from storage ones
+func (s *Shorten) Export(ctx context.Context, user string, fn func(ExportItem) error) error {
+	var fnErr error
+	err := s.repo.ForEach(ctx, user, func(url *domain.URL) error {
+		item := ExportItem{
+			ShortURL:    url.Short,
+			OriginalURL: url.Orig,
+			CreatedAt:   url.CreatedAt,
+			Status:      s.status(url),
+			MaxClicks:   url.MaxClicks,
+		}
+		if url.MaxClicks > 0 {
+			clicks := url.MaxClicks - url.ClicksLeft
+			item.Clicks = &clicks
+		}
+		fnErr = fn(item)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
 	if err != nil {
+		return NewError(KindUnavailable, err, "")
+	}
+	return nil
+}
+
+// ChangeOrigin points user link to another original, the new one is validated like a shortened one.
+// Links of other users are reported as missing, so their ids are not disclosed
+func (s *Shorten) ChangeOrigin(ctx context.Context, id string, url string, user string) (LinkVersions, error) {
+	stored, err := s.repo.FindByKey(ctx, id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return LinkVersions{}, NewError(KindUnavailable, err, "")
+	}
+	if err != nil || stored.Owner == "" || stored.Owner != user {
+		if err == nil {
+			err = fmt.Errorf("link %v is not owned by user: %w", id, ErrNotFound)
+		}
+		return LinkVersions{}, NewError(KindNotFound, err, fmt.Sprintf("Sorry, you have no short link %v", id))
+	}
+
+	normalized, err := s.validate(url)
+	if err != nil {
+		return LinkVersions{}, err
+	}
+
+	err = s.repo.Update(ctx, id, normalized, s.now())
+	if err != nil {
+		if errors.As(err, &ErrAlreadyExists{}) {
+			return LinkVersions{}, err
+		}
+		if errors.Is(err, ErrNotFound) {
+			// deleted meanwhile
+			return LinkVersions{}, NewError(KindNotFound, err, fmt.Sprintf("Sorry, you have no short link %v", id))
+		}
+		return LinkVersions{}, NewError(KindUnavailable, err, "")
+	}
+
+	history, err := s.repo.History(ctx, id)
+	if err != nil {
+		return LinkVersions{}, NewError(KindUnavailable, err, "")
+	}
+	versions := LinkVersions{
+		ShortURL:    id,
+		OriginalURL: normalized,
+		Version:     len(history) + 1,
+		History:     make([]LinkVersion, 0, len(history)),
+	}
+	for i, version := range history {
+		versions.History = append(versions.History, LinkVersion{
+			Version:     i + 1,
+			OriginalURL: version.Orig,
+			ReplacedAt:  version.ReplacedAt,
+		})
+	}
+	return versions, nil
+}
+
+// status tells if link is followed now
+func (s *Shorten) status(url *domain.URL) string {
+	if s.checkPolicy(url.Orig) != nil {
+		return StatusBlocked
+	}
+	now := s.now()
+	if url.NotBefore != nil && now.Before(*url.NotBefore) {
+		return StatusScheduled
+	}
+	if url.NotAfter != nil && !now.Before(*url.NotAfter) {
+		return StatusExpired
+	}
+	if url.MaxClicks > 0 && url.ClicksLeft == 0 {
+		return StatusUsedUp
+	}
+	return StatusActive
+}
+
+// now is current time of the clock, truncated to be stored equally by every storage
+func (s *Shorten) now() time.Time {
+	return s.clock().UTC().Truncate(time.Microsecond)
+}
+
+// validate normalizes url and checks it against destination policy
+func (s *Shorten) validate(url string) (string, error) {
+	normalized, err := normalizeURL(url, s.sortQuery)
+	if err != nil {
+		return "", err
+	}
+	if err = s.checkPolicy(normalized); err != nil {
 		return "", err
 	}
-	return url.Orig, nil
+	return normalized, nil
 }
 
-func (s *Shorten) ShowAll(user string) ([]*domain.URL, error) {
-	list := s.repo.FindAll(user)
-	if list == nil || len(list) < 1 {
-		return nil, fmt.Errorf("seems you %v do not have any shortened links yet", user)
+func (s *Shorten) checkPolicy(destination string) error {
+	if s.policy == nil {
+		return nil
+	}
+	if err := s.policy.Check(destination); err != nil {
+		return NewError(KindBlocked, err, "")
 	}
-	return list, nil
+	return nil
 }
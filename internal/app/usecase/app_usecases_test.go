@@ -0,0 +1,385 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sequenceGenerator makes short ids a0000, a0001 and so on
+type sequenceGenerator struct {
+	next int
+}
+
+func (g *sequenceGenerator) Generate() domain.Shorten {
+	var short domain.Shorten
+	copy(short[:], "a0000")
+	short[len(short)-1] += byte(g.next)
+	g.next++
+	return short
+}
+
+// conflictRepository reports every link of given originals as already existing
+type conflictRepository struct {
+	Repository
+	existing map[string]string
+	written  []domain.URL
+}
+
+func (r *conflictRepository) BatchWrite(_ context.Context, urls []domain.URL) error {
+	conflicts := make(map[int]ErrAlreadyExists)
+	for i, url := range urls {
+		if id, ok := r.existing[url.Orig]; ok {
+			conflicts[i] = ErrAlreadyExists{ExistShortenID: id, Orig: url.Orig}
+			continue
+		}
+		r.written = append(r.written, url)
+	}
+	if len(conflicts) > 0 {
+		return ErrBatchConflicts{Conflicts: conflicts}
+	}
+	return nil
+}
+
+func TestShorten_ShortenBatchConflicts(t *testing.T) {
+	repo := &conflictRepository{existing: map[string]string{"http://b.com/": "old"}}
+	s := NewShorten(domain.NewShortener(&sequenceGenerator{}), repo)
+
+	output, err := s.ShortenBatch(context.Background(), []Correlation{
+		{CorrelationID: "1", OriginalURL: "http://a.com/"},
+		{CorrelationID: "2", OriginalURL: "not a url"},
+		{CorrelationID: "3", OriginalURL: "http://b.com/"},
+		{CorrelationID: "4", OriginalURL: "http://c.com/"},
+	}, "user")
+	require.NoError(t, err)
+
+	require.Len(t, output, 4)
+	assert.Equal(t, OutputBatchItem{CorrelationID: "1", ShortURL: "a0000"}, output[0])
+	assert.NotEmpty(t, output[1].Error)
+	assert.Equal(t, OutputBatchItem{CorrelationID: "3", ShortURL: "old", Conflict: true}, output[2])
+	assert.Equal(t, OutputBatchItem{CorrelationID: "4", ShortURL: "a0002"}, output[3])
+	assert.Len(t, repo.written, 2)
+}
+
+// versionRepository holds a single link and its history
+type versionRepository struct {
+	Repository
+	url     domain.URL
+	history []domain.Version
+}
+
+func (r *versionRepository) FindByKey(_ context.Context, key string) (*domain.URL, error) {
+	if key != r.url.Short {
+		return nil, ErrNotFound
+	}
+	url := r.url
+	return &url, nil
+}
+
+func (r *versionRepository) Update(_ context.Context, _ string, orig string, at time.Time) error {
+	r.history = append(r.history, domain.Version{Orig: r.url.Orig, ReplacedAt: at})
+	r.url.Orig = orig
+	return nil
+}
+
+func (r *versionRepository) History(context.Context, string) ([]domain.Version, error) {
+	return r.history, nil
+}
+
+// blockedHost rejects destinations of a host
+type blockedHost string
+
+func (b blockedHost) Check(destination string) error {
+	if strings.Contains(destination, string(b)) {
+		return errors.New("host is blocked")
+	}
+	return nil
+}
+
+func TestShorten_ChangeOrigin(t *testing.T) {
+	ctx := context.Background()
+	repo := &versionRepository{url: domain.URL{Short: "a0000", Orig: "http://a.com/", Owner: "user"}}
+	s := NewShorten(domain.NewShortener(&sequenceGenerator{}), repo, WithPolicy(blockedHost("evil.com")))
+
+	versions, err := s.ChangeOrigin(ctx, "a0000", "HTTP://B.com", "user")
+	require.NoError(t, err)
+	assert.Equal(t, "a0000", versions.ShortURL)
+	assert.Equal(t, "http://b.com", versions.OriginalURL, "original is normalized")
+	assert.Equal(t, 2, versions.Version)
+	require.Len(t, versions.History, 1)
+	assert.Equal(t, LinkVersion{Version: 1, OriginalURL: "http://a.com/", ReplacedAt: repo.history[0].ReplacedAt}, versions.History[0])
+
+	_, err = s.ChangeOrigin(ctx, "a0000", "http://c.com/", "another")
+	assert.Equal(t, KindNotFound, KindOf(err), "links of other users are not disclosed")
+	_, err = s.ChangeOrigin(ctx, "missing", "http://c.com/", "user")
+	assert.Equal(t, KindNotFound, KindOf(err))
+	_, err = s.ChangeOrigin(ctx, "a0000", "not a url", "user")
+	assert.Equal(t, KindInvalidInput, KindOf(err))
+	_, err = s.ChangeOrigin(ctx, "a0000", "http://evil.com/", "user")
+	assert.Equal(t, KindBlocked, KindOf(err))
+	assert.Len(t, repo.history, 1, "rejected originals are not stored")
+}
+
+// linkRepository keeps stored links by short id
+type linkRepository struct {
+	Repository
+	urls map[string]domain.URL
+}
+
+func (r *linkRepository) Store(_ context.Context, url *domain.URL) error {
+	r.urls[url.Short] = *url
+	return nil
+}
+
+func (r *linkRepository) BatchWrite(_ context.Context, urls []domain.URL) error {
+	for _, url := range urls {
+		r.urls[url.Short] = url
+	}
+	return nil
+}
+
+func (r *linkRepository) FindByKey(_ context.Context, key string) (*domain.URL, error) {
+	url, ok := r.urls[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &url, nil
+}
+
+func TestShorten_Redirect(t *testing.T) {
+	ctx := context.Background()
+	repo := &linkRepository{urls: make(map[string]domain.URL)}
+	s := NewShorten(domain.NewShortener(&sequenceGenerator{}), repo, WithDefaultRedirect(302))
+
+	byDefault, err := s.Shorten(ctx, "http://a.com/", "user", LinkSettings{})
+	require.NoError(t, err)
+	permanent, err := s.Shorten(ctx, "http://b.com/", "user", LinkSettings{Redirect: 301})
+	require.NoError(t, err)
+	_, err = s.Shorten(ctx, "http://c.com/", "user", LinkSettings{Redirect: 200})
+	assert.Equal(t, KindInvalidInput, KindOf(err))
+	assert.Len(t, repo.urls, 2)
+
+	redirect, err := s.RestoreOrigin(ctx, byDefault, "")
+	require.NoError(t, err)
+	assert.Equal(t, Redirect{Location: "http://a.com/", Status: 302}, redirect)
+	assert.False(t, redirect.Permanent())
+	redirect, err = s.RestoreOrigin(ctx, permanent, "")
+	require.NoError(t, err)
+	assert.Equal(t, Redirect{Location: "http://b.com/", Status: 301}, redirect)
+	assert.True(t, redirect.Permanent())
+
+	output, err := s.ShortenBatch(ctx, []Correlation{
+		{CorrelationID: "1", OriginalURL: "http://d.com/", LinkSettings: LinkSettings{Redirect: 308}},
+		{CorrelationID: "2", OriginalURL: "http://e.com/", LinkSettings: LinkSettings{Redirect: 303}},
+	}, "user")
+	require.NoError(t, err)
+	require.Len(t, output, 2)
+	assert.Equal(t, 308, repo.urls[output[0].ShortURL].Redirect)
+	assert.NotEmpty(t, output[1].Error, "only 301, 302, 307 and 308 are allowed")
+}
+
+func TestShorten_Password(t *testing.T) {
+	ctx := context.Background()
+	repo := &linkRepository{urls: make(map[string]domain.URL)}
+	s := NewShorten(domain.NewShortener(&sequenceGenerator{}), repo, WithPasswordAttempts(2, time.Hour))
+
+	protected, err := s.Shorten(ctx, "http://a.com/", "user", LinkSettings{Password: "secret"})
+	require.NoError(t, err)
+	assert.NotContains(t, repo.urls[protected].PasswordHash, "secret", "password is stored as a hash")
+	_, err = s.Shorten(ctx, "http://b.com/", "user", LinkSettings{Password: strings.Repeat("x", MaxPasswordLength+1)})
+	assert.Equal(t, KindInvalidInput, KindOf(err))
+
+	redirect, err := s.RestoreOrigin(ctx, protected, "")
+	assert.Equal(t, KindUnauthorized, KindOf(err))
+	assert.ErrorIs(t, err, ErrPasswordRequired)
+	assert.Empty(t, redirect.Location, "destination is not disclosed")
+
+	_, err = s.RestoreOrigin(ctx, protected, "wrong")
+	assert.Equal(t, KindUnauthorized, KindOf(err))
+	assert.ErrorIs(t, err, ErrPasswordRequired)
+	// right passwords are not attempts, the link is opened as often as needed
+	for i := 0; i <= DefaultPasswordAttempts; i++ {
+		redirect, err = s.RestoreOrigin(ctx, protected, "secret")
+		require.NoError(t, err)
+		assert.Equal(t, Redirect{Location: "http://a.com/", Status: DefaultRedirect, Protected: true}, redirect)
+	}
+	_, err = s.RestoreOrigin(ctx, protected, "wrong")
+	assert.Equal(t, KindUnauthorized, KindOf(err))
+	_, err = s.RestoreOrigin(ctx, protected, "secret")
+	assert.Equal(t, KindRateLimited, KindOf(err), "wrong attempts are limited per link")
+
+	open, err := s.Shorten(ctx, "http://c.com/", "user", LinkSettings{})
+	require.NoError(t, err)
+	redirect, err = s.RestoreOrigin(ctx, open, "")
+	require.NoError(t, err)
+	assert.False(t, redirect.Protected)
+}
+
+// ForEach walks links of the user, tests do not depend on their order
+func (r *linkRepository) ForEach(_ context.Context, user string, fn func(*domain.URL) error) error {
+	for _, url := range r.urls {
+		url := url
+		if url.Owner != user {
+			continue
+		}
+		if err := fn(&url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Click counts clicks down like storages do
+func (r *linkRepository) Click(_ context.Context, key string) error {
+	url, ok := r.urls[key]
+	if !ok {
+		return ErrNotFound
+	}
+	if url.MaxClicks > 0 {
+		if url.ClicksLeft == 0 {
+			return ErrExhausted
+		}
+		url.ClicksLeft--
+		r.urls[key] = url
+	}
+	return nil
+}
+
+func TestShorten_MaxClicks(t *testing.T) {
+	ctx := context.Background()
+	repo := &linkRepository{urls: make(map[string]domain.URL)}
+	s := NewShorten(domain.NewShortener(&sequenceGenerator{}), repo, WithPolicy(blockedHost("evil.com")))
+
+	_, err := s.Shorten(ctx, "http://a.com/", "user", LinkSettings{MaxClicks: -1})
+	assert.Equal(t, KindInvalidInput, KindOf(err))
+
+	once, err := s.Shorten(ctx, "http://a.com/", "user", LinkSettings{MaxClicks: 1, Password: "secret"})
+	require.NoError(t, err)
+	_, err = s.RestoreOrigin(ctx, once, "wrong")
+	assert.Equal(t, KindUnauthorized, KindOf(err))
+	assert.Equal(t, 1, repo.urls[once].ClicksLeft, "wrong passwords do not use clicks up")
+
+	redirect, err := s.RestoreOrigin(ctx, once, "secret")
+	require.NoError(t, err)
+	assert.True(t, redirect.Limited)
+	assert.False(t, redirect.Cacheable())
+	_, err = s.RestoreOrigin(ctx, once, "secret")
+	assert.Equal(t, KindGone, KindOf(err))
+
+	blocked := domain.URL{Short: "blocked", Orig: "http://evil.com/", MaxClicks: 1, ClicksLeft: 1}
+	repo.urls[blocked.Short] = blocked
+	_, err = s.RestoreOrigin(ctx, blocked.Short, "")
+	assert.Equal(t, KindBlocked, KindOf(err))
+	assert.Equal(t, 1, repo.urls[blocked.Short].ClicksLeft, "blocked destinations do not use clicks up")
+
+	open, err := s.Shorten(ctx, "http://b.com/", "user", LinkSettings{Redirect: 308})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		redirect, err = s.RestoreOrigin(ctx, open, "")
+		require.NoError(t, err)
+	}
+	assert.True(t, redirect.Cacheable())
+
+	// export tells clicks of limited links only
+	exported := make(map[string]ExportItem)
+	require.NoError(t, s.Export(ctx, "user", func(item ExportItem) error {
+		exported[item.ShortURL] = item
+		return nil
+	}))
+	require.Len(t, exported, 2)
+	used := 1
+	assert.Equal(t, StatusUsedUp, exported[once].Status)
+	assert.Equal(t, &used, exported[once].Clicks)
+	assert.Equal(t, 1, exported[once].MaxClicks)
+	assert.Equal(t, StatusActive, exported[open].Status)
+	assert.Nil(t, exported[open].Clicks)
+	assert.Zero(t, exported[open].MaxClicks)
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	l := newAttemptLimiter(2, time.Minute)
+	start := time.Now()
+
+	assert.True(t, l.allow("a", start))
+	assert.True(t, l.allow("a", start.Add(time.Second)))
+	assert.False(t, l.allow("a", start.Add(2*time.Second)))
+	assert.True(t, l.allow("b", start.Add(2*time.Second)), "links are limited on their own")
+	assert.True(t, l.allow("a", start.Add(time.Minute)), "window is over")
+
+	l.allow("c", start.Add(3*time.Minute))
+	assert.Len(t, l.links, 1, "windows which are over are forgotten")
+}
+
+// fakeClock is moved by tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestShorten_Window(t *testing.T) {
+	ctx := context.Background()
+	launch := time.Date(2022, 3, 4, 5, 0, 0, 0, time.UTC)
+	end := launch.Add(24 * time.Hour)
+	clock := &fakeClock{now: launch.Add(-time.Hour)}
+	repo := &linkRepository{urls: make(map[string]domain.URL)}
+	s := NewShorten(domain.NewShortener(&sequenceGenerator{}), repo, WithClock(clock.Now))
+
+	_, err := s.Shorten(ctx, "http://a.com/", "user", LinkSettings{NotBefore: &end, NotAfter: &launch})
+	assert.Equal(t, KindInvalidInput, KindOf(err), "window must not be empty")
+	_, err = s.Shorten(ctx, "http://a.com/", "user", LinkSettings{PlaceholderURL: "http://soon.com/"})
+	assert.Equal(t, KindInvalidInput, KindOf(err), "placeholder needs a start")
+
+	campaign, err := s.Shorten(ctx, "http://a.com/", "user", LinkSettings{
+		Redirect:       301,
+		NotBefore:      &launch,
+		NotAfter:       &end,
+		PlaceholderURL: "http://soon.com/",
+		FallbackURL:    "http://over.com/",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, clock.now, repo.urls[campaign].CreatedAt, "links are created by the clock")
+	hidden, err := s.Shorten(ctx, "http://b.com/", "user", LinkSettings{NotBefore: &launch, NotAfter: &end})
+	require.NoError(t, err)
+	assertStatus := func(status string) {
+		t.Helper()
+		for _, url := range repo.urls {
+			assert.Equal(t, status, s.status(&url), url.Short)
+		}
+	}
+
+	// before the window
+	redirect, err := s.RestoreOrigin(ctx, campaign, "")
+	require.NoError(t, err)
+	assert.Equal(t, Redirect{Location: "http://soon.com/", Status: 307, Scheduled: true}, redirect)
+	_, err = s.RestoreOrigin(ctx, hidden, "")
+	assert.Equal(t, KindNotFound, KindOf(err))
+	assertStatus(StatusScheduled)
+
+	// within the window, its start is included
+	clock.now = launch
+	redirect, err = s.RestoreOrigin(ctx, campaign, "")
+	require.NoError(t, err)
+	assert.Equal(t, Redirect{Location: "http://a.com/", Status: 301, Scheduled: true}, redirect)
+	assert.False(t, redirect.Cacheable(), "redirect must not outlive the window")
+	_, err = s.RestoreOrigin(ctx, hidden, "")
+	require.NoError(t, err)
+	assertStatus(StatusActive)
+
+	// after the window, its end is excluded
+	clock.now = end
+	redirect, err = s.RestoreOrigin(ctx, campaign, "")
+	require.NoError(t, err)
+	assert.Equal(t, "http://over.com/", redirect.Location)
+	_, err = s.RestoreOrigin(ctx, hidden, "")
+	assert.Equal(t, KindGone, KindOf(err))
+	assertStatus(StatusExpired)
+}
@@ -1,15 +1,59 @@
 package usecase
 
+import "time"
+
+// LinkSettings are optional settings link creator chooses, zero values mean server defaults
+type LinkSettings struct {
+	// Redirect is one of 301, 302, 307 and 308
+	Redirect int `json:"redirect,omitempty"`
+	// Password protects the link, it is stored as a hash only
+	Password string `json:"password,omitempty"`
+	// MaxClicks makes the link work that many times only
+	MaxClicks int `json:"max_clicks,omitempty"`
+	// NotBefore and NotAfter bound when the link works, PlaceholderURL is followed
+	// before the window and FallbackURL after it
+	NotBefore      *time.Time `json:"not_before,omitempty"`
+	NotAfter       *time.Time `json:"not_after,omitempty"`
+	PlaceholderURL string     `json:"placeholder_url,omitempty"`
+	FallbackURL    string     `json:"fallback_url,omitempty"`
+}
+
 // Correlation is an input DTO for batching
 type Correlation struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	LinkSettings
+}
+
+// Redirect is where a short link leads and HTTP status it redirects with
+type Redirect struct {
+	Location string
+	Status   int
+	// Protected redirects are given after a password only, Limited ones count every click
+	// and Scheduled ones change when the window of the link opens or closes
+	Protected bool
+	Limited   bool
+	Scheduled bool
+}
+
+// Permanent tells if redirect is permanent by its status
+func (r Redirect) Permanent() bool {
+	return r.Status == 301 || r.Status == 308
+}
+
+// Cacheable tells if redirect may be cached by clients, redirects checked on every click never are
+func (r Redirect) Cacheable() bool {
+	return r.Permanent() && !r.Protected && !r.Limited && !r.Scheduled
 }
 
-// OutputBatchItem is an output DTO for batching
+// OutputBatchItem is an output DTO for batching,
+// holds either short url or an error if the item was rejected.
+// Conflict tells that the url was shortened before and short url is the existing one
 type OutputBatchItem struct {
 	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	ShortURL      string `json:"short_url,omitempty"`
+	Conflict      bool   `json:"conflict,omitempty"`
+	Error         string `json:"error,omitempty"`
 }
 
 // OutputUserLinksListItem is output DTO to represent all User links
@@ -17,3 +61,38 @@ type OutputUserLinksListItem struct {
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
 }
+
+// Link statuses shown to User
+const (
+	StatusActive    = "active"
+	StatusBlocked   = "blocked"
+	StatusScheduled = "scheduled"
+	StatusExpired   = "expired"
+	StatusUsedUp    = "used_up"
+)
+
+// ExportItem is output DTO to represent a User link with its metadata
+type ExportItem struct {
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	Status      string    `json:"status"`
+	// Clicks are counted for links with limited clicks only
+	Clicks    *int `json:"clicks,omitempty"`
+	MaxClicks int  `json:"max_clicks,omitempty"`
+}
+
+// LinkVersions is output DTO to represent a User link with its previous originals, the current one is the last version
+type LinkVersions struct {
+	ShortURL    string        `json:"short_url"`
+	OriginalURL string        `json:"original_url"`
+	Version     int           `json:"version"`
+	History     []LinkVersion `json:"history"`
+}
+
+// LinkVersion is a previous original of a User link
+type LinkVersion struct {
+	Version     int       `json:"version"`
+	OriginalURL string    `json:"original_url"`
+	ReplacedAt  time.Time `json:"replaced_at"`
+}
@@ -1,7 +1,9 @@
 package usecase
 
+import "context"
+
 type ServicePinger interface {
-	Ping() error
+	Ping(context.Context) error
 }
 
 type Liveliness struct {
@@ -14,8 +16,8 @@ func NewLiveliness(p ServicePinger) *Liveliness {
 	}
 }
 
-func (l *Liveliness) Do() error {
-	err := l.service.Ping()
+func (l *Liveliness) Do(ctx context.Context) error {
+	err := l.service.Ping(ctx)
 	if err != nil {
 		// figure out what to do with error
 		// process somehow
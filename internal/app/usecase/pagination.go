@@ -0,0 +1,86 @@
+package usecase
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aidlatyp/ya-pr-shortener/internal/app/domain"
+)
+
+const (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+// Cursor points to the last link of a page, the next page starts right after it.
+// Links are ordered by creation time and then by short id, so the position is stable
+type Cursor struct {
+	CreatedAt time.Time
+	Short     string
+}
+
+// After reports if url goes after cursor in ascending order
+func (c Cursor) After(url *domain.URL) bool {
+	if url.CreatedAt.Equal(c.CreatedAt) {
+		return url.Short > c.Short
+	}
+	return url.CreatedAt.After(c.CreatedAt)
+}
+
+// Encode represents cursor as opaque url safe string
+func (c Cursor) Encode() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.Short
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(encoded string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, NewError(KindInvalidInput, err, "Sorry, cursor is malformed")
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, NewError(KindInvalidInput, errors.New("cursor has no separator"), "Sorry, cursor is malformed")
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, NewError(KindInvalidInput, err, "Sorry, cursor is malformed")
+	}
+	return &Cursor{
+		CreatedAt: time.Unix(0, nanos).UTC(),
+		Short:     parts[1],
+	}, nil
+}
+
+// PageQuery describes which part of user links is requested
+type PageQuery struct {
+	Limit int
+	// After is a position to continue from, nil for the first page
+	After *Cursor
+	// Desc orders newest links first
+	Desc bool
+	// Contains filters links by substring of original url
+	Contains string
+	// CreatedAfter filters links created strictly after given time, zero time means no filter
+	CreatedAfter time.Time
+}
+
+// Match reports if url passes query filters
+func (q PageQuery) Match(url *domain.URL) bool {
+	if q.Contains != "" && !strings.Contains(url.Orig, q.Contains) {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !url.CreatedAt.After(q.CreatedAfter) {
+		return false
+	}
+	return true
+}
+
+// Page is a part of user links, Next is nil on the last page
+type Page struct {
+	URLs []*domain.URL
+	Next *Cursor
+}
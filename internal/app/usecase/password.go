@@ -0,0 +1,129 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrPasswordRequired is wrapped by errors of links which are followed with a password only
+var ErrPasswordRequired = errors.New("password required")
+
+// MaxPasswordLength is the longest password bcrypt takes into account
+const MaxPasswordLength = 72
+
+// Password attempts each link takes unless WithPasswordAttempts says otherwise
+const (
+	DefaultPasswordAttempts = 5
+	DefaultPasswordWindow   = time.Minute
+)
+
+// WithPasswordAttempts bounds how many wrong passwords are tried for a link per window,
+// so a protected link can't be guessed by brute force
+func WithPasswordAttempts(limit int, window time.Duration) Option {
+	return func(s *Shorten) {
+		if limit > 0 && window > 0 {
+			s.attempts = newAttemptLimiter(limit, window)
+		}
+	}
+}
+
+// hashPassword makes a hash to store with the link, empty password means the link is open
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	if len(password) > MaxPasswordLength {
+		return "", NewError(KindInvalidInput, fmt.Errorf("password of %v bytes is too long", len(password)),
+			fmt.Sprintf("Sorry, password must not be longer than %v bytes", MaxPasswordLength))
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", NewError(KindInternal, err, "")
+	}
+	return string(hash), nil
+}
+
+// checkPassword lets a protected link be followed with its password, wrong passwords only are attempts.
+// An attempt is taken before the slow check and given back when the password is right,
+// so concurrent guesses can't all pass the limit while being checked
+func (s *Shorten) checkPassword(id string, hash string, password string) error {
+	if hash == "" {
+		return nil
+	}
+	if password == "" {
+		return NewError(KindUnauthorized, ErrPasswordRequired, "This link is protected with a password")
+	}
+	if !s.attempts.allow(id, s.clock()) {
+		return NewError(KindRateLimited, fmt.Errorf("too many attempts of link %v", id),
+			"Sorry, too many wrong passwords, try again later")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return NewError(KindUnauthorized, fmt.Errorf("wrong password of link %v: %w", id, ErrPasswordRequired),
+			"Sorry, the password is wrong")
+	}
+	s.attempts.giveBack(id)
+	return nil
+}
+
+// attemptLimiter counts attempts of every link in fixed windows
+type attemptLimiter struct {
+	mutex  sync.Mutex
+	limit  int
+	window time.Duration
+	links  map[string]*attempts
+	// sweepAt is when windows which are over are forgotten
+	sweepAt time.Time
+}
+
+type attempts struct {
+	count int
+	until time.Time
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		limit:  limit,
+		window: window,
+		links:  make(map[string]*attempts),
+	}
+}
+
+// allow takes an attempt of the link and reports if it is within the limit, attempts over it are not counted
+func (l *attemptLimiter) allow(id string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.After(l.sweepAt) {
+		for key, a := range l.links {
+			if !now.Before(a.until) {
+				delete(l.links, key)
+			}
+		}
+		l.sweepAt = now.Add(l.window)
+	}
+
+	a, ok := l.links[id]
+	if !ok || !now.Before(a.until) {
+		a = &attempts{until: now.Add(l.window)}
+		l.links[id] = a
+	}
+	if a.count >= l.limit {
+		return false
+	}
+	a.count++
+	return true
+}
+
+// giveBack forgets an attempt of the link which turned out to be right
+func (l *attemptLimiter) giveBack(id string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if a, ok := l.links[id]; ok && a.count > 0 {
+		a.count--
+	}
+}
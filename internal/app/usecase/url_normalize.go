@@ -0,0 +1,83 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// defaultPorts are dropped from host while normalizing as they do not change the destination
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// normalizeURL parses raw url, accepts only absolute http and https URLs and brings them
+// to canonical form, so the same destination written differently is stored once
+func normalizeURL(raw string, sortQuery bool) (string, error) {
+
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", NewError(KindInvalidInput, err, "Sorry, given string is not a URL")
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	defaultPort, ok := defaultPorts[parsed.Scheme]
+	if !ok {
+		return "", NewError(KindInvalidInput,
+			fmt.Errorf("unsupported scheme %q", parsed.Scheme),
+			"Sorry, only http and https URLs can be shortened")
+	}
+
+	// trailing dot of fully qualified name does not change the destination,
+	// without it evil.com. would pass rules of evil.com
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	if host == "" {
+		return "", NewError(KindInvalidInput, errors.New("url has no host"), "Sorry, given URL has no host")
+	}
+	if parsed.User != nil {
+		return "", NewError(KindInvalidInput, errors.New("url has credentials"), "Sorry, URLs with credentials can not be shortened")
+	}
+
+	port := parsed.Port()
+	if port == "" || port == defaultPort {
+		if strings.Contains(host, ":") {
+			// IPv6 literal
+			host = "[" + host + "]"
+		}
+		parsed.Host = host
+	} else {
+		parsed.Host = net.JoinHostPort(host, port)
+	}
+
+	if sortQuery && parsed.RawQuery != "" {
+		parsed.RawQuery = sortRawQuery(parsed.RawQuery)
+	}
+
+	return parsed.String(), nil
+}
+
+// sortRawQuery orders query parameters by key and keeps order of values with the same key.
+// Parameters are not decoded, so escaping stays as given and + is not taken for %20
+// or back, only empty parameters, which mean nothing, are dropped
+func sortRawQuery(rawQuery string) string {
+	params := make([]string, 0, strings.Count(rawQuery, "&")+1)
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+	key := func(param string) string {
+		if i := strings.Index(param, "="); i >= 0 {
+			return param[:i]
+		}
+		return param
+	}
+	sort.SliceStable(params, func(i, j int) bool {
+		return key(params[i]) < key(params[j])
+	})
+	return strings.Join(params, "&")
+}
@@ -1,6 +1,135 @@
 package usecase
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned by storages when requested entity does not exist,
+// usually wrapped with the key that was looked for
+var ErrNotFound = errors.New("not found")
+
+// ErrExhausted is returned by storages when a link with limited clicks has none left
+var ErrExhausted = errors.New("no clicks left")
+
+// ErrReadOnly is wrapped by errors of storages which take no writes, writes are served by another instance
+var ErrReadOnly = errors.New("storage is read only")
+
+// ErrorKind classifies usecase layer errors, so any delivery layer
+// can decide how to represent an error without knowing its origin
+type ErrorKind int
+
+const (
+	KindInternal ErrorKind = iota
+	KindInvalidInput
+	KindUnauthorized
+	KindNotFound
+	KindConflict
+	KindUnavailable
+	KindBlocked
+	KindRateLimited
+	KindGone
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindInvalidInput:
+		return "invalid-input"
+	case KindUnauthorized:
+		return "unauthorized"
+	case KindNotFound:
+		return "not-found"
+	case KindConflict:
+		return "conflict"
+	case KindUnavailable:
+		return "unavailable"
+	case KindBlocked:
+		return "blocked"
+	case KindRateLimited:
+		return "rate-limited"
+	case KindGone:
+		return "gone"
+	default:
+		return "internal"
+	}
+}
+
+// Error represents usecase layer error of some kind with wrapped
+// context error, like ErrAlreadyExists can be logged and contain User understandable message
+type Error struct {
+	Kind      ErrorKind
+	Err       error
+	PrettyMsg string
+}
+
+func NewError(kind ErrorKind, err error, prettyMsg string) Error {
+	return Error{
+		Kind:      kind,
+		Err:       err,
+		PrettyMsg: prettyMsg,
+	}
+}
+
+func (e Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v error", e.Kind)
+	}
+	return fmt.Sprintf("%v error %v", e.Kind, e.Err)
+}
+
+func (e Error) Unwrap() error {
+	return e.Err
+}
+
+func (e Error) Pretty() string {
+	if e.PrettyMsg != "" {
+		return e.PrettyMsg
+	}
+	switch e.Kind {
+	case KindInvalidInput:
+		return "Sorry, your request can not be processed as is"
+	case KindUnauthorized:
+		return "Sorry, we can not recognize you"
+	case KindNotFound:
+		return "Sorry, nothing found"
+	case KindUnavailable:
+		return "Sorry, service is temporarily unavailable"
+	case KindBlocked:
+		return "Sorry, this destination is blocked"
+	case KindRateLimited:
+		return "Sorry, too many requests, try again later"
+	case KindGone:
+		return "Sorry, this link is no longer available"
+	default:
+		return "Sorry, something went wrong"
+	}
+}
+
+// KindOf reports the kind of usecase layer error,
+// errors unknown to usecase layer are internal ones
+func KindOf(err error) ErrorKind {
+	var kindErr Error
+	if errors.As(err, &kindErr) {
+		return kindErr.Kind
+	}
+	if errors.As(err, &ErrAlreadyExists{}) {
+		return KindConflict
+	}
+	return KindInternal
+}
+
+// PrettyOf returns User understandable message for any error
+func PrettyOf(err error) string {
+	var kindErr Error
+	if errors.As(err, &kindErr) {
+		return kindErr.Pretty()
+	}
+	var existsErr ErrAlreadyExists
+	if errors.As(err, &existsErr) {
+		return existsErr.Pretty()
+	}
+	return Error{Kind: KindInternal}.Pretty()
+}
 
 // ErrAlreadyExists represents usecase layer error with wrapped
 // context error, can be logged and contain User understandable message
@@ -20,7 +149,22 @@ func (e ErrAlreadyExists) Error() string {
 	return fmt.Sprintf("duplication error %v", e.ExistShortenID)
 }
 
+func (e ErrAlreadyExists) Unwrap() error {
+	return e.Err
+}
+
 func (e ErrAlreadyExists) Pretty() string {
 	// Could be a message from PrettyMsg in real
 	return fmt.Sprintf("Sorry, you have already saved this url %v ", e.Orig)
 }
+
+// ErrBatchConflicts is returned by BatchWrite when some links of a batch are not written
+// because their owners have already shortened the same urls, the rest of the batch is written
+type ErrBatchConflicts struct {
+	// Conflicts maps index of a link in the batch to the link which already exists
+	Conflicts map[int]ErrAlreadyExists
+}
+
+func (e ErrBatchConflicts) Error() string {
+	return fmt.Sprintf("%v links of batch already exist", len(e.Conflicts))
+}
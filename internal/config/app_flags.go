@@ -7,6 +7,7 @@ type AppFlags struct {
 	baseURL     *string
 	fileName    *string
 	databaseDSN *string
+	migrateOnly *bool
 }
 
 // Addr and other methods to get unexported fields
@@ -28,12 +29,17 @@ func (p *AppFlags) DatabaseDSN() string {
 	return *p.databaseDSN
 }
 
+func (p *AppFlags) MigrateOnly() bool {
+	return *p.migrateOnly
+}
+
 func parseFlags() AppFlags {
 	parsed := AppFlags{}
 	parsed.addr = pflag.StringP("a", "a", "", "Host IP address")
 	parsed.baseURL = pflag.StringP("b", "b", "", "Base URL")
 	parsed.fileName = pflag.StringP("f", "f", "", "Filename to store URLs")
 	parsed.databaseDSN = pflag.StringP("d", "d", "", "Connection string for DB")
+	parsed.migrateOnly = pflag.Bool("migrate-only", false, "Migrate database schema and exit")
 	pflag.Parse()
 	return parsed
 }
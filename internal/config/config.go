@@ -10,6 +10,21 @@ import (
 // ShortenedURLLen configure "main functionality"
 const ShortenedURLLen int = 5
 
+// Replication roles
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// Storage engines
+const (
+	EngineMemory   = "memory"
+	EngineFile     = "file"
+	EnginePostgres = "postgres"
+	EngineBolt     = "bolt"
+	EngineSQLite   = "sqlite"
+)
+
 // AppConfig is application specific configuration.
 type AppConfig struct {
 	BaseURL       string `env:"BASE_URL"`
@@ -17,6 +32,63 @@ type AppConfig struct {
 	ServerTimeout int64  `env:"SERVER_TIMEOUT"`
 	ServerAddr    string `env:"SERVER_ADDRESS"`
 	DBConnect     string `env:"DATABASE_DSN"`
+	// AdminAddr is a listener of metrics for operators only, empty one does not serve them
+	AdminAddr string `env:"ADMIN_ADDRESS"`
+	// StorageEngine is one of memory, file, postgres, bolt or sqlite, empty one means
+	// Postgres if it connects, file if path is set and memory otherwise
+	StorageEngine string `env:"STORAGE_ENGINE"`
+	// FileKeys seal records of file log, keys are id:base64 separated by commas, FileKeyFile has more
+	// of them one per line. The first key is current, the rest only open records sealed before rotation
+	FileKeys    string `env:"FILE_ENCRYPTION_KEYS"`
+	FileKeyFile string `env:"FILE_ENCRYPTION_KEY_FILE"`
+	// ReplicationRole is leader or follower of file storage replication, empty one does not replicate.
+	// Follower tails log of ReplicationLeader base URL, leader serves it to followers with ReplicationToken
+	ReplicationRole   string `env:"REPLICATION_ROLE"`
+	ReplicationLeader string `env:"REPLICATION_LEADER"`
+	ReplicationToken  string `env:"REPLICATION_TOKEN"`
+	// MemoryShards spreads memory storage over independently locked shards, zero keeps a single lock
+	MemoryShards int `env:"MEMORY_SHARDS"`
+	// MemoryMaxLinks and MemoryMaxBytes bound links held in memory by memory and file engines, zero is no bound.
+	// Past them cold links are read back from file log, without one MemoryEviction says if they spill or drop
+	MemoryMaxLinks int    `env:"MEMORY_MAX_LINKS"`
+	MemoryMaxBytes int64  `env:"MEMORY_MAX_BYTES"`
+	MemoryEviction string `env:"MEMORY_EVICTION"`
+	// BoltPath is a file of bolt engine, BoltBackupPath gets its copy every BoltBackupInterval seconds
+	BoltPath           string `env:"BOLT_PATH"`
+	BoltBackupPath     string `env:"BOLT_BACKUP_PATH"`
+	BoltBackupInterval int64  `env:"BOLT_BACKUP_INTERVAL"`
+	// SQLitePath is a database file of sqlite engine, writers wait SQLiteBusyTimeout milliseconds for each other
+	SQLitePath        string `env:"SQLITE_PATH"`
+	SQLiteBusyTimeout int64  `env:"SQLITE_BUSY_TIMEOUT"`
+	// Postgres pool, zero sizes keep pgx defaults, timeouts are in seconds
+	DBMaxConns        int32 `env:"DATABASE_MAX_CONNS"`
+	DBMinConns        int32 `env:"DATABASE_MIN_CONNS"`
+	DBConnectTimeout  int64 `env:"DATABASE_CONNECT_TIMEOUT"`
+	DBQueryTimeout    int64 `env:"DATABASE_QUERY_TIMEOUT"`
+	DBMaxConnIdleTime int64 `env:"DATABASE_MAX_CONN_IDLE_TIME"`
+	// SortQuery makes URLs be normalized with sorted query parameters
+	SortQuery bool `env:"NORMALIZE_SORT_QUERY"`
+	// PolicyFile holds destinations block and allow rules, it is reloaded every PolicyReloadInterval
+	// seconds if modified, zero interval loads it once
+	PolicyFile           string `env:"POLICY_FILE"`
+	PolicyReloadInterval int64  `env:"POLICY_RELOAD_INTERVAL"`
+	PolicyWarningPage    bool   `env:"POLICY_WARNING_PAGE"`
+	// RedirectCode is a status of links created without one, permanent redirects
+	// are cached by clients for RedirectMaxAge seconds
+	RedirectCode   int   `env:"REDIRECT_CODE"`
+	RedirectMaxAge int64 `env:"REDIRECT_MAX_AGE"`
+	// PasswordAttempts bounds wrong passwords tried for a protected link per PasswordWindow seconds
+	PasswordAttempts int   `env:"PASSWORD_ATTEMPTS"`
+	PasswordWindow   int64 `env:"PASSWORD_WINDOW"`
+	// CacheSize bounds links cached in front of storage, zero disables cache, TTLs are in seconds
+	CacheSize        int   `env:"CACHE_SIZE"`
+	CacheTTL         int64 `env:"CACHE_TTL"`
+	CacheNegativeTTL int64 `env:"CACHE_NEGATIVE_TTL"`
+	// MigrateFrom is a storage every link is copied from on start, see transfer.Open.
+	// History of changed originals is not copied
+	MigrateFrom string `env:"MIGRATE_FROM"`
+	// MigrateOnly makes server migrate database schema and exit
+	MigrateOnly bool `env:"MIGRATE_ONLY"`
 	sync.Once
 }
 
@@ -26,6 +98,7 @@ type FlagGetter interface {
 	Filename() string
 	Addr() string
 	DatabaseDSN() string
+	MigrateOnly() bool
 }
 
 // App do not support hot configuration reload
@@ -55,7 +128,41 @@ func (a *AppConfig) configure(appFlags FlagGetter) {
 	a.FilePath = ""
 	a.ServerTimeout = 30
 	a.ServerAddr = ":8080"
+	a.AdminAddr = ""
 	a.DBConnect = ""
+	a.StorageEngine = ""
+	a.FileKeys = ""
+	a.FileKeyFile = ""
+	a.ReplicationRole = ""
+	a.ReplicationLeader = ""
+	a.ReplicationToken = ""
+	a.MemoryShards = 0
+	a.MemoryMaxLinks = 0
+	a.MemoryMaxBytes = 0
+	a.MemoryEviction = "spill"
+	a.BoltPath = "shortener.db"
+	a.BoltBackupPath = ""
+	a.BoltBackupInterval = 3600
+	a.SQLitePath = "shortener.sqlite"
+	a.SQLiteBusyTimeout = 5000
+	a.DBMaxConns = 0
+	a.DBMinConns = 0
+	a.DBConnectTimeout = 5
+	a.DBQueryTimeout = 10
+	a.DBMaxConnIdleTime = 0
+	a.SortQuery = false
+	a.PolicyFile = ""
+	a.PolicyReloadInterval = 10
+	a.PolicyWarningPage = false
+	a.RedirectCode = 307
+	a.RedirectMaxAge = 86400
+	a.PasswordAttempts = 5
+	a.PasswordWindow = 60
+	a.CacheSize = 0
+	a.CacheTTL = 60
+	a.CacheNegativeTTL = 5
+	a.MigrateFrom = ""
+	a.MigrateOnly = false
 
 	// Configure with ENV vars
 	// Middle priority
@@ -78,6 +185,9 @@ func (a *AppConfig) configure(appFlags FlagGetter) {
 	if appFlags.DatabaseDSN() != "" {
 		a.DBConnect = appFlags.DatabaseDSN()
 	}
+	if appFlags.MigrateOnly() {
+		a.MigrateOnly = true
+	}
 
 	a.BaseURL += "/"
 }